@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"context"
 	"fmt"
 	"github.com/go-resty/resty/v2"
 	ps "github.com/jetrmm/go-sysinfo"
@@ -15,6 +16,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"time"
 	// _ "github.com/jetrmm/rmm-agent/agent/darwin"
@@ -60,6 +62,7 @@ type PackageManager interface {
 	InstallPackage(mgr string, name string) (string, error)
 	RemovePackage(mgr string, name string) (string, error)
 	UpdatePackage(mgr string, name string) (string, error)
+	PkgManagers() []string
 }
 
 // todo
@@ -99,11 +102,12 @@ type baseAgent interface {
 
 	RunTask(int) error
 	RunChecks(force bool) error
+	CheckTypes() []string
 	RunScript(code string, shell string, args []string, timeout int) (stdout, stderr string, exitcode int, e error)
+	RunScriptContext(ctx context.Context, code string, shell string, args []string, timeout int) (stdout, stderr string, exitcode int, e error)
 	CheckIn(nc *nats.Conn, mode string)
 	CreateInternalTask(name, args, repeat string, start int) (bool, error)
 	CheckRunner()
-	GetCheckInterval() (int, error)
 
 	// Transmit
 	SendSoftware()
@@ -138,8 +142,15 @@ type IAgent interface {
 type Agent struct {
 	IAgent
 	*AgentConfig
+	Store   ConfigStore
 	Logger  *logrus.Logger
 	RClient *resty.Client
+	Rpc     *RpcRegistry
+	Jobs    *JobManager
+	Outbox  *Outbox
+	Checks  *CheckScheduler
+
+	lifecycle
 }
 
 func (a *Agent) Start(s service.Service) error {
@@ -155,9 +166,33 @@ func (a *Agent) Start(s service.Service) error {
 
 func (a *Agent) Stop(s service.Service) error {
 	a.Logger.Info("Agent service is stopping")
+	a.Shutdown(AGENT_SHUTDOWN_GRACE)
+	a.Logger.Info("Agent service stopped")
 	return nil
 }
 
+// ProcessRpcMsg dispatches an incoming RPC (NATS) message to its registered handler
+func (a *Agent) ProcessRpcMsg(nc *nats.Conn, msg *nats.Msg) {
+	a.Rpc.Dispatch(nc, msg)
+}
+
+// Capabilities returns what this agent supports, advertised on hello and startup
+func (a *Agent) Capabilities() shared.AgentCapabilities {
+	protocol := RPC_PROTOCOL_VERSION
+	if a.Rpc.LegacyReplies {
+		protocol = 1
+	}
+	return shared.AgentCapabilities{
+		Protocol:    protocol,
+		GoOS:        runtime.GOOS,
+		GoArch:      runtime.GOARCH,
+		Functions:   a.Rpc.Functions(),
+		CheckTypes:  a.CheckTypes(),
+		PkgManagers: a.PkgManagers(),
+		Encodings:   Encodings,
+	}
+}
+
 // GetHostname from go-sysinfo package
 func (a *Agent) GetHostname() string {
 	sysHost, _ := ps.Host()
@@ -304,15 +339,6 @@ func (a *Agent) OSInfo() (plat, osFullName string) {
 	return
 }
 
-func TestTCP(addr string) error {
-	conn, err := net.Dial("tcp4", addr)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-	return nil
-}
-
 // IsValidIP checks for a valid IPv4 or IPv6 address
 func IsValidIP(ip string) bool {
 	return net.ParseIP(ip) != nil
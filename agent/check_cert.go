@@ -0,0 +1,219 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+// CertInfo describes a certificate checked by a certexpiry check
+type CertInfo struct {
+	Source     string    `json:"source"` // File or address the certificate was read from
+	Subject    string    `json:"subject"`
+	Issuer     string    `json:"issuer"`
+	NotAfter   time.Time `json:"not_after"`
+	DaysLeft   int       `json:"days_left"` // Negative once expired
+	ChainValid bool      `json:"chain_valid"`
+	ChainError string    `json:"chain_error,omitempty"`
+}
+
+// certChain is a certificate and the intermediates sent or stored along with it
+type certChain struct {
+	source string
+	certs  []*x509.Certificate
+}
+
+// CertExpiryCheck checks the certificate of a TLS endpoint, or the certificates of local files, see
+// shared.Check. The thresholds apply to the days left until the earliest expiry; the check fails
+// if a certificate expired, or its chain is not valid unless TLSInsecure.
+func (a *Agent) CertExpiryCheck(ctx context.Context, data shared.Check) {
+	payload := map[string]any{
+		"id": data.CheckPK,
+	}
+
+	var (
+		chains   []certChain
+		err      error
+		roots    *x509.CertPool
+		hostname string
+	)
+	if len(data.TLSCACert) > 0 {
+		roots, err = LoadCertPool(data.TLSCACert)
+	}
+	if err == nil {
+		if len(data.Path) > 0 {
+			chains, err = loadCertChains(data.Path)
+		} else if len(data.Host) == 0 {
+			err = errors.New("host or path required")
+		} else {
+			hostname = data.TLSServerName
+			if len(hostname) == 0 {
+				hostname = data.Host
+			}
+			chains, err = dialCertChain(ctx, data, hostname)
+		}
+	}
+	if err != nil {
+		a.Logger.Debugln("Certificate expiry check:", err)
+		payload["output"] = err.Error()
+		a.ReportCheck(data, payload, a.Checks.Status(data, shared.CHECK_STATUS_FAILING))
+		return
+	}
+
+	var (
+		certs  []CertInfo
+		levels []string
+	)
+	earliest := 0
+	for i, chain := range chains {
+		info := describeCert(chain, roots, hostname)
+		certs = append(certs, info)
+
+		level := CheckLevel(data, float64(info.DaysLeft), true)
+		if info.DaysLeft < 0 || (!info.ChainValid && !data.TLSInsecure) {
+			level = shared.CHECK_STATUS_FAILING
+		}
+		levels = append(levels, level)
+		if info.NotAfter.Before(certs[earliest].NotAfter) {
+			earliest = i
+		}
+	}
+	first := certs[earliest]
+	payload["certificates"] = certs
+	payload["days_left"] = first.DaysLeft
+	payload["output"] = fmt.Sprintf("%s (%s) expires in %d days", first.Subject, first.Source, first.DaysLeft)
+
+	a.ReportCheck(data, payload, a.Checks.Status(data, WorstLevel(levels...)))
+}
+
+// describeCert returns the expiry and chain validity of a certificate; the chain is verified for
+// hostname unless it is empty
+func describeCert(chain certChain, roots *x509.CertPool, hostname string) CertInfo {
+	cert := chain.certs[0]
+	info := CertInfo{
+		Source:   chain.source,
+		Subject:  cert.Subject.String(),
+		Issuer:   cert.Issuer.String(),
+		NotAfter: cert.NotAfter.UTC(),
+		DaysLeft: int(math.Floor(time.Until(cert.NotAfter).Hours() / 24)),
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		DNSName:       hostname,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, c := range chain.certs[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	if _, err := cert.Verify(opts); err != nil {
+		info.ChainError = err.Error()
+	} else {
+		info.ChainValid = true
+	}
+	return info
+}
+
+// dialCertChain returns the certificates a TLS endpoint presents for hostname
+func dialCertChain(ctx context.Context, data shared.Check, hostname string) ([]certChain, error) {
+	port := data.Port
+	if port == 0 {
+		port = 443
+	}
+	addr := net.JoinHostPort(data.Host, strconv.Itoa(port))
+
+	// the chain is verified afterwards, so that invalid certificates are still described
+	d := tls.Dialer{Config: &tls.Config{ServerName: hostname, InsecureSkipVerify: true}}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate presented by %s", addr)
+	}
+	return []certChain{{source: addr, certs: certs}}, nil
+}
+
+// loadCertChains reads a PEM or DER certificate file, or the certificate files of a directory,
+// skipping those which are not certificates, e.g. keys. The first certificate of a file is
+// checked, the others are its intermediates.
+func loadCertChains(path string) ([]certChain, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		certs, err := readCerts(path)
+		if err != nil {
+			return nil, err
+		}
+		return []certChain{{source: path, certs: certs}}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var ret []certChain
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		file := filepath.Join(path, e.Name())
+		if certs, err := readCerts(file); err == nil {
+			ret = append(ret, certChain{source: file, certs: certs})
+		}
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return ret, nil
+}
+
+// readCerts returns the certificates of a PEM or DER file
+func readCerts(file string) ([]*x509.Certificate, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for rest := b; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) > 0 {
+		return certs, nil
+	}
+
+	// not PEM, or PEM without certificates
+	if certs, err = x509.ParseCertificates(b); err != nil || len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate found in %s", file)
+	}
+	return certs, nil
+}
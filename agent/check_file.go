@@ -0,0 +1,166 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+// fileOwnership is the user and group owning a file, by id and by name if known
+type fileOwnership struct {
+	UID, User  string
+	GID, Group string
+}
+
+// fileCheckState is the state a file check keeps between runs
+type fileCheckState struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+}
+
+// FileCheck checks the existence, age, size, permissions and ownership of a file or directory,
+// and whether the content of a file changed since the previous run, see shared.Check.
+// The check fails if any of them is not as expected.
+func (a *Agent) FileCheck(ctx context.Context, data shared.Check) {
+	payload := map[string]any{
+		"id":   data.CheckPK,
+		"path": data.Path,
+	}
+
+	fi, err := os.Stat(data.Path)
+	if err != nil {
+		a.Logger.Debugln("File check", data.Path, err)
+		payload["exists"] = false
+		payload["output"] = err.Error()
+		a.ReportCheck(data, payload, a.Checks.Status(data, shared.CHECK_STATUS_FAILING))
+		return
+	}
+
+	var problems []string
+	age := time.Since(fi.ModTime())
+	payload["exists"] = true
+	payload["modified"] = fi.ModTime().UTC()
+	payload["age"] = int(age.Seconds())
+	payload["mode"] = fmt.Sprintf("%04o", fi.Mode().Perm())
+
+	if data.MaxAge > 0 && age > time.Duration(data.MaxAge)*time.Second {
+		problems = append(problems, fmt.Sprintf("modified %s ago, more than %ds", age.Round(time.Second), data.MaxAge))
+	}
+	if !fi.IsDir() {
+		payload["size"] = fi.Size()
+		if data.MinSize > 0 && fi.Size() < data.MinSize {
+			problems = append(problems, fmt.Sprintf("size %d bytes, less than %d", fi.Size(), data.MinSize))
+		}
+		if data.MaxSize > 0 && fi.Size() > data.MaxSize {
+			problems = append(problems, fmt.Sprintf("size %d bytes, more than %d", fi.Size(), data.MaxSize))
+		}
+	}
+	// Windows only reports whether a file is read-only
+	if len(data.Mode) > 0 && runtime.GOOS != "windows" {
+		if mode, err := strconv.ParseUint(data.Mode, 8, 32); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid mode %q", data.Mode))
+		} else if fi.Mode().Perm() != os.FileMode(mode).Perm() {
+			problems = append(problems, fmt.Sprintf("mode %04o, expected %04o", fi.Mode().Perm(), mode))
+		}
+	}
+	problems = append(problems, checkOwnership(data, fi, payload)...)
+
+	// the previous hash stays the baseline until the change alerts, so that it is reported on
+	// each run until then rather than only once
+	var baseline *fileCheckState
+	if data.TrackHash && !fi.IsDir() {
+		hash, err := fileHash(ctx, data.Path)
+		if err != nil {
+			problems = append(problems, err.Error())
+		} else {
+			payload["hash"] = hash
+			var st fileCheckState
+			if !a.Checks.LoadState(data.CheckPK, &st) || st.Path != data.Path {
+				a.saveFileState(data, fileCheckState{Path: data.Path, Hash: hash})
+			} else if st.Hash != hash {
+				payload["old_hash"] = st.Hash
+				problems = append(problems, fmt.Sprintf("content changed, SHA-256 %s, was %s", hash, st.Hash))
+				baseline = &fileCheckState{Path: data.Path, Hash: hash}
+			}
+		}
+	}
+
+	level := shared.CHECK_STATUS_PASSING
+	if len(problems) > 0 {
+		level = shared.CHECK_STATUS_FAILING
+		payload["output"] = strings.Join(problems, "\n")
+	} else {
+		payload["output"] = fmt.Sprintf("%s is as expected", data.Path)
+	}
+	status := a.Checks.Status(data, level)
+	if baseline != nil && status == shared.CHECK_STATUS_FAILING {
+		a.saveFileState(data, *baseline)
+	}
+	a.ReportCheck(data, payload, status)
+}
+
+func (a *Agent) saveFileState(data shared.Check, st fileCheckState) {
+	if err := a.Checks.SaveState(data.CheckPK, st); err != nil {
+		a.Logger.Debugln("File check", data.Path, err)
+	}
+}
+
+// checkOwnership adds the owner of a file to the payload of a file check, and returns how it
+// differs from the expected one
+func checkOwnership(data shared.Check, fi os.FileInfo, payload map[string]any) []string {
+	owner, ok := fileOwner(fi)
+	if !ok {
+		if len(data.Owner) > 0 || len(data.Group) > 0 {
+			return []string{"file ownership is not supported on this platform"}
+		}
+		return nil
+	}
+	payload["owner"] = owner.User
+	payload["group"] = owner.Group
+
+	var ret []string
+	if len(data.Owner) > 0 && data.Owner != owner.User && data.Owner != owner.UID {
+		ret = append(ret, fmt.Sprintf("owned by %s (%s), expected %s", owner.User, owner.UID, data.Owner))
+	}
+	if len(data.Group) > 0 && data.Group != owner.Group && data.Group != owner.GID {
+		ret = append(ret, fmt.Sprintf("group %s (%s), expected %s", owner.Group, owner.GID, data.Group))
+	}
+	return ret
+}
+
+// fileHash returns the SHA-256 of a file, hex encoded
+func fileHash(ctx context.Context, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, contextReader{ctx, f}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// contextReader stops reading once ctx is done, e.g. when hashing a large file times out
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+func TestFileCheck(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("modes and owners are not checked on Windows")
+	}
+	ta := newCheckTestAgent(t)
+	file := filepath.Join(t.TempDir(), "sudoers")
+	write := func(data string) {
+		if err := os.WriteFile(file, []byte(data), 0440); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("root ALL=(ALL) ALL\n")
+
+	check := shared.Check{
+		CheckPK:   1,
+		Path:      file,
+		MaxAge:    3600,
+		MinSize:   1,
+		MaxSize:   1024,
+		Mode:      "0440",
+		Owner:     strconv.Itoa(os.Getuid()),
+		TrackHash: true,
+	}
+	result := ta.runStatus(ta.FileCheck, check, passing)
+	hash, _ := result["hash"].(string)
+	if len(hash) != 64 {
+		t.Errorf("hash %v, want a SHA-256", result["hash"])
+	}
+	if _, err := os.Stat(ta.Checks.statePath(1)); err != nil {
+		t.Errorf("check state not saved: %v", err)
+	}
+
+	// a change alerts at once, with the previous hash
+	write("root ALL=(ALL) NOPASSWD: ALL\n")
+	result = ta.runStatus(ta.FileCheck, check, failing)
+	if result["old_hash"] != hash || result["hash"] == hash {
+		t.Errorf("changed: hash %v, old hash %v, want a new hash and %s", result["hash"], result["old_hash"], hash)
+	}
+	ta.runStatus(ta.FileCheck, check, passing)
+
+	// the previous hash is kept until the change alerts
+	check.FailsBeforeAlert = 2
+	write("root ALL=(ALL) ALL\n")
+	for i, want := range []string{passing, failing, passing} {
+		result := ta.runStatus(ta.FileCheck, check, want)
+		if (result["old_hash"] == nil) != (i == 2) {
+			t.Errorf("changed run %d: old hash %v", i+1, result["old_hash"])
+		}
+	}
+	check.FailsBeforeAlert = 0
+
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(file, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(file, 0644); err != nil {
+		t.Fatal(err)
+	}
+	result = ta.runStatus(ta.FileCheck, check, failing)
+	if output, _ := result["output"].(string); !strings.Contains(output, "modified") || !strings.Contains(output, "mode 0644") {
+		t.Errorf("stale: output %q, want the age and mode", output)
+	}
+
+	check = shared.Check{CheckPK: 1, Path: file, MaxSize: 4, Owner: "nosuchuser"}
+	result = ta.runStatus(ta.FileCheck, check, failing)
+	if output, _ := result["output"].(string); !strings.Contains(output, "more than 4") || !strings.Contains(output, "expected nosuchuser") {
+		t.Errorf("size and owner: output %q", output)
+	}
+
+	check.Path = file + ".missing"
+	if result := ta.runStatus(ta.FileCheck, check, failing); result["exists"] != false {
+		t.Errorf("missing: exists %v, want false", result["exists"])
+	}
+}
+
+func TestPruneStates(t *testing.T) {
+	ta := newCheckTestAgent(t)
+	s := ta.Checks
+	for pk := 1; pk <= 2; pk++ {
+		if err := s.SaveState(pk, map[string]int{"pk": pk}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{".tmp1", ".tmp2"} {
+		if err := os.WriteFile(filepath.Join(s.StateDir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * CHECK_STATE_TMP_MAX_AGE)
+	if err := os.Chtimes(filepath.Join(s.StateDir, ".tmp1"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// the state of check 2, and the stale temporary file, are removed
+	s.pruneStates(map[int]bool{1: true})
+	entries, err := os.ReadDir(s.StateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if want := []string{".tmp2", "1.json"}; !slices.Equal(names, want) {
+		t.Errorf("left %v, want %v", names, want)
+	}
+
+	var st map[string]int
+	if !s.LoadState(1, &st) || st["pk"] != 1 {
+		t.Errorf("state of check 1: %v", st)
+	}
+	if s.LoadState(2, &st) {
+		t.Error("state of check 2 loaded")
+	}
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+
+package agent
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// fileInode returns the inode number of a file
+func fileInode(fi os.FileInfo) (uint64, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(st.Ino), true
+}
+
+// fileOwner returns the user and group owning a file
+func fileOwner(fi os.FileInfo) (*fileOwnership, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, false
+	}
+	ret := &fileOwnership{
+		UID: strconv.FormatUint(uint64(st.Uid), 10),
+		GID: strconv.FormatUint(uint64(st.Gid), 10),
+	}
+	if u, err := user.LookupId(ret.UID); err == nil {
+		ret.User = u.Username
+	}
+	if g, err := user.LookupGroupId(ret.GID); err == nil {
+		ret.Group = g.Name
+	}
+	return ret, true
+}
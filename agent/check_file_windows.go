@@ -0,0 +1,15 @@
+package agent
+
+import (
+	"os"
+)
+
+// fileInode is not supported on Windows, where os.Stat does not return the file index
+func fileInode(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// fileOwner is not supported on Windows, where files are owned through their security descriptor
+func fileOwner(fi os.FileInfo) (*fileOwnership, bool) {
+	return nil, false
+}
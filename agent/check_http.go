@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+// HTTP_CHECK_MAX_BODY is the most of the response body read to match it
+const HTTP_CHECK_MAX_BODY = 1 << 20
+
+// HttpCheck requests a URL and checks the response status, body and time, see shared.Check.
+// The thresholds apply to the response time in milliseconds; the check fails if the request
+// fails, or the status or body do not match.
+func (a *Agent) HttpCheck(ctx context.Context, data shared.Check) {
+	payload := map[string]any{
+		"id":  data.CheckPK,
+		"url": data.URL,
+	}
+
+	level := shared.CHECK_STATUS_FAILING
+	resp, elapsed, err := httpCheckRequest(ctx, data)
+	if err != nil {
+		a.Logger.Debugln("Http check", data.URL, err)
+		payload["output"] = err.Error()
+	} else {
+		payload["status_code"] = resp.StatusCode
+		latency := milliseconds(elapsed)
+		payload["latency"] = latency
+		if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+			expiry := resp.TLS.PeerCertificates[0].NotAfter
+			payload["cert_expiry"] = expiry.UTC()
+			payload["cert_days_left"] = int(math.Floor(time.Until(expiry).Hours() / 24))
+		}
+
+		if err := httpCheckMatch(data, resp); err != nil {
+			payload["output"] = err.Error()
+		} else {
+			level = CheckLevel(data, latency, false)
+			payload["output"] = fmt.Sprintf("%s in %.2f ms", resp.Status, latency)
+		}
+	}
+
+	a.ReportCheck(data, payload, a.Checks.Status(data, level))
+}
+
+// LoadCertPool returns the certificates of a PEM file as a pool
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", file)
+	}
+	return pool, nil
+}
+
+// httpResponse is the part of a response an http check looks at
+type httpResponse struct {
+	*http.Response
+	body []byte
+}
+
+// httpCheckRequest sends the request of an http check and reads the response, returning the time
+// until the body was read
+func httpCheckRequest(ctx context.Context, data shared.Check) (*httpResponse, time.Duration, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: data.TLSInsecure,
+		ServerName:         data.TLSServerName,
+	}
+	if len(data.TLSCACert) > 0 {
+		var err error
+		if tlsConfig.RootCAs, err = LoadCertPool(data.TLSCACert); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	method := strings.ToUpper(data.Method)
+	if len(method) == 0 {
+		method = http.MethodGet
+	}
+	var body io.Reader
+	if len(data.Body) > 0 {
+		body = strings.NewReader(data.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, data.URL, body)
+	if err != nil {
+		return nil, 0, err
+	}
+	for k, v := range data.Headers {
+		if strings.EqualFold(k, "Host") {
+			req.Host = v
+		} else {
+			req.Header.Set(k, v)
+		}
+	}
+
+	transport := &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		TLSClientConfig:   tlsConfig,
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, HTTP_CHECK_MAX_BODY))
+	if err != nil {
+		return nil, 0, err
+	}
+	return &httpResponse{Response: resp, body: b}, time.Since(start), nil
+}
+
+// httpCheckMatch returns why a response does not match an http check, if it does not
+func httpCheckMatch(data shared.Check, resp *httpResponse) error {
+	if len(data.ExpectedStatus) > 0 {
+		if !slices.Contains(data.ExpectedStatus, resp.StatusCode) {
+			return fmt.Errorf("unexpected status %s, expected %v", resp.Status, data.ExpectedStatus)
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if len(data.BodyContains) > 0 && !strings.Contains(string(resp.body), data.BodyContains) {
+		return fmt.Errorf("body does not contain %q", data.BodyContains)
+	}
+	if len(data.BodyRegex) > 0 {
+		re, err := regexp.Compile(data.BodyRegex)
+		if err != nil {
+			return fmt.Errorf("invalid body regex: %w", err)
+		}
+		if !re.Match(resp.body) {
+			return fmt.Errorf("body does not match %q", data.BodyRegex)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+func TestHttpCheckMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		check  shared.Check
+		status int
+		body   string
+		ok     bool
+	}{
+		{"2xx by default", shared.Check{}, http.StatusNoContent, "", true},
+		{"not 2xx", shared.Check{}, http.StatusFound, "", false},
+		{"expected status", shared.Check{ExpectedStatus: []int{401, 403}}, http.StatusForbidden, "", true},
+		{"unexpected status", shared.Check{ExpectedStatus: []int{401}}, http.StatusOK, "", false},
+		{"contains", shared.Check{BodyContains: "healthy"}, http.StatusOK, "status: healthy", true},
+		{"does not contain", shared.Check{BodyContains: "healthy"}, http.StatusOK, "status: down", false},
+		{"matches", shared.Check{BodyRegex: "status: (healthy|degraded)"}, http.StatusOK, "status: degraded", true},
+		{"does not match", shared.Check{BodyRegex: "^ok$"}, http.StatusOK, "not ok", false},
+		{"invalid regex", shared.Check{BodyRegex: "("}, http.StatusOK, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &httpResponse{
+				Response: &http.Response{StatusCode: tt.status, Status: fmt.Sprintf("%d %s", tt.status, http.StatusText(tt.status))},
+				body:     []byte(tt.body),
+			}
+			if err := httpCheckMatch(tt.check, resp); (err == nil) != tt.ok {
+				t.Errorf("httpCheckMatch: %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestHttpCheck(t *testing.T) {
+	ta := newCheckTestAgent(t)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, "status: healthy")
+	}))
+	defer srv.Close()
+
+	check := shared.Check{
+		CheckPK:      1,
+		URL:          srv.URL,
+		Headers:      map[string]string{"X-Token": "secret"},
+		BodyContains: "healthy",
+		TLSInsecure:  true,
+	}
+	result := ta.runStatus(ta.HttpCheck, check, passing)
+	if code, _ := result["status_code"].(float64); code != http.StatusOK {
+		t.Errorf("status code %v, want %d", result["status_code"], http.StatusOK)
+	}
+	if _, ok := result["latency"].(float64); !ok {
+		t.Errorf("no latency: %v", result)
+	}
+	if days, _ := result["cert_days_left"].(float64); days <= 0 {
+		t.Errorf("cert days left %v, want > 0", result["cert_days_left"])
+	}
+
+	// the thresholds apply to the latency
+	check.WarningThreshold = 0.0001
+	ta.runStatus(ta.HttpCheck, check, warning)
+	check.WarningThreshold = 0
+
+	// the self-signed certificate is not trusted unless verification is skipped
+	check.TLSInsecure = false
+	ta.runStatus(ta.HttpCheck, check, failing)
+
+	check.TLSInsecure = true
+	check.Headers = nil
+	ta.runStatus(ta.HttpCheck, check, failing)
+}
@@ -0,0 +1,296 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+// Log file checks
+const (
+	LOGFILE_CHECK_MAX_LINES = 50       // Most matching lines reported, the latest
+	LOGFILE_CHECK_MAX_LINE  = 1024     // Longer lines are truncated
+	LOGFILE_CHECK_MAX_READ  = 16 << 20 // Lines read from a file per run, the rest is read by the next runs
+)
+
+// LogLine is a line matched by a logfile check
+type LogLine struct {
+	Time time.Time `json:"time"` // When the agent read it
+	File string    `json:"file"`
+	Line string    `json:"line"`
+}
+
+// logRun is the number of lines a run of a logfile check matched
+type logRun struct {
+	Time  time.Time `json:"time"`
+	Count int       `json:"count"`
+}
+
+// logFileOffset is where a logfile check stopped reading a file, and the file's size and
+// modification time then, to tell a new file reusing the inode of a removed one
+type logFileOffset struct {
+	Offset  int64     `json:"offset"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// logFileState is the state a logfile check keeps between runs
+type logFileState struct {
+	Path  string                   `json:"path"`
+	Files map[string]logFileOffset `json:"files"` // By file, see logFileID
+	Runs  []logRun                 `json:"runs"`  // Within the window
+	Lines []LogLine                `json:"lines"` // Within the window
+}
+
+// logScan reads log files for a logfile check
+type logScan struct {
+	ctx     context.Context
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+	now     time.Time
+	count   int
+	lines   []LogLine
+}
+
+// LogFileCheck reads the lines appended to the files matching a glob since the previous run, and
+// counts those matching the include and exclude regexes within the check's window, see shared.Check.
+// On the first run, the files modified within the window are read, up to LOGFILE_CHECK_MAX_READ
+// from their end, and the others from their end. A file renamed by log rotation is read to its end
+// before the new file is read. The check fails if the count exceeds the thresholds, see CountLevel,
+// or if any line matches when there are none.
+func (a *Agent) LogFileCheck(ctx context.Context, data shared.Check) {
+	payload := map[string]any{
+		"id":   data.CheckPK,
+		"path": data.Path,
+	}
+	fail := func(err error) {
+		a.Logger.Debugln("Log file check", data.Path, err)
+		payload["output"] = err.Error()
+		a.ReportCheck(data, payload, a.Checks.Status(data, shared.CHECK_STATUS_FAILING))
+	}
+
+	scan := &logScan{ctx: ctx, now: time.Now()}
+	var err error
+	if len(data.Include) > 0 {
+		if scan.include, err = regexp.Compile(data.Include); err != nil {
+			fail(fmt.Errorf("invalid include regex: %w", err))
+			return
+		}
+	}
+	if len(data.Exclude) > 0 {
+		if scan.exclude, err = regexp.Compile(data.Exclude); err != nil {
+			fail(fmt.Errorf("invalid exclude regex: %w", err))
+			return
+		}
+	}
+	files, err := filepath.Glob(data.Path)
+	if err == nil && len(files) == 0 {
+		err = fmt.Errorf("no file matches %s", data.Path)
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	var st logFileState
+	first := !a.Checks.LoadState(data.CheckPK, &st) || st.Path != data.Path || st.Files == nil
+	if first {
+		st = logFileState{Path: data.Path}
+	}
+	window := time.Duration(data.Window) * time.Second
+	read := make(map[string]logFileOffset)
+	scanFile := func(file string, fi os.FileInfo, id string, offset int64, resync bool) {
+		next, err := scan.file(file, offset, resync)
+		if err != nil {
+			a.Logger.Debugln("Log file check", file, err)
+		}
+		read[id] = logFileOffset{Offset: next, Size: fi.Size(), ModTime: fi.ModTime()}
+	}
+
+	// files still matching the glob, and new files
+	dirs := make(map[string]bool)
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		dirs[filepath.Dir(file)] = true
+		id := logFileID(file, fi)
+
+		prev, known := st.Files[id]
+		offset := prev.Offset
+		switch {
+		case first:
+			// the lines of the window can only be told by the file's modification time
+			offset = fi.Size()
+			if window > 0 && scan.now.Sub(fi.ModTime()) <= window {
+				offset = max(0, fi.Size()-LOGFILE_CHECK_MAX_READ)
+			}
+		case !known || fi.Size() < offset || prev.replacedBy(fi):
+			// new, truncated, or another file with the same inode
+			offset = 0
+		}
+		scanFile(file, fi, id, offset, first)
+	}
+
+	// files renamed by log rotation, no longer matching the glob
+	for dir := range dirs {
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			fi, err := e.Info()
+			if err != nil || !fi.Mode().IsRegular() {
+				continue
+			}
+			file := filepath.Join(dir, e.Name())
+			id := logFileID(file, fi)
+			prev, known := st.Files[id]
+			if _, seen := read[id]; seen || !known || prev.replacedBy(fi) {
+				continue
+			}
+			scanFile(file, fi, id, min(prev.Offset, fi.Size()), false)
+		}
+	}
+
+	// the matches within the window
+	st.Files = read
+	if window > 0 {
+		st.Runs = append(st.Runs, logRun{Time: scan.now, Count: scan.count})
+		st.Lines = append(st.Lines, scan.lines...)
+	} else {
+		st.Runs = []logRun{{Time: scan.now, Count: scan.count}}
+		st.Lines = scan.lines
+	}
+	count := 0
+	for i := len(st.Runs) - 1; i >= 0; i-- {
+		if scan.now.Sub(st.Runs[i].Time) > window {
+			st.Runs = st.Runs[i+1:]
+			break
+		}
+		count += st.Runs[i].Count
+	}
+	for i := len(st.Lines) - 1; i >= 0; i-- {
+		if scan.now.Sub(st.Lines[i].Time) > window {
+			st.Lines = st.Lines[i+1:]
+			break
+		}
+	}
+	if len(st.Lines) > LOGFILE_CHECK_MAX_LINES {
+		st.Lines = st.Lines[len(st.Lines)-LOGFILE_CHECK_MAX_LINES:]
+	}
+	if err := a.Checks.SaveState(data.CheckPK, st); err != nil {
+		a.Logger.Debugln("Log file check", data.Path, err)
+	}
+
+	level := shared.CHECK_STATUS_PASSING
+	if HasThresholds(data) {
+		level = CountLevel(data, count)
+	} else if count > 0 {
+		level = shared.CHECK_STATUS_FAILING
+	}
+	payload["files"] = len(files)
+	payload["count"] = count
+	payload["new_matches"] = scan.count
+	payload["lines"] = st.Lines
+	payload["output"] = fmt.Sprintf("%d matching lines", count)
+	a.ReportCheck(data, payload, a.Checks.Status(data, level))
+}
+
+// file reads the complete lines of a file from offset, up to LOGFILE_CHECK_MAX_READ, and returns
+// the offset of the first line not read. With resync, offset may be within a line, which is skipped.
+func (s *logScan) file(file string, offset int64, resync bool) (int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return offset, err
+	}
+	defer f.Close()
+
+	start := offset
+	if resync && offset > 0 {
+		// from the end of the previous line
+		start--
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return offset, err
+	}
+	r := bufio.NewReader(f)
+	if start < offset {
+		_, n, err := readLine(r, 0)
+		if err != nil {
+			return offset, nil
+		}
+		offset = start + n
+	}
+
+	for read := int64(0); read < LOGFILE_CHECK_MAX_READ && s.ctx.Err() == nil; {
+		line, n, err := readLine(r, LOGFILE_CHECK_MAX_LINE)
+		if err != nil {
+			// an incomplete line is read again once complete
+			break
+		}
+		offset += n
+		read += n
+		s.match(file, bytes.TrimRight(line, "\r\n"))
+	}
+	return offset, nil
+}
+
+// readLine reads a line, and returns up to limit bytes of it and its length; the rest of a longer
+// line is skipped, so that it is read whatever its length
+func readLine(r *bufio.Reader, limit int) ([]byte, int64, error) {
+	var (
+		line []byte
+		n    int64
+	)
+	for {
+		chunk, err := r.ReadSlice('\n')
+		n += int64(len(chunk))
+		if room := limit - len(line); room > 0 {
+			line = append(line, chunk[:min(len(chunk), room)]...)
+		}
+		if err != bufio.ErrBufferFull {
+			return line, n, err
+		}
+	}
+}
+
+func (s *logScan) match(file string, line []byte) {
+	if s.include != nil && !s.include.Match(line) {
+		return
+	}
+	if s.exclude != nil && s.exclude.Match(line) {
+		return
+	}
+	s.count++
+	if len(line) > LOGFILE_CHECK_MAX_LINE {
+		line = line[:LOGFILE_CHECK_MAX_LINE]
+	}
+	s.lines = append(s.lines, LogLine{Time: s.now, File: file, Line: string(line)})
+	if len(s.lines) > LOGFILE_CHECK_MAX_LINES {
+		s.lines = s.lines[1:]
+	}
+}
+
+// replacedBy reports whether a file with the ID of the one read last is another file, e.g. a new
+// file created with the inode of a removed one: it is smaller, older or was rewritten meanwhile
+func (o logFileOffset) replacedBy(fi os.FileInfo) bool {
+	return fi.Size() < o.Size || fi.ModTime().Before(o.ModTime) ||
+		(fi.Size() == o.Size && !fi.ModTime().Equal(o.ModTime))
+}
+
+// logFileID identifies a log file across renames by its inode, or by its path where inodes are not
+// supported
+func logFileID(file string, fi os.FileInfo) string {
+	if ino, ok := fileInode(fi); ok {
+		return "inode:" + strconv.FormatUint(ino, 10)
+	}
+	return file
+}
@@ -0,0 +1,236 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+func TestReadLine(t *testing.T) {
+	long := strings.Repeat("x", 10000)
+	tests := []struct {
+		name  string
+		input string
+		limit int
+		line  string
+		n     int64
+		err   error
+	}{
+		{"line", "ERROR one\nnext\n", 100, "ERROR one\n", 10, nil},
+		{"truncated", "ERROR one\n", 5, "ERROR", 10, nil},
+		{"longer than the buffer", long + "\n", 100, long[:100], 10001, nil},
+		{"skipped", long + "\n", 0, "", 10001, nil},
+		{"incomplete", "ERROR", 100, "ERROR", 5, io.EOF},
+		{"empty", "", 100, "", 0, io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line, n, err := readLine(bufio.NewReader(strings.NewReader(tt.input)), tt.limit)
+			if string(line) != tt.line || n != tt.n || err != tt.err {
+				t.Errorf("got %q, %d, %v, want %q, %d, %v", line, n, err, tt.line, tt.n, tt.err)
+			}
+		})
+	}
+}
+
+func TestLogScanFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "app.log")
+	content := "INFO start\nERROR one\nERROR two"
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		offset int64
+		resync bool
+		want   int64 // offset
+		count  int
+	}{
+		{"from the start", 0, false, 21, 1},
+		{"up to the last complete line", 11, false, 21, 1},
+		{"within a line", 3, true, 21, 1},
+		{"at the start of a line", 11, true, 21, 1},
+		{"within the last line", 25, true, 25, 0},
+		{"at the end", int64(len(content)), false, int64(len(content)), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &logScan{ctx: context.Background(), now: time.Now()}
+			s.include = mustRegexp(t, "ERROR")
+			offset, err := s.file(file, tt.offset, tt.resync)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if offset != tt.want || s.count != tt.count {
+				t.Errorf("offset %d, %d matches, want %d, %d", offset, s.count, tt.want, tt.count)
+			}
+		})
+	}
+}
+
+func TestLogScanFileLongLine(t *testing.T) {
+	// a line longer than what is read per run is skipped, rather than read again on every run
+	file := filepath.Join(t.TempDir(), "app.log")
+	long := "ERROR " + strings.Repeat("x", LOGFILE_CHECK_MAX_READ)
+	if err := os.WriteFile(file, []byte(long+"\nERROR after\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &logScan{ctx: context.Background(), now: time.Now(), include: mustRegexp(t, "ERROR")}
+	offset, err := s.file(file, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != int64(len(long))+1 || s.count != 1 || len(s.lines[0].Line) != LOGFILE_CHECK_MAX_LINE {
+		t.Fatalf("offset %d, %d matches, want %d, 1 truncated line", offset, s.count, len(long)+1)
+	}
+	if _, err := s.file(file, offset, false); err != nil {
+		t.Fatal(err)
+	}
+	if s.count != 2 || s.lines[1].Line != "ERROR after" {
+		t.Errorf("%d matches, last %q, want ERROR after", s.count, s.lines[len(s.lines)-1].Line)
+	}
+}
+
+// testFileInfo is the size and modification time of a file
+type testFileInfo struct {
+	os.FileInfo
+	size    int64
+	modTime time.Time
+}
+
+func (fi testFileInfo) Size() int64        { return fi.size }
+func (fi testFileInfo) ModTime() time.Time { return fi.modTime }
+
+func TestLogFileOffsetReplacedBy(t *testing.T) {
+	now := time.Now()
+	read := logFileOffset{Offset: 100, Size: 120, ModTime: now}
+	tests := []struct {
+		name    string
+		size    int64
+		modTime time.Time
+		want    bool
+	}{
+		{"unchanged", 120, now, false},
+		{"appended", 200, now.Add(time.Second), false},
+		{"smaller", 110, now.Add(time.Second), true},
+		{"older", 200, now.Add(-time.Second), true},
+		{"rewritten", 120, now.Add(time.Second), true},
+	}
+	for _, tt := range tests {
+		if got := read.replacedBy(testFileInfo{size: tt.size, modTime: tt.modTime}); got != tt.want {
+			t.Errorf("%s: replacedBy = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLogFileCheck(t *testing.T) {
+	ta := newCheckTestAgent(t)
+	dir := t.TempDir()
+	log := filepath.Join(dir, "app.log")
+	appendLog := func(file, lines string) {
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(lines); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run := func(check shared.Check, status string, count, newMatches int) map[string]any {
+		t.Helper()
+		result := ta.runStatus(ta.LogFileCheck, check, status)
+		if got, _ := result["count"].(float64); int(got) != count {
+			t.Errorf("count %v, want %d", result["count"], count)
+		}
+		if got, _ := result["new_matches"].(float64); int(got) != newMatches {
+			t.Errorf("new matches %v, want %d", result["new_matches"], newMatches)
+		}
+		return result
+	}
+
+	check := shared.Check{
+		CheckPK:          1,
+		Path:             filepath.Join(dir, "*.log"),
+		Include:          "ERROR",
+		Exclude:          "ignored",
+		Window:           3600,
+		WarningThreshold: 1,
+		ErrorThreshold:   2,
+	}
+
+	// on the first run, the lines of the files modified within the window are counted
+	recent := check
+	recent.CheckPK, recent.Path = 2, filepath.Join(t.TempDir(), "recent.log")
+	appendLog(recent.Path, "ERROR recent\n")
+	run(recent, passing, 1, 1)
+
+	// and those of older files skipped
+	appendLog(log, "ERROR before the agent\n")
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(log, old, old); err != nil {
+		t.Fatal(err)
+	}
+	run(check, passing, 0, 0)
+
+	appendLog(log, "ERROR one\nINFO ok\nERROR ignored\n")
+	result := run(check, passing, 1, 1)
+	if lines, _ := result["lines"].([]any); len(lines) != 1 || lines[0].(map[string]any)["line"] != "ERROR one" {
+		t.Errorf("lines %v, want ERROR one", result["lines"])
+	}
+
+	// the rotated file is read to its end, then the new file from its start, up to its last complete line
+	rotated := filepath.Join(dir, "app.log.1")
+	if err := os.Rename(log, rotated); err != nil {
+		t.Fatal(err)
+	}
+	appendLog(rotated, "ERROR two\n")
+	appendLog(log, "ERROR three\nERROR four")
+	result = run(check, failing, 3, 2)
+	if lines, _ := result["lines"].([]any); len(lines) != 3 {
+		t.Errorf("lines %v, want 3", result["lines"])
+	}
+
+	appendLog(log, "\n")
+	run(check, failing, 4, 1)
+
+	// a file rewritten in place, with the same inode and size, is read from its start
+	time.Sleep(10 * time.Millisecond)
+	if err := os.WriteFile(log, []byte("ERROR 33333\nERROR 4444\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run(check, failing, 6, 2)
+
+	// the offsets are kept with the state
+	var st logFileState
+	if !ta.Checks.LoadState(check.CheckPK, &st) || len(st.Files) != 2 {
+		t.Errorf("state %+v, want the offsets of 2 files", st)
+	}
+
+	// without a window, only the new lines count, and fail once they exceed the threshold
+	check.Window = 0
+	run(check, passing, 0, 0)
+	appendLog(log, "ERROR five\nERROR six\n")
+	run(check, warning, 2, 2)
+	appendLog(log, "ERROR seven\nERROR eight\nERROR nine\n")
+	run(check, failing, 3, 3)
+}
+
+func mustRegexp(t *testing.T, expr string) *regexp.Regexp {
+	t.Helper()
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return re
+}
@@ -0,0 +1,253 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+// TCP checks
+const (
+	TCP_CHECK_MAX_BANNER   = 4096             // Most data read to match the banner
+	TCP_CHECK_READ_TIMEOUT = 10 * time.Second // To receive the banner, within the check's timeout
+)
+
+// DNS record types of the dns checks
+const (
+	DNS_TYPE_A     = "A"
+	DNS_TYPE_AAAA  = "AAAA"
+	DNS_TYPE_CNAME = "CNAME"
+	DNS_TYPE_MX    = "MX"
+	DNS_TYPE_NS    = "NS"
+	DNS_TYPE_TXT   = "TXT"
+	DNS_TYPE_PTR   = "PTR"
+)
+
+// milliseconds returns a duration in milliseconds, to the hundredth
+func milliseconds(d time.Duration) float64 {
+	return math.Round(float64(d.Microseconds())/10) / 100
+}
+
+// TcpCheck connects to a port, optionally sends a string and matches the banner received,
+// see shared.Check. The thresholds apply to the connection time in milliseconds.
+func (a *Agent) TcpCheck(ctx context.Context, data shared.Check) {
+	addr := net.JoinHostPort(data.Host, strconv.Itoa(data.Port))
+	payload := map[string]any{
+		"id":      data.CheckPK,
+		"address": addr,
+	}
+
+	level := shared.CHECK_STATUS_FAILING
+	latency, banner, err := tcpCheckConnect(ctx, data, addr)
+	if latency > 0 {
+		payload["latency"] = latency
+	}
+	if len(banner) > 0 {
+		payload["banner"] = banner
+	}
+	if err != nil {
+		a.Logger.Debugln("Tcp check", addr, err)
+		payload["output"] = err.Error()
+	} else {
+		level = CheckLevel(data, latency, false)
+		payload["output"] = fmt.Sprintf("Connected to %s in %.2f ms", addr, latency)
+	}
+
+	a.ReportCheck(data, payload, a.Checks.Status(data, level))
+}
+
+// TestTCP checks that a TCP port accepts connections, as a tcp check without banner would
+func TestTCP(addr string) error {
+	_, _, err := tcpCheckConnect(context.Background(), shared.Check{}, addr)
+	return err
+}
+
+// tcpCheckConnect connects to addr and exchanges the data of a tcp check, returning the connection
+// time in milliseconds and the data received
+func tcpCheckConnect(ctx context.Context, data shared.Check, addr string) (float64, string, error) {
+	var re *regexp.Regexp
+	if len(data.Banner) > 0 {
+		var err error
+		if re, err = regexp.Compile(data.Banner); err != nil {
+			return 0, "", fmt.Errorf("invalid banner regex: %w", err)
+		}
+	}
+
+	var d net.Dialer
+	start := time.Now()
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return 0, "", err
+	}
+	latency := milliseconds(time.Since(start))
+	defer conn.Close()
+
+	// unblock the reads and writes when the check times out
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	if len(data.Send) > 0 {
+		if _, err := io.WriteString(conn, data.Send); err != nil {
+			return latency, "", err
+		}
+	}
+	if re == nil {
+		return latency, "", nil
+	}
+
+	// keep the check's deadline if it is earlier; a cancellation before this point sets none
+	deadline := time.Now().Add(TCP_CHECK_READ_TIMEOUT)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = conn.SetReadDeadline(deadline)
+	if err := ctx.Err(); err != nil {
+		return latency, "", err
+	}
+	buf := make([]byte, 0, TCP_CHECK_MAX_BANNER)
+	for len(buf) < cap(buf) {
+		n, err := conn.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if re.Match(buf) {
+			return latency, string(buf), nil
+		}
+		if err != nil {
+			break
+		}
+	}
+	return latency, string(buf), fmt.Errorf("banner does not match %q", data.Banner)
+}
+
+// DnsCheck resolves a name, optionally against a given resolver, and checks one of the records has
+// the expected value, see shared.Check. The thresholds apply to the resolution time in milliseconds.
+func (a *Agent) DnsCheck(ctx context.Context, data shared.Check) {
+	recordType := strings.ToUpper(data.RecordType)
+	if len(recordType) == 0 {
+		recordType = DNS_TYPE_A
+	}
+	payload := map[string]any{
+		"id":          data.CheckPK,
+		"name":        data.Host,
+		"record_type": recordType,
+		"resolver":    data.Resolver,
+	}
+
+	level := shared.CHECK_STATUS_FAILING
+	start := time.Now()
+	records, err := dnsLookup(ctx, dnsResolver(data.Resolver), recordType, data.Host)
+	latency := milliseconds(time.Since(start))
+	if err != nil {
+		a.Logger.Debugln("Dns check", data.Host, err)
+		payload["output"] = err.Error()
+	} else {
+		payload["latency"] = latency
+		payload["records"] = records
+		if len(data.Expected) > 0 && !slices.ContainsFunc(records, func(r string) bool { return dnsValueEqual(r, data.Expected) }) {
+			payload["output"] = fmt.Sprintf("no %s record of %s is %s", recordType, data.Host, data.Expected)
+		} else {
+			level = CheckLevel(data, latency, false)
+			payload["output"] = fmt.Sprintf("Resolved %s in %.2f ms", data.Host, latency)
+		}
+	}
+
+	a.ReportCheck(data, payload, a.Checks.Status(data, level))
+}
+
+// dnsResolver returns a resolver querying the given server, port 53 by default, or the system's
+// resolver if server is empty
+func dnsResolver(server string) *net.Resolver {
+	if len(server) == 0 {
+		return net.DefaultResolver
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// dnsLookup returns the records of a name, DNS_TYPE_*
+func dnsLookup(ctx context.Context, r *net.Resolver, recordType string, name string) ([]string, error) {
+	var ret []string
+	switch recordType {
+	case DNS_TYPE_A, DNS_TYPE_AAAA:
+		network := "ip4"
+		if recordType == DNS_TYPE_AAAA {
+			network = "ip6"
+		}
+		ips, err := r.LookupIP(ctx, network, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			ret = append(ret, ip.String())
+		}
+	case DNS_TYPE_CNAME:
+		cname, err := r.LookupCNAME(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, cname)
+	case DNS_TYPE_MX:
+		mxs, err := r.LookupMX(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, mx := range mxs {
+			ret = append(ret, mx.Host)
+		}
+	case DNS_TYPE_NS:
+		nss, err := r.LookupNS(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ns := range nss {
+			ret = append(ret, ns.Host)
+		}
+	case DNS_TYPE_TXT:
+		txts, err := r.LookupTXT(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		ret = txts
+	case DNS_TYPE_PTR:
+		names, err := r.LookupAddr(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		ret = names
+	default:
+		return nil, fmt.Errorf("unsupported record type %q", recordType)
+	}
+
+	if len(ret) == 0 {
+		return nil, errors.New("no records found")
+	}
+	return ret, nil
+}
+
+// dnsValueEqual compares a record with an expected value: addresses by value, names regardless of
+// case and of the trailing dot
+func dnsValueEqual(record, expected string) bool {
+	if ip := net.ParseIP(record); ip != nil {
+		return ip.Equal(net.ParseIP(expected))
+	}
+	return strings.EqualFold(strings.TrimSuffix(record, "."), strings.TrimSuffix(expected, "."))
+}
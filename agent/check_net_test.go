@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+func TestDnsValueEqual(t *testing.T) {
+	tests := []struct {
+		record, expected string
+		want             bool
+	}{
+		{"192.0.2.10", "192.0.2.10", true},
+		{"192.0.2.10", "192.0.2.11", false},
+		{"2001:db8::1", "2001:0db8:0000::0001", true},
+		{"::ffff:192.0.2.10", "192.0.2.10", true},
+		{"192.0.2.10", "app.example.com", false},
+		{"mail.example.com.", "mail.example.com", true},
+		{"Mail.Example.com", "mail.example.com.", true},
+		{"mail.example.com", "mail.example.org", false},
+		{"v=spf1 -all", "v=spf1 -all", true},
+	}
+	for _, tt := range tests {
+		if got := dnsValueEqual(tt.record, tt.expected); got != tt.want {
+			t.Errorf("dnsValueEqual(%q, %q) = %v, want %v", tt.record, tt.expected, got, tt.want)
+		}
+	}
+}
+
+// listenTCP accepts connections on a local port, handled by fn, until the test ends
+func listenTCP(t *testing.T, fn func(net.Conn)) (net.Listener, int) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				fn(conn)
+			}()
+		}
+	}()
+	return ln, ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestTcpCheck(t *testing.T) {
+	ta := newCheckTestAgent(t)
+	ln, port := listenTCP(t, func(conn net.Conn) {
+		fmt.Fprint(conn, "220 mail.example.com ESMTP\r\n")
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		if strings.HasPrefix(line, "EHLO") {
+			fmt.Fprint(conn, "250 mail.example.com\r\n")
+		}
+	})
+
+	check := shared.Check{CheckPK: 1, Host: "127.0.0.1", Port: port, Send: "EHLO agent\r\n", Banner: "(?m)^250 "}
+	result := ta.runStatus(ta.TcpCheck, check, passing)
+	if _, ok := result["latency"].(float64); !ok {
+		t.Errorf("no latency: %v", result)
+	}
+
+	check.Banner = "^SSH-"
+	ta.runStatus(ta.TcpCheck, check, failing)
+
+	check.Banner = "("
+	if result := ta.runStatus(ta.TcpCheck, check, failing); !strings.Contains(result["output"].(string), "invalid banner regex") {
+		t.Errorf("invalid banner: output %v", result["output"])
+	}
+
+	ln.Close()
+	check.Send, check.Banner = "", ""
+	ta.runStatus(ta.TcpCheck, check, failing)
+}
+
+func TestTcpCheckConnectDeadline(t *testing.T) {
+	// the server never sends its banner: the read stops at the check's deadline
+	_, port := listenTCP(t, func(conn net.Conn) {
+		time.Sleep(2 * time.Second)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := tcpCheckConnect(ctx, shared.Check{Banner: "^220 "}, net.JoinHostPort("127.0.0.1", fmt.Sprint(port)))
+	if err == nil {
+		t.Fatal("no error without a banner")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("returned after %s, want at the check's deadline", d)
+	}
+
+	// and at once when cancelled
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := tcpCheckConnect(cancelled, shared.Check{Banner: "^220 "}, net.JoinHostPort("127.0.0.1", fmt.Sprint(port))); err == nil {
+		t.Error("no error once cancelled")
+	}
+}
+
+func TestTestTCP(t *testing.T) {
+	ln, port := listenTCP(t, func(net.Conn) {})
+	addr := net.JoinHostPort("127.0.0.1", fmt.Sprint(port))
+	if err := TestTCP(addr); err != nil {
+		t.Errorf("open port: %v", err)
+	}
+	ln.Close()
+	if err := TestTCP(addr); err == nil {
+		t.Error("closed port: no error")
+	}
+}
@@ -0,0 +1,270 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Ping check defaults
+const (
+	PING_COUNT_DEF    = 4
+	PING_INTERVAL_DEF = time.Second     // Between echo requests
+	PING_TIMEOUT_DEF  = 2 * time.Second // For each reply
+)
+
+// ICMP protocol numbers
+const (
+	protocolICMP     = 1
+	protocolIPv6ICMP = 58
+)
+
+// PingStats are the results of a ping, the times in milliseconds
+type PingStats struct {
+	Addr     string  `json:"addr"`
+	Sent     int     `json:"sent"`
+	Received int     `json:"received"`
+	Loss     float64 `json:"loss"` // Percent
+	Min      float64 `json:"rtt_min"`
+	Avg      float64 `json:"rtt_avg"`
+	Max      float64 `json:"rtt_max"`
+	Jitter   float64 `json:"jitter"` // Mean difference between consecutive round trips
+}
+
+// echoReply is an echo reply received, by sequence number
+type echoReply struct {
+	seq int
+	at  time.Time
+}
+
+// Ping sends count ICMP echo requests to host, every interval, and waits up to timeout for each
+// reply. It uses an unprivileged datagram socket where the system allows it, e.g. on Linux within
+// net.ipv4.ping_group_range, and a raw socket otherwise, which requires root or administrator.
+func Ping(ctx context.Context, host string, count int, interval, timeout time.Duration) (*PingStats, error) {
+	ip, err := resolvePingAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	conn, dst, proto, echo, err := listenICMP(ip)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// the replies are told from those to other pings by their payload, as datagram sockets set the ID
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	replies := make(chan echoReply, count)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, peer, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			at := time.Now()
+			if !pingPeerIs(peer, ip) {
+				continue
+			}
+			msg, err := icmp.ParseMessage(proto, buf[:n])
+			if err != nil || (msg.Type != ipv4.ICMPTypeEchoReply && msg.Type != ipv6.ICMPTypeEchoReply) {
+				continue
+			}
+			if body, ok := msg.Body.(*icmp.Echo); ok && bytes.Equal(body.Data, token) {
+				select {
+				case replies <- echoReply{seq: body.Seq, at: at}:
+				default:
+				}
+			}
+		}
+	}()
+
+	sent := make([]time.Time, count)
+	rtts := make([]time.Duration, count) // 0 if lost
+	received := 0
+	// collect records the replies until deadline, or until all of them are received if all is set
+	collect := func(deadline time.Time, all bool) error {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		for !all || received < count {
+			select {
+			case r := <-replies:
+				if r.seq < 0 || r.seq >= count || sent[r.seq].IsZero() || rtts[r.seq] != 0 {
+					continue
+				}
+				if rtt := r.at.Sub(sent[r.seq]); rtt <= timeout {
+					rtts[r.seq] = max(rtt, time.Nanosecond)
+					received++
+				}
+			case <-timer.C:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	}
+
+	for i := 0; i < count; i++ {
+		msg := icmp.Message{Type: echo, Body: &icmp.Echo{ID: 1, Seq: i, Data: token}}
+		b, err := msg.Marshal(nil)
+		if err != nil {
+			return nil, err
+		}
+		sent[i] = time.Now()
+		if _, err := conn.WriteTo(b, dst); err != nil {
+			return nil, err
+		}
+		if i < count-1 {
+			if err := collect(sent[i].Add(interval), false); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := collect(sent[count-1].Add(timeout), true); err != nil {
+		return nil, err
+	}
+	return pingStats(ip.String(), rtts), nil
+}
+
+// pingStats summarizes the round trips of a ping, 0 for the lost requests
+func pingStats(addr string, rtts []time.Duration) *PingStats {
+	ret := &PingStats{Addr: addr, Sent: len(rtts)}
+	var sum, diffs float64
+	prev := -1.0
+	for _, rtt := range rtts {
+		if rtt == 0 {
+			continue
+		}
+		ms := float64(rtt.Microseconds()) / 1000
+		if ret.Received == 0 || ms < ret.Min {
+			ret.Min = ms
+		}
+		ret.Max = max(ret.Max, ms)
+		sum += ms
+		if prev >= 0 {
+			diffs += math.Abs(ms - prev)
+		}
+		prev = ms
+		ret.Received++
+	}
+
+	round := func(f float64) float64 { return math.Round(f*100) / 100 }
+	ret.Loss = round(float64(ret.Sent-ret.Received) / float64(ret.Sent) * 100)
+	if ret.Received > 0 {
+		ret.Avg = round(sum / float64(ret.Received))
+	}
+	if ret.Received > 1 {
+		ret.Jitter = round(diffs / float64(ret.Received-1))
+	}
+	ret.Min, ret.Max = round(ret.Min), round(ret.Max)
+	return ret
+}
+
+// resolvePingAddr returns the address of host, IPv4 if it has one
+func resolvePingAddr(ctx context.Context, host string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			return a.IP, nil
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no address found for %s", host)
+	}
+	return addrs[0].IP, nil
+}
+
+// listenICMP opens an ICMP socket for pinging ip, unprivileged if possible, and returns the
+// destination address, the protocol number and the echo request type to use with it
+func listenICMP(ip net.IP) (*icmp.PacketConn, net.Addr, int, icmp.Type, error) {
+	network, raw, address := "udp4", "ip4:icmp", "0.0.0.0"
+	proto, echo := protocolICMP, icmp.Type(ipv4.ICMPTypeEcho)
+	if ip.To4() == nil {
+		network, raw, address = "udp6", "ip6:ipv6-icmp", "::"
+		proto, echo = protocolIPv6ICMP, ipv6.ICMPTypeEchoRequest
+	}
+
+	if conn, err := icmp.ListenPacket(network, address); err == nil {
+		return conn, &net.UDPAddr{IP: ip}, proto, echo, nil
+	}
+	conn, err := icmp.ListenPacket(raw, address)
+	if err != nil {
+		return nil, nil, 0, nil, fmt.Errorf("opening an ICMP socket: %w", err)
+	}
+	return conn, &net.IPAddr{IP: ip}, proto, echo, nil
+}
+
+func pingPeerIs(peer net.Addr, ip net.IP) bool {
+	switch p := peer.(type) {
+	case *net.UDPAddr:
+		return p.IP.Equal(ip)
+	case *net.IPAddr:
+		return p.IP.Equal(ip)
+	}
+	return false
+}
+
+// PingCheck pings a host and reports the round trip times and the packet loss, see shared.Check.
+// The thresholds apply to the average round trip time in milliseconds, and the loss thresholds to
+// the percentage of lost packets; the check fails if no reply is received.
+func (a *Agent) PingCheck(ctx context.Context, data shared.Check) {
+	count := data.PingCount
+	if count <= 0 {
+		count = PING_COUNT_DEF
+	}
+	interval, timeout := PING_INTERVAL_DEF, PING_TIMEOUT_DEF
+	if data.PingInterval > 0 {
+		interval = time.Duration(data.PingInterval) * time.Millisecond
+	}
+	if data.PingTimeout > 0 {
+		timeout = time.Duration(data.PingTimeout) * time.Millisecond
+	}
+
+	var (
+		output string
+		level  = shared.CHECK_STATUS_FAILING
+	)
+	stats, err := Ping(ctx, data.IP, count, interval, timeout)
+	if err != nil {
+		a.Logger.Debugln("Ping check", data.IP, err)
+		output = fmt.Sprintf("Ping %s: %v", data.IP, err)
+	} else {
+		output = fmt.Sprintf("%d packets transmitted, %d received, %g%% packet loss\nrtt min/avg/max/jitter = %.2f/%.2f/%.2f/%.2f ms",
+			stats.Sent, stats.Received, stats.Loss, stats.Min, stats.Avg, stats.Max, stats.Jitter)
+		if stats.Received > 0 {
+			loss := shared.Check{WarningThreshold: data.LossWarningThreshold, ErrorThreshold: data.LossErrorThreshold}
+			level = WorstLevel(CheckLevel(data, stats.Avg, false), CheckLevel(loss, stats.Loss, false))
+		}
+	}
+
+	// has_stdout, has_stderr and output as with the ping command
+	payload := map[string]any{
+		"id":         data.CheckPK,
+		"has_stdout": err == nil,
+		"has_stderr": err != nil || stats.Received == 0,
+		"output":     output,
+	}
+	if stats != nil {
+		payload["stats"] = stats
+	}
+	a.ReportCheck(data, payload, a.Checks.Status(data, level))
+}
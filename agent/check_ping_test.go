@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+func TestPingStats(t *testing.T) {
+	ms := func(f float64) time.Duration { return time.Duration(f * float64(time.Millisecond)) }
+	tests := []struct {
+		name string
+		rtts []time.Duration
+		want PingStats
+	}{
+		{
+			name: "all replies",
+			rtts: []time.Duration{ms(10), ms(20), ms(15)},
+			want: PingStats{Sent: 3, Received: 3, Min: 10, Avg: 15, Max: 20, Jitter: 7.5},
+		},
+		{
+			name: "lost replies",
+			rtts: []time.Duration{ms(10), 0, ms(30), 0},
+			want: PingStats{Sent: 4, Received: 2, Loss: 50, Min: 10, Avg: 20, Max: 30, Jitter: 20},
+		},
+		{
+			name: "one reply",
+			rtts: []time.Duration{0, 0, ms(1.234)},
+			want: PingStats{Sent: 3, Received: 1, Loss: 66.67, Min: 1.23, Avg: 1.23, Max: 1.23},
+		},
+		{
+			name: "no reply",
+			rtts: []time.Duration{0, 0},
+			want: PingStats{Sent: 2, Loss: 100},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.want.Addr = "192.0.2.1"
+			if got := pingStats("192.0.2.1", tt.rtts); !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPingCheck(t *testing.T) {
+	ta := newCheckTestAgent(t)
+
+	check := shared.Check{CheckPK: 1, IP: "127.0.0.1", PingCount: 3, PingInterval: 50, PingTimeout: 500}
+	result := ta.runStatus(ta.PingCheck, check, passing)
+	stats, _ := result["stats"].(map[string]any)
+	if stats["sent"] != 3.0 || stats["received"] != 3.0 || stats["loss"] != 0.0 {
+		t.Errorf("stats %v, want 3 sent and received", stats)
+	}
+
+	// the thresholds apply to the average round trip
+	check.WarningThreshold = 0.0001
+	ta.runStatus(ta.PingCheck, check, warning)
+
+	check = shared.Check{CheckPK: 2, IP: "agent.invalid", PingCount: 2, PingInterval: 50, PingTimeout: 200}
+	if result := ta.runStatus(ta.PingCheck, check, failing); result["has_stderr"] != true {
+		t.Errorf("unknown host: has_stderr %v, want true", result["has_stderr"])
+	}
+}
@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// PROCESS_CHECK_CPU_SAMPLE is how long the processor time of the matching processes is measured
+// when a process check limits it
+const PROCESS_CHECK_CPU_SAMPLE = time.Second
+
+// ProcessInfo describes a process matched by a process check
+type ProcessInfo struct {
+	Pid        int32   `json:"pid"`
+	Name       string  `json:"name"`
+	CPUPercent float64 `json:"cpu_percent,omitempty"`
+	RSS        uint64  `json:"rss"`
+	OpenFiles  int32   `json:"open_files,omitempty"`
+	Zombie     bool    `json:"zombie,omitempty"`
+}
+
+// ProcessCheck counts the processes matching a check and checks their resources, see shared.Check.
+// The check fails if the count is out of bounds or a process exceeds a limit, or a limit cannot be
+// checked, and warns about zombie processes, which are not counted.
+func (a *Agent) ProcessCheck(ctx context.Context, data shared.Check) {
+	payload := map[string]any{
+		"id": data.CheckPK,
+	}
+
+	procs, err := matchProcesses(ctx, data)
+	if err == nil && data.MaxOpenFiles > 0 && runtime.GOOS == "windows" {
+		// the open files of a process are not counted on Windows, a limit would always pass
+		err = fmt.Errorf("max_open_files is not supported on %s", runtime.GOOS)
+	}
+	if err != nil {
+		a.Logger.Debugln("Process check:", err)
+		payload["output"] = err.Error()
+		a.ReportCheck(data, payload, a.Checks.Status(data, shared.CHECK_STATUS_FAILING))
+		return
+	}
+
+	var cpuStart, cpuEnd map[int32]float64
+	if data.MaxCPUPercent > 0 {
+		cpuStart = cpuTimes(procs)
+		if !SleepContext(ctx, PROCESS_CHECK_CPU_SAMPLE) {
+			return
+		}
+		cpuEnd = cpuTimes(procs)
+	}
+
+	var (
+		infos    []ProcessInfo
+		zombies  []int32
+		problems []string
+		count    int
+	)
+	for _, p := range procs {
+		info := ProcessInfo{Pid: p.Pid}
+		info.Name, _ = p.NameWithContext(ctx)
+		if status, err := p.StatusWithContext(ctx); err == nil && slices.Contains(status, process.Zombie) {
+			info.Zombie = true
+			zombies = append(zombies, p.Pid)
+			infos = append(infos, info)
+			continue
+		}
+		count++
+
+		if m, err := p.MemoryInfoWithContext(ctx); err == nil {
+			info.RSS = m.RSS
+		}
+		if n, err := p.NumFDsWithContext(ctx); err == nil {
+			info.OpenFiles = n
+		} else if data.MaxOpenFiles > 0 {
+			problems = append(problems, fmt.Sprintf("unable to count the open files of process %d: %v", p.Pid, err))
+		}
+		if start, ok := cpuStart[p.Pid]; ok {
+			if end, ok := cpuEnd[p.Pid]; ok {
+				info.CPUPercent = (end - start) / PROCESS_CHECK_CPU_SAMPLE.Seconds() * 100
+			}
+		}
+
+		if data.MaxCPUPercent > 0 && info.CPUPercent > data.MaxCPUPercent {
+			problems = append(problems, fmt.Sprintf("process %d uses %.1f%% CPU, above %.1f%%", p.Pid, info.CPUPercent, data.MaxCPUPercent))
+		}
+		if data.MaxRSS > 0 && info.RSS > data.MaxRSS {
+			problems = append(problems, fmt.Sprintf("process %d uses %d bytes of memory, above %d", p.Pid, info.RSS, data.MaxRSS))
+		}
+		if data.MaxOpenFiles > 0 && int(info.OpenFiles) > data.MaxOpenFiles {
+			problems = append(problems, fmt.Sprintf("process %d has %d open files, above %d", p.Pid, info.OpenFiles, data.MaxOpenFiles))
+		}
+		infos = append(infos, info)
+	}
+
+	minCount := data.MinCount
+	if minCount == 0 && data.MaxCount == 0 {
+		minCount = 1
+	}
+	if count < minCount {
+		problems = append(problems, fmt.Sprintf("%d processes running, expected at least %d", count, minCount))
+	} else if data.MaxCount > 0 && count > data.MaxCount {
+		problems = append(problems, fmt.Sprintf("%d processes running, expected at most %d", count, data.MaxCount))
+	}
+
+	level := shared.CHECK_STATUS_PASSING
+	if len(problems) > 0 {
+		level = shared.CHECK_STATUS_FAILING
+	} else if len(zombies) > 0 {
+		level = shared.CHECK_STATUS_WARNING
+	}
+	if len(zombies) > 0 {
+		problems = append(problems, fmt.Sprintf("zombie processes: %v", zombies))
+	}
+	if len(problems) == 0 {
+		problems = append(problems, fmt.Sprintf("%d processes running", count))
+	}
+
+	payload["count"] = count
+	payload["processes"] = infos
+	payload["zombies"] = zombies
+	payload["output"] = strings.Join(problems, "\n")
+	a.ReportCheck(data, payload, a.Checks.Status(data, level))
+}
+
+// matchProcesses returns the processes matching the name, executable and command line of a check
+func matchProcesses(ctx context.Context, data shared.Check) ([]*process.Process, error) {
+	if len(data.ProcessName) == 0 && len(data.ProcessExe) == 0 && len(data.ProcessCmdline) == 0 {
+		return nil, errors.New("no process name, executable or command line to match")
+	}
+	var re *regexp.Regexp
+	if len(data.ProcessCmdline) > 0 {
+		var err error
+		if re, err = regexp.Compile(data.ProcessCmdline); err != nil {
+			return nil, fmt.Errorf("invalid command line regex: %w", err)
+		}
+	}
+
+	// names and paths are case-insensitive on Windows
+	equal := func(a, b string) bool { return a == b }
+	if runtime.GOOS == "windows" {
+		equal = strings.EqualFold
+	}
+
+	procs, err := process.ProcessesWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ret []*process.Process
+	for _, p := range procs {
+		if len(data.ProcessName) > 0 {
+			if name, err := p.NameWithContext(ctx); err != nil || !equal(name, data.ProcessName) {
+				continue
+			}
+		}
+		if len(data.ProcessExe) > 0 {
+			if exe, err := p.ExeWithContext(ctx); err != nil || !equal(filepath.Clean(exe), filepath.Clean(data.ProcessExe)) {
+				continue
+			}
+		}
+		if re != nil {
+			if cmdline, err := p.CmdlineWithContext(ctx); err != nil || !re.MatchString(cmdline) {
+				continue
+			}
+		}
+		ret = append(ret, p)
+	}
+	return ret, nil
+}
+
+// cpuTimes returns the processor time of processes, in seconds
+func cpuTimes(procs []*process.Process) map[int32]float64 {
+	ret := make(map[int32]float64, len(procs))
+	for _, p := range procs {
+		if t, err := p.Times(); err == nil {
+			ret[p.Pid] = t.User + t.System
+		}
+	}
+	return ret
+}
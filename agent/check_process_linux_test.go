@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+func TestProcessCheck(t *testing.T) {
+	ta := newCheckTestAgent(t)
+
+	// copies of sleep, so that their names are unique
+	dir := t.TempDir()
+	sleep, err := os.ReadFile("/bin/sleep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exe, zombie := filepath.Join(dir, "rmmproctest"), filepath.Join(dir, "rmmzombietest")
+	for _, file := range []string{exe, zombie} {
+		if err := os.WriteFile(file, sleep, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		cmd := exec.Command(exe, "30")
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer cmd.Wait()
+		defer cmd.Process.Kill()
+	}
+
+	tests := []struct {
+		name  string
+		check shared.Check
+		want  string
+	}{
+		{"matching", shared.Check{ProcessName: "rmmproctest", ProcessExe: exe, ProcessCmdline: " 30$", MaxCount: 2}, passing},
+		{"at least one", shared.Check{ProcessName: "rmmproctest"}, passing},
+		{"too many", shared.Check{ProcessName: "rmmproctest", MaxCount: 1}, failing},
+		{"too few", shared.Check{ProcessName: "rmmproctest", MinCount: 3}, failing},
+		{"memory limit", shared.Check{ProcessName: "rmmproctest", MaxRSS: 1}, failing},
+		{"open files limit", shared.Check{ProcessName: "rmmproctest", MaxOpenFiles: 1}, failing},
+		{"missing", shared.Check{ProcessName: "rmmproctest", ProcessCmdline: " 31$"}, failing},
+		{"nothing to match", shared.Check{}, failing},
+		{"invalid regex", shared.Check{ProcessCmdline: "("}, failing},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := ta.runStatus(ta.ProcessCheck, tt.check, tt.want)
+			if tt.want == passing {
+				if count, _ := result["count"].(float64); count != 2 {
+					t.Errorf("count %v, want 2", result["count"])
+				}
+			}
+		})
+	}
+
+	// a child which exited but was not waited for
+	cmd := exec.Command(zombie, "0")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		p, err := process.NewProcess(int32(cmd.Process.Pid))
+		if err == nil {
+			if status, _ := p.Status(); slices.Contains(status, process.Zombie) {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the zombie")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	result := ta.runStatus(ta.ProcessCheck, shared.Check{ProcessName: "rmmzombietest", MaxCount: 1}, warning)
+	if zombies, _ := result["zombies"].([]any); len(zombies) != 1 || zombies[0] != float64(cmd.Process.Pid) {
+		t.Errorf("zombies %v, want [%d]", result["zombies"], cmd.Process.Pid)
+	}
+}
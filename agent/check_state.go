@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Check state
+const (
+	CHECK_STATE_DIR         = "checks"  // Where the checks keep their state between runs, in the data directory
+	CHECK_STATE_TMP_MAX_AGE = time.Hour // Temporary files left by an interrupted SaveState are removed after this
+	checkStateTmpPrefix     = ".tmp"
+)
+
+func (s *CheckScheduler) statePath(checkPK int) string {
+	return filepath.Join(s.StateDir, strconv.Itoa(checkPK)+".json")
+}
+
+// LoadState reads the state a check saved on a previous run, and reports whether there was one
+func (s *CheckScheduler) LoadState(checkPK int, v any) bool {
+	if s == nil || len(s.StateDir) == 0 {
+		return false
+	}
+	data, err := os.ReadFile(s.statePath(checkPK))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			s.Logger.Debugf("Check %d state: %v", checkPK, err)
+		}
+		return false
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		s.Logger.Debugf("Check %d state: %v", checkPK, err)
+		return false
+	}
+	return true
+}
+
+// SaveState keeps the state of a check for its next runs, also across restarts of the agent.
+// Without a state directory, e.g. when not running as root, the state is not kept.
+func (s *CheckScheduler) SaveState(checkPK int, v any) error {
+	if s == nil || len(s.StateDir) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.StateDir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(s.StateDir, checkStateTmpPrefix)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.statePath(checkPK))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// pruneStates removes the saved state of the checks not listed, and the stale temporary files
+func (s *CheckScheduler) pruneStates(listed map[int]bool) {
+	if len(s.StateDir) == 0 {
+		return
+	}
+	entries, err := os.ReadDir(s.StateDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), checkStateTmpPrefix) {
+			// a recent one may still be written
+			if fi, err := e.Info(); err == nil && time.Since(fi.ModTime()) > CHECK_STATE_TMP_MAX_AGE {
+				os.Remove(filepath.Join(s.StateDir, e.Name()))
+			}
+			continue
+		}
+		pk, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".json"))
+		if err == nil && !listed[pk] {
+			os.Remove(filepath.Join(s.StateDir, e.Name()))
+		}
+	}
+}
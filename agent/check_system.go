@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"math"
+
+	ps "github.com/jetrmm/go-sysinfo"
+	"github.com/jetrmm/rmm-agent/shared"
+	"github.com/shirou/gopsutil/v3/disk"
+)
+
+// DiskCheck checks disk usage
+func (a *Agent) DiskCheck(ctx context.Context, data shared.Check) {
+	var payload map[string]any
+
+	usage, err := disk.UsageWithContext(ctx, data.Storage)
+	if err != nil {
+		a.Logger.Debugln("StorageDrive", data.Storage, err)
+
+		payload = map[string]any{
+			"id":     data.CheckPK,
+			"exists": false,
+		}
+
+		a.ReportCheck(data, payload, a.Checks.Evaluate(data, shared.CHECK_STATUS_FAILING))
+		return
+	}
+
+	payload = map[string]any{
+		"id":           data.CheckPK,
+		"exists":       true,
+		"percent_used": usage.UsedPercent,
+		"total":        usage.Total,
+		"free":         usage.Free,
+	}
+
+	// thresholds are minimum percentages of free space
+	status := a.Checks.Evaluate(data, CheckLevel(data, 100-usage.UsedPercent, true))
+	a.ReportCheck(data, payload, status)
+}
+
+// CPULoadCheck checks the average processor load
+func (a *Agent) CPULoadCheck(ctx context.Context, data shared.Check) {
+	percent := a.GetCPULoadAvg()
+	payload := map[string]any{
+		"id":      data.CheckPK,
+		"percent": percent,
+	}
+
+	a.ReportCheck(data, payload, a.Checks.Evaluate(data, CheckLevel(data, float64(percent), false)))
+}
+
+// MemCheck checks the percentage of memory used, and fails if it cannot be read
+func (a *Agent) MemCheck(ctx context.Context, data shared.Check) {
+	payload := map[string]any{
+		"id": data.CheckPK,
+	}
+
+	percent, err := memoryUsed()
+	if err != nil {
+		a.Logger.Debugln("Memory check:", err)
+		payload["output"] = err.Error()
+		a.ReportCheck(data, payload, a.Checks.Status(data, shared.CHECK_STATUS_FAILING))
+		return
+	}
+
+	payload["percent"] = int(math.Round(percent))
+	a.ReportCheck(data, payload, a.Checks.Evaluate(data, CheckLevel(data, percent, false)))
+}
+
+// memoryUsed returns the percentage of memory used
+func memoryUsed() (float64, error) {
+	host, err := ps.Host()
+	if err != nil {
+		return 0, err
+	}
+	mem, err := host.Memory()
+	if err != nil {
+		return 0, err
+	}
+	if mem.Total == 0 {
+		return 0, errors.New("total memory unknown")
+	}
+	return float64(mem.Used) / float64(mem.Total) * 100, nil
+}
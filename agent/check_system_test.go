@@ -0,0 +1,35 @@
+package agent
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+func TestDiskCheck(t *testing.T) {
+	ta := newCheckTestAgent(t)
+	dir := t.TempDir()
+
+	// thresholds are minimum percentages of free space
+	result := ta.runStatus(ta.DiskCheck, shared.Check{CheckPK: 1, Storage: dir, ErrorThreshold: 0.001}, passing)
+	if result["exists"] != true || result["total"] == nil {
+		t.Errorf("result %v, want the usage of %s", result, dir)
+	}
+	ta.runStatus(ta.DiskCheck, shared.Check{CheckPK: 2, Storage: dir, ErrorThreshold: 100}, failing)
+
+	result = ta.runStatus(ta.DiskCheck, shared.Check{CheckPK: 3, Storage: filepath.Join(dir, "missing"), ErrorThreshold: 10}, failing)
+	if result["exists"] != false {
+		t.Errorf("missing: exists %v, want false", result["exists"])
+	}
+}
+
+func TestMemCheck(t *testing.T) {
+	ta := newCheckTestAgent(t)
+
+	result := ta.runStatus(ta.MemCheck, shared.Check{CheckPK: 1, ErrorThreshold: 101}, passing)
+	if percent, _ := result["percent"].(float64); percent <= 0 || percent > 100 {
+		t.Errorf("percent %v", result["percent"])
+	}
+	ta.runStatus(ta.MemCheck, shared.Check{CheckPK: 2, WarningThreshold: 0.001}, warning)
+}
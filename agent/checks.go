@@ -0,0 +1,438 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+	"github.com/sirupsen/logrus"
+)
+
+// Check scheduling
+const (
+	CHECK_INTERVAL_DEF  = 120 * time.Second // When the server does not set the check interval
+	CHECK_TIMEOUT_DEF   = 120 * time.Second // When a check sets no timeout, unless its interval is shorter
+	CHECK_JITTER        = 10                // Runs are spread by up to this percentage of their interval
+	CHECK_START_SPREAD  = 30 * time.Second  // New checks first run within this delay
+	CHECK_STARTUP_DELAY = 15 * time.Second  // The check runner waits this long after the service starts
+)
+
+// ErrChecksRunning is returned when all checks are run while a previous run is still in progress
+var ErrChecksRunning = errors.New("checks are already running")
+
+// CheckFunc runs a check and sends its result to the server. ctx is cancelled at the check's
+// timeout or when the agent stops.
+type CheckFunc func(ctx context.Context, check shared.Check)
+
+// scheduledCheck is a check run on its own timer
+type scheduledCheck struct {
+	check    shared.Check
+	interval time.Duration
+	timer    *time.Timer // nil if the check is only run by RunAll
+	running  bool
+}
+
+func (sc *scheduledCheck) stop() {
+	if sc.timer != nil {
+		sc.timer.Stop()
+	}
+}
+
+// CheckScheduler runs each check on its own interval, with jitter and a timeout, and never runs
+// a check again while it is still running
+type CheckScheduler struct {
+	Logger   *logrus.Logger
+	StateDir string // Where the checks keep their state, see SaveState; not kept if empty
+
+	ctx   context.Context
+	track func() func()
+	funcs map[string]CheckFunc
+
+	mu       sync.Mutex
+	interval time.Duration // of the checks which do not set their own
+	checks   map[int]*scheduledCheck
+	states   map[int]*checkState // of the checks with thresholds, see Evaluate
+	forcing  bool
+	stopped  bool // no check is started once set, see Stop
+}
+
+// NewCheckScheduler returns a scheduler running the checks until ctx is done; track registers
+// each run as in-flight work, see Agent.Track
+func NewCheckScheduler(ctx context.Context, logger *logrus.Logger, track func() func()) *CheckScheduler {
+	return &CheckScheduler{
+		Logger:   logger,
+		ctx:      ctx,
+		track:    track,
+		funcs:    make(map[string]CheckFunc),
+		interval: CHECK_INTERVAL_DEF,
+		checks:   make(map[int]*scheduledCheck),
+		states:   make(map[int]*checkState),
+	}
+}
+
+// Register sets the function running a check type
+func (s *CheckScheduler) Register(checkType string, fn CheckFunc) {
+	s.funcs[checkType] = fn
+}
+
+// Types returns the supported check types, sorted
+func (s *CheckScheduler) Types() []string {
+	if s == nil {
+		return nil
+	}
+	ret := make([]string, 0, len(s.funcs))
+	for t := range s.funcs {
+		ret = append(ret, t)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Update schedules the given checks, which must be all of the agent's checks, see GetChecks:
+// new checks first run within CHECK_START_SPREAD, checks whose interval changed are rescheduled,
+// and checks no longer listed are stopped and their state removed.
+// A removed check still running is not cancelled.
+func (s *CheckScheduler) Update(all *shared.AllChecks) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped || s.ctx.Err() != nil {
+		return
+	}
+	s.setInterval(all.Interval)
+
+	listed := make(map[int]bool, len(all.Checks))
+	for _, c := range all.Checks {
+		if _, ok := s.funcs[c.CheckType]; !ok {
+			s.Logger.Debugln("Check type not supported:", c.CheckType)
+			continue
+		}
+		listed[c.CheckPK] = true
+		interval := s.intervalOf(c)
+
+		sc, ok := s.checks[c.CheckPK]
+		if !ok {
+			sc = &scheduledCheck{}
+			s.checks[c.CheckPK] = sc
+		}
+		sc.check = c
+		if sc.timer != nil && sc.interval == interval {
+			continue
+		}
+		sc.stop()
+		sc.interval = interval
+		s.schedule(sc, randDuration(min(interval, CHECK_START_SPREAD)))
+	}
+
+	for pk, sc := range s.checks {
+		if !listed[pk] && sc.timer != nil {
+			sc.stop()
+			delete(s.checks, pk)
+		}
+	}
+	for pk := range s.states {
+		if !listed[pk] {
+			delete(s.states, pk)
+		}
+	}
+	s.pruneStates(listed)
+}
+
+// Stop stops the timers of all checks, and no check is started afterwards; running checks
+// are cancelled through the context
+func (s *CheckScheduler) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	for pk, sc := range s.checks {
+		sc.stop()
+		sc.timer = nil
+		if !sc.running {
+			delete(s.checks, pk)
+		}
+	}
+}
+
+// Running reports whether all checks are being run, see RunAll
+func (s *CheckScheduler) Running() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.forcing
+}
+
+// RunAll runs the given checks at once and waits for them; the checks still running from their
+// schedule are skipped. It returns ErrChecksRunning if a previous RunAll is still in progress.
+func (s *CheckScheduler) RunAll(all *shared.AllChecks) error {
+	s.mu.Lock()
+	if s.forcing {
+		s.mu.Unlock()
+		return ErrChecksRunning
+	}
+	s.forcing = true
+	s.setInterval(all.Interval)
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.forcing = false
+		s.mu.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	for _, c := range all.Checks {
+		fn, ok := s.funcs[c.CheckType]
+		if !ok {
+			s.Logger.Debugln("Check type not supported:", c.CheckType)
+			continue
+		}
+		sc, interval, done := s.begin(c)
+		if sc == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(c shared.Check) {
+			defer wg.Done()
+			defer s.end(sc)
+			s.run(fn, c, interval, done)
+		}(c)
+	}
+	wg.Wait()
+	return nil
+}
+
+// schedule runs a check after d, then every interval with jitter; call with s.mu held
+func (s *CheckScheduler) schedule(sc *scheduledCheck, d time.Duration) {
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		s.mu.Lock()
+		if sc.timer != t || s.stopped || s.ctx.Err() != nil {
+			// stopped or rescheduled meanwhile
+			s.mu.Unlock()
+			return
+		}
+		c, interval := sc.check, sc.interval
+		s.schedule(sc, jitter(interval))
+		if sc.running {
+			s.mu.Unlock()
+			s.Logger.Debugf("Check %d is still running, skipping this run", c.CheckPK)
+			return
+		}
+		sc.running = true
+		// tracked before Stop can return, so that the agent waits for it
+		done := s.track()
+		s.mu.Unlock()
+
+		defer s.end(sc)
+		s.run(s.funcs[c.CheckType], c, interval, done)
+	})
+	sc.timer = t
+}
+
+// begin marks a check as running and returns its interval and the function to call once it has
+// completed, see Agent.Track, or nil if it is already running or the scheduler was stopped
+func (s *CheckScheduler) begin(c shared.Check) (*scheduledCheck, time.Duration, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return nil, 0, nil
+	}
+	sc, ok := s.checks[c.CheckPK]
+	if !ok {
+		// not scheduled, e.g. the checks are run once from the command line
+		sc = &scheduledCheck{check: c}
+		s.checks[c.CheckPK] = sc
+	} else if sc.running {
+		s.Logger.Debugf("Check %d is already running", c.CheckPK)
+		return nil, 0, nil
+	}
+	sc.running = true
+	return sc, s.intervalOf(c), s.track()
+}
+
+func (s *CheckScheduler) end(sc *scheduledCheck) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sc.running = false
+	if sc.timer == nil && s.checks[sc.check.CheckPK] == sc {
+		delete(s.checks, sc.check.CheckPK)
+	}
+}
+
+func (s *CheckScheduler) run(fn CheckFunc, c shared.Check, interval time.Duration, done func()) {
+	defer done()
+
+	timeout := min(interval, CHECK_TIMEOUT_DEF)
+	if c.Timeout > 0 {
+		timeout = time.Duration(c.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, timeout)
+	defer cancel()
+
+	defer func() {
+		if r := recover(); r != nil {
+			s.Logger.Errorf("Check %d (%s) panicked: %v", c.CheckPK, c.CheckType, r)
+		}
+	}()
+	fn(ctx, c)
+}
+
+// intervalOf returns the interval of a check; call with s.mu held
+func (s *CheckScheduler) intervalOf(c shared.Check) time.Duration {
+	if c.RunInterval > 0 {
+		return time.Duration(c.RunInterval) * time.Second
+	}
+	return s.interval
+}
+
+// setInterval sets the interval of the checks which do not set their own, in seconds; call with s.mu held
+func (s *CheckScheduler) setInterval(seconds int) {
+	if seconds > 0 {
+		s.interval = time.Duration(seconds) * time.Second
+	}
+}
+
+// jitter returns d spread by up to CHECK_JITTER percent either way
+func jitter(d time.Duration) time.Duration {
+	spread := d * CHECK_JITTER / 100
+	return d - spread + randDuration(2*spread)
+}
+
+func randDuration(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// GetChecks retrieves the agent's checks: those due if force is false, all of them otherwise
+func (a *Agent) GetChecks(force bool) (*shared.AllChecks, error) {
+	url := fmt.Sprintf("/api/v3/%s/checkrunner/", a.AgentID)
+	if force {
+		url = fmt.Sprintf("/api/v3/%s/runchecks/", a.AgentID)
+	}
+
+	r, err := a.RClient.R().Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if r.IsError() {
+		return nil, fmt.Errorf("checks response code: %v", r.StatusCode())
+	}
+
+	data := &shared.AllChecks{}
+	if err := json.Unmarshal(r.Body(), data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// CheckRunner keeps the scheduled checks in sync with the server until the service stops,
+// refreshing them every check interval. All the checks are fetched, not only those due, as the
+// scheduler decides when each of them runs.
+func (a *Agent) CheckRunner() {
+	a.Logger.Infoln("CheckRunner service started.")
+	ctx := a.Context()
+	defer a.Checks.Stop()
+
+	if !SleepContext(ctx, CHECK_STARTUP_DELAY+randDuration(CHECK_STARTUP_DELAY/2)) {
+		return
+	}
+	for {
+		interval := CHECK_INTERVAL_DEF
+		if data, err := a.GetChecks(true); err != nil {
+			a.Logger.Debugln("CheckRunner:", err)
+		} else {
+			if data.Interval > 0 {
+				interval = time.Duration(data.Interval) * time.Second
+			}
+			a.Checks.Update(data)
+		}
+
+		a.Logger.Debugf("CheckRunner refreshing the checks in %s", interval)
+		if !SleepContext(ctx, interval) {
+			return
+		}
+	}
+}
+
+// RunChecks runs the checks once and waits for them
+func (a *Agent) RunChecks(force bool) error {
+	data, err := a.GetChecks(force)
+	if err != nil {
+		return err
+	}
+	return a.Checks.RunAll(data)
+}
+
+// ReportCheck sends the result of a check and runs its assigned tasks if it fails. If status is
+// set, see CheckScheduler.Evaluate, it is sent with the result and decides whether the check fails,
+// even while the result is queued in the outbox. Otherwise, the server replies with the status.
+func (a *Agent) ReportCheck(c shared.Check, payload map[string]any, status string) {
+	if len(status) > 0 {
+		payload["status"] = status
+	}
+
+	replied, err := a.SendCheckResult(c.CheckPK, payload)
+	if err != nil {
+		a.Logger.Debugln(err)
+		if len(status) == 0 {
+			return
+		}
+	}
+	if len(status) == 0 {
+		status = replied
+	}
+	a.runAssignedTasks(status, c.AssignedTasks)
+}
+
+// runAssignedTasks runs the enabled remediation tasks of a failing check, and waits for them
+func (a *Agent) runAssignedTasks(status string, tasks []shared.AssignedTask) {
+	if len(tasks) == 0 || status != shared.CHECK_STATUS_FAILING {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, t := range tasks {
+		if t.Enabled {
+			wg.Add(1)
+			go func(pk int) {
+				defer wg.Done()
+				a.RunTask(pk)
+			}(t.TaskPK)
+		}
+	}
+	wg.Wait()
+}
+
+// RegisterCommonChecks registers the check types every platform supports
+func RegisterCommonChecks(s *CheckScheduler, a *Agent) {
+	s.Register(CHECK_TYPE_DISKSPACE, a.DiskCheck)
+	s.Register(CHECK_TYPE_CPULOAD, a.CPULoadCheck)
+	s.Register(CHECK_TYPE_MEMORY, a.MemCheck)
+	s.Register(CHECK_TYPE_PING, a.PingCheck)
+	s.Register(CHECK_TYPE_HTTP, a.HttpCheck)
+	s.Register(CHECK_TYPE_TCP, a.TcpCheck)
+	s.Register(CHECK_TYPE_DNS, a.DnsCheck)
+	s.Register(CHECK_TYPE_CERTEXPIRY, a.CertExpiryCheck)
+	s.Register(CHECK_TYPE_PROCESS, a.ProcessCheck)
+	s.Register(CHECK_TYPE_FILE, a.FileCheck)
+	s.Register(CHECK_TYPE_LOGFILE, a.LogFileCheck)
+}
+
+// ChecksRunning reports whether the checks are being run at once, see RunChecks
+func (a *Agent) ChecksRunning() bool {
+	return a.Checks.Running()
+}
+
+// CheckTypes returns the check types the agent handles
+func (a *Agent) CheckTypes() []string {
+	return a.Checks.Types()
+}
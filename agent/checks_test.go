@@ -0,0 +1,202 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/jetrmm/rmm-agent/shared"
+	"github.com/sirupsen/logrus"
+)
+
+// checkTestAgent runs checks with an agent keeping their results instead of sending them
+type checkTestAgent struct {
+	*Agent
+	t *testing.T
+
+	mu      sync.Mutex
+	results []map[string]any
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func newCheckTestAgent(t *testing.T) *checkTestAgent {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	ta := &checkTestAgent{t: t}
+	client := resty.New().SetBaseURL("http://rmm.invalid").SetTransport(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		result := make(map[string]any)
+		if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+			return nil, err
+		}
+		ta.mu.Lock()
+		ta.results = append(ta.results, result)
+		ta.mu.Unlock()
+		return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: io.NopCloser(strings.NewReader("")), Request: r}, nil
+	}))
+	checks := NewCheckScheduler(ctx, logger, func() func() { return func() {} })
+	checks.StateDir = t.TempDir()
+	ta.Agent = &Agent{Logger: logger, RClient: client, Checks: checks}
+	return ta
+}
+
+// run runs a check and returns the result it sent, decoded from JSON as the server would
+func (ta *checkTestAgent) run(fn CheckFunc, c shared.Check) map[string]any {
+	ta.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	before := len(ta.results)
+	fn(ctx, c)
+
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+	if len(ta.results) != before+1 {
+		ta.t.Fatalf("check %d sent %d results, want 1", c.CheckPK, len(ta.results)-before)
+	}
+	return ta.results[before]
+}
+
+// runStatus runs a check and fails the test unless it reports the given status
+func (ta *checkTestAgent) runStatus(fn CheckFunc, c shared.Check, status string) map[string]any {
+	ta.t.Helper()
+	result := ta.run(fn, c)
+	if result["status"] != status {
+		ta.t.Errorf("status %v, want %s: %v", result["status"], status, result["output"])
+	}
+	return result
+}
+
+// waitFor polls cond until it returns true, failing the test after the timeout
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(timeout); !cond(); time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out after %s waiting for %s", timeout, what)
+		}
+	}
+}
+
+func TestCheckScheduler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		runs     int
+		running  int
+		overlaps int
+		timeouts int
+	)
+	s := NewCheckScheduler(ctx, logrus.New(), func() func() { return func() {} })
+	s.Register("slow", func(ctx context.Context, c shared.Check) {
+		mu.Lock()
+		runs++
+		running++
+		if running > 1 {
+			overlaps++
+		}
+		mu.Unlock()
+
+		// due every second, but runs until its 2 second timeout
+		<-ctx.Done()
+
+		mu.Lock()
+		running--
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			timeouts++
+		}
+		mu.Unlock()
+	})
+	s.Update(&shared.AllChecks{Checks: []shared.Check{{CheckPK: 1, CheckType: "slow", RunInterval: 1, Timeout: 2}}})
+
+	waitFor(t, 15*time.Second, "3 timed out runs", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return timeouts >= 3
+	})
+	s.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if overlaps > 0 {
+		t.Errorf("check ran %d time(s) while still running", overlaps)
+	}
+	// runs due while the check is running are skipped
+	if runs > timeouts+1 {
+		t.Errorf("%d runs for %d timeouts", runs, timeouts)
+	}
+}
+
+func TestCheckSchedulerUpdate(t *testing.T) {
+	ta := newCheckTestAgent(t)
+	s := ta.Checks
+	s.Register("noop", func(context.Context, shared.Check) {})
+
+	all := []shared.Check{{CheckPK: 1, CheckType: "noop", RunInterval: 3600}, {CheckPK: 2, CheckType: "noop", RunInterval: 3600}}
+	s.Update(&shared.AllChecks{Checks: all})
+	for _, c := range all {
+		s.Status(c, failing)
+		if err := s.SaveState(c.CheckPK, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the same checks keep their schedule and state
+	s.Update(&shared.AllChecks{Checks: all})
+	if len(s.checks) != 2 || len(s.states) != 2 {
+		t.Errorf("%d checks scheduled, %d states, want 2", len(s.checks), len(s.states))
+	}
+
+	// a check no longer listed is stopped, and its state removed
+	s.Update(&shared.AllChecks{Checks: all[:1]})
+	var c shared.Check
+	if len(s.checks) != 1 || len(s.states) != 1 || !s.LoadState(1, &c) || s.LoadState(2, &c) {
+		t.Errorf("%d checks scheduled, %d states, want 1", len(s.checks), len(s.states))
+	}
+
+	// unsupported check types are not scheduled
+	s.Update(&shared.AllChecks{Checks: []shared.Check{{CheckPK: 3, CheckType: "nosuchtype"}}})
+	if len(s.checks) != 0 {
+		t.Errorf("%d checks scheduled, want none", len(s.checks))
+	}
+	s.Stop()
+}
+
+func TestCheckSchedulerStop(t *testing.T) {
+	var tracked, ran atomic.Int32
+	s := NewCheckScheduler(context.Background(), logrus.New(), func() func() {
+		tracked.Add(1)
+		return func() {}
+	})
+	s.Register("count", func(context.Context, shared.Check) { ran.Add(1) })
+	all := &shared.AllChecks{Checks: []shared.Check{{CheckPK: 1, CheckType: "count", RunInterval: 1}}}
+	s.Update(all)
+	// a run started before Stop returns is tracked by then
+	s.Stop()
+	before := tracked.Load()
+
+	// once stopped, checks are neither scheduled nor run, and no work is tracked
+	s.Update(all)
+	if err := s.RunAll(all); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if tracked.Load() != before || ran.Load() != before {
+		t.Errorf("%d runs tracked, %d run, want %d", tracked.Load(), ran.Load(), before)
+	}
+}
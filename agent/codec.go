@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/ugorji/go/codec"
+)
+
+// NATS payload content types
+const (
+	NATS_HDR_CONTENT_TYPE = "Content-Type"
+
+	CONTENT_TYPE_MSGPACK = "application/msgpack"
+	CONTENT_TYPE_JSON    = "application/json"
+	CONTENT_TYPE_CBOR    = "application/cbor"
+)
+
+// Codec encodes and decodes NATS payloads
+type Codec interface {
+	ContentType() string
+	Encode(v any) ([]byte, error)
+	Decode(data []byte, v any) error
+}
+
+// handleCodec is a Codec backed by an ugorji handle, which honors the json struct tags
+type handleCodec struct {
+	contentType string
+	handle      codec.Handle
+}
+
+func (c *handleCodec) ContentType() string {
+	return c.contentType
+}
+
+func (c *handleCodec) Encode(v any) ([]byte, error) {
+	var b []byte
+	err := codec.NewEncoderBytes(&b, c.handle).Encode(v)
+	return b, err
+}
+
+func (c *handleCodec) Decode(data []byte, v any) error {
+	return codec.NewDecoderBytes(data, c.handle).Decode(v)
+}
+
+var (
+	MsgpackCodec Codec = &handleCodec{CONTENT_TYPE_MSGPACK, newMsgpackHandle()}
+	JsonCodec    Codec = &handleCodec{CONTENT_TYPE_JSON, &codec.JsonHandle{}}
+	CborCodec    Codec = &handleCodec{CONTENT_TYPE_CBOR, &codec.CborHandle{}}
+)
+
+func newMsgpackHandle() codec.Handle {
+	var mh codec.MsgpackHandle
+	mh.RawToString = true
+	return &mh
+}
+
+// codecAliases maps the accepted content types to their codec
+var codecAliases = map[string]Codec{
+	CONTENT_TYPE_MSGPACK:      MsgpackCodec,
+	"application/x-msgpack":   MsgpackCodec,
+	"application/vnd.msgpack": MsgpackCodec,
+	CONTENT_TYPE_JSON:         JsonCodec,
+	"text/json":               JsonCodec,
+	CONTENT_TYPE_CBOR:         CborCodec,
+}
+
+// CodecFor returns the codec for a content type; msgpack is used if it is empty
+func CodecFor(contentType string) (Codec, error) {
+	if len(contentType) == 0 {
+		return MsgpackCodec, nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content type %q: %w", contentType, err)
+	}
+	if c, ok := codecAliases[strings.ToLower(mediaType)]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("unsupported content type %q", contentType)
+}
+
+// codecForMsg returns the codec of a message, from its Content-Type header
+func codecForMsg(msg *nats.Msg) (Codec, error) {
+	if msg.Header == nil {
+		return MsgpackCodec, nil
+	}
+	return CodecFor(msg.Header.Get(NATS_HDR_CONTENT_TYPE))
+}
+
+// newCodecMsg returns a message with the encoded payload and its Content-Type header
+func newCodecMsg(c Codec, subject, reply string, v any) (*nats.Msg, error) {
+	data, err := c.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := nats.NewMsg(subject)
+	msg.Reply = reply
+	msg.Data = data
+	msg.Header.Set(NATS_HDR_CONTENT_TYPE, c.ContentType())
+	return msg, nil
+}
+
+// PublishCheckIn sends a check-in payload to the server, encoded with the configured codec
+// and, if it is large, compressed and split into chunks, see publishMsg. While NATS is
+// disconnected, the latest check-in of each mode is kept in the outbox.
+func (a *Agent) PublishCheckIn(nc *nats.Conn, mode string, payload any) error {
+	c, err := CodecFor(a.Codec)
+	if err != nil {
+		return err
+	}
+	if err := checkEncoding(a.Compression); err != nil {
+		return err
+	}
+	msg, err := newCodecMsg(c, a.AgentID, mode, payload)
+	if err != nil {
+		return err
+	}
+	if a.Outbox == nil {
+		return publishMsg(nc, msg, a.Compression, true)
+	}
+
+	key := "checkin:" + mode
+	e := &OutboxEntry{
+		Key:     key,
+		Subject: msg.Subject,
+		Reply:   msg.Reply,
+		Header:  nats.Header{NATS_HDR_CONTENT_TYPE: []string{c.ContentType()}},
+		Body:    msg.Data,
+	}
+	if !a.Outbox.Pending(key) && nc.IsConnected() {
+		err := publishMsg(nc, msg, a.Compression, true)
+		if err == nil {
+			return nil
+		}
+		a.Logger.Debugln("Checkin:", err, "queueing")
+	}
+	if err := a.Outbox.Put(e, true); err != nil {
+		return fmt.Errorf("outbox: %w", err)
+	}
+	return ErrQueued
+}
@@ -1,19 +1,134 @@
 package agent
 
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// CONFIG_SCHEMA_VERSION is the current version of the persisted configuration layout
+const CONFIG_SCHEMA_VERSION = 2
+
+var (
+	ErrConfigNotFound = errors.New("agent configuration not found")
+	ErrConfigReadOnly = errors.New("agent configuration is read-only")
+)
+
 type IAgentConfig interface {
 	setConfig(config *AgentConfig)
 	getConfig() *AgentConfig
 }
 
 type AgentConfig struct {
-	AgentID string // Username (as ULID)
-	AgentPK int    // Primary Key on server?
-	BaseURL string // Server URL
-	ApiURL  string // NATS
-	ApiPort int    // NATS Port (4222)
-	Token   string // Authorization token
-	Cert    string // Root Certificate
-	Debug   bool
-	Version string
-	Headers map[string]string
+	Schema        int               `json:"version"`
+	AgentID       string            `json:"agent_id"`                     // Username (as ULID)
+	AgentPK       int               `json:"agent_pk"`                     // Primary Key on server?
+	BaseURL       string            `json:"base_url"`                     // Server URL
+	ApiURL        string            `json:"api_url"`                      // NATS
+	ApiPort       int               `json:"api_port"`                     // NATS Port (4222)
+	Token         string            `json:"token"`                        // Authorization token
+	Cert          string            `json:"root_cert"`                    // Root Certificate
+	NKeySeed      string            `json:"nkey_seed,omitempty"`          // NATS NKey user seed
+	CredsFile     string            `json:"creds_file,omitempty"`         // NATS user JWT credentials (.creds)
+	JetStream     bool              `json:"jetstream,omitempty"`          // Receive commands from a durable JetStream consumer
+	LegacyReplies bool              `json:"legacy_replies,omitempty"`     // Reply with bare strings for servers without shared.RpcResponse
+	Codec         string            `json:"codec,omitempty"`              // Content type of check-ins (CONTENT_TYPE_*), defaults to msgpack
+	RpcMaxConc    int               `json:"rpc_max_concurrent,omitempty"` // RPC handlers running at once, defaults to RPC_MAX_CONCURRENT
+	RpcQueueTime  int               `json:"rpc_queue_timeout,omitempty"`  // Seconds a request waits for a handler, defaults to RPC_QUEUE_TIMEOUT
+	RpcLimits     map[string]int    `json:"rpc_limits,omitempty"`         // Concurrent requests per function, e.g. {"agentupdate": 1}
+	Compression   string            `json:"compression,omitempty"`        // Encoding of large check-ins and replies (ENCODING_*), defaults to none
+	Debug         bool              `json:"-"`
+	Version       string            `json:"-"`
+	Headers       map[string]string `json:"-"`
+}
+
+// secrets returns the fields that must be protected at rest
+func (c *AgentConfig) secrets() map[string]*string {
+	return map[string]*string{
+		"token":     &c.Token,
+		"nkey_seed": &c.NKeySeed,
+	}
+}
+
+// ConfigStore persists the agent configuration, e.g. to a file or the Windows registry
+type ConfigStore interface {
+	// Load returns ErrConfigNotFound if the agent has not been installed
+	Load() (*AgentConfig, error)
+	Save(cfg *AgentConfig) error
+	Delete() error
+}
+
+// configMigrations upgrade a raw configuration from schema version i+1 to i+2
+var configMigrations = []func(raw map[string]any) error{
+	// v1 -> v2: schema version and NATS port added
+	func(raw map[string]any) error {
+		if _, ok := raw["api_port"]; !ok {
+			raw["api_port"] = NATS_DEFAULT_PORT
+		}
+		return nil
+	},
+}
+
+// migrateConfig upgrades a raw configuration to CONFIG_SCHEMA_VERSION.
+// Returns true if any migration was applied.
+func migrateConfig(raw map[string]any) (bool, error) {
+	version := 1
+	if v, ok := raw["version"].(float64); ok {
+		version = int(v)
+	}
+
+	if version > CONFIG_SCHEMA_VERSION {
+		return false, fmt.Errorf("agent configuration version %d is newer than supported version %d", version, CONFIG_SCHEMA_VERSION)
+	}
+
+	migrated := false
+	for ; version < CONFIG_SCHEMA_VERSION; version++ {
+		if err := configMigrations[version-1](raw); err != nil {
+			return migrated, fmt.Errorf("migrating agent configuration to version %d: %w", version+1, err)
+		}
+		raw["version"] = version + 1
+		migrated = true
+	}
+	return migrated, nil
+}
+
+// LoadConfig reads the configuration from the store and sets up the REST client.
+// A missing configuration leaves the agent with an empty one.
+func (a *Agent) LoadConfig(store ConfigStore, version string) error {
+	a.Store = store
+	debug := a.Logger.IsLevelEnabled(logrus.DebugLevel)
+
+	cfg, err := store.Load()
+	if err != nil {
+		cfg = &AgentConfig{}
+	}
+	if cfg.ApiPort == 0 {
+		cfg.ApiPort = NATS_DEFAULT_PORT
+	}
+	cfg.Version = version
+	cfg.Debug = debug
+	cfg.Headers = make(map[string]string)
+
+	restyC := resty.New()
+	if len(cfg.Token) > 0 {
+		cfg.Headers["Content-Type"] = "application/json"
+		cfg.Headers["Authorization"] = fmt.Sprintf("Token %s", cfg.Token)
+	}
+	if len(cfg.BaseURL) > 0 {
+		restyC.SetBaseURL(cfg.BaseURL)
+		restyC.SetCloseConnection(true)
+		restyC.SetHeaders(cfg.Headers)
+		restyC.SetTimeout(15 * time.Second)
+		restyC.SetDebug(debug)
+		if len(cfg.Cert) > 0 {
+			restyC.SetRootCertificate(cfg.Cert)
+		}
+	}
+
+	a.AgentConfig = cfg
+	a.RClient = restyC
+	return err
 }
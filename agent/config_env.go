@@ -0,0 +1,180 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Environment variables read by EnvConfigStore
+const (
+	ENV_AGENT_ID  = "RMM_AGENT_ID"
+	ENV_AGENT_PK  = "RMM_AGENT_PK"
+	ENV_BASE_URL  = "RMM_BASE_URL"
+	ENV_API_URL   = "RMM_API_URL"
+	ENV_API_PORT  = "RMM_API_PORT"
+	ENV_TOKEN     = "RMM_TOKEN"
+	ENV_ROOT_CERT = "RMM_ROOT_CERT"
+	ENV_NKEY_SEED = "RMM_NKEY_SEED"
+	ENV_CREDS     = "RMM_CREDS_FILE"
+	ENV_JETSTREAM = "RMM_JETSTREAM"
+	ENV_LEGACY    = "RMM_LEGACY_REPLIES"
+	ENV_CODEC     = "RMM_CODEC"
+	ENV_COMPRESS  = "RMM_COMPRESSION"
+
+	ENV_RPC_MAX_CONCURRENT = "RMM_RPC_MAX_CONCURRENT"
+	ENV_RPC_QUEUE_TIMEOUT  = "RMM_RPC_QUEUE_TIMEOUT" // Seconds
+	ENV_RPC_LIMITS         = "RMM_RPC_LIMITS"        // Per-function limits, e.g. "agentupdate=1,runchecks=2"
+)
+
+// EnvConfigStore reads the configuration from RMM_* environment variables, e.g. in containers.
+// If Base is set, its configuration is loaded first and the environment overrides it;
+// saving and deleting are passed through to Base. Values from the environment are never
+// saved: Base keeps its own.
+type EnvConfigStore struct {
+	Base ConfigStore
+
+	base       *AgentConfig    // configuration loaded from Base, before the environment
+	overridden map[string]bool // environment variables set on the last Load
+}
+
+func NewEnvConfigStore(base ConfigStore) *EnvConfigStore {
+	return &EnvConfigStore{Base: base}
+}
+
+// envStrings, envInts and envBools map environment variables to the fields they set
+func envStrings(cfg *AgentConfig) map[string]*string {
+	return map[string]*string{
+		ENV_AGENT_ID:  &cfg.AgentID,
+		ENV_BASE_URL:  &cfg.BaseURL,
+		ENV_API_URL:   &cfg.ApiURL,
+		ENV_TOKEN:     &cfg.Token,
+		ENV_ROOT_CERT: &cfg.Cert,
+		ENV_NKEY_SEED: &cfg.NKeySeed,
+		ENV_CREDS:     &cfg.CredsFile,
+		ENV_CODEC:     &cfg.Codec,
+		ENV_COMPRESS:  &cfg.Compression,
+	}
+}
+
+func envInts(cfg *AgentConfig) map[string]*int {
+	return map[string]*int{
+		ENV_AGENT_PK:           &cfg.AgentPK,
+		ENV_API_PORT:           &cfg.ApiPort,
+		ENV_RPC_MAX_CONCURRENT: &cfg.RpcMaxConc,
+		ENV_RPC_QUEUE_TIMEOUT:  &cfg.RpcQueueTime,
+	}
+}
+
+func envBools(cfg *AgentConfig) map[string]*bool {
+	return map[string]*bool{
+		ENV_JETSTREAM: &cfg.JetStream,
+		ENV_LEGACY:    &cfg.LegacyReplies,
+	}
+}
+
+func (s *EnvConfigStore) Load() (*AgentConfig, error) {
+	cfg := &AgentConfig{}
+	base := &AgentConfig{}
+	overridden := make(map[string]bool)
+	found := false
+
+	if s.Base != nil {
+		loaded, err := s.Base.Load()
+		if err == nil {
+			base = loaded
+			found = true
+		} else if err != ErrConfigNotFound {
+			return nil, err
+		}
+	}
+	*cfg = *base
+
+	for env, field := range envStrings(cfg) {
+		if v, ok := os.LookupEnv(env); ok {
+			*field = v
+			overridden[env] = true
+		}
+	}
+
+	for env, field := range envInts(cfg) {
+		if v, ok := os.LookupEnv(env); ok {
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid number %q", env, v)
+			}
+			*field = i
+			overridden[env] = true
+		}
+	}
+
+	for env, field := range envBools(cfg) {
+		if v, ok := os.LookupEnv(env); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid boolean %q", env, v)
+			}
+			*field = b
+			overridden[env] = true
+		}
+	}
+
+	if v, ok := os.LookupEnv(ENV_RPC_LIMITS); ok {
+		limits, err := ParseRpcLimits(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ENV_RPC_LIMITS, err)
+		}
+		cfg.RpcLimits = limits
+		overridden[ENV_RPC_LIMITS] = true
+	}
+
+	s.base, s.overridden = base, overridden
+	if !found && len(overridden) == 0 {
+		return nil, ErrConfigNotFound
+	}
+	cfg.Schema = CONFIG_SCHEMA_VERSION
+	return cfg, nil
+}
+
+// Save saves cfg to Base, with the values of Base in place of those set from the environment
+func (s *EnvConfigStore) Save(cfg *AgentConfig) error {
+	if s.Base == nil {
+		return ErrConfigReadOnly
+	}
+	if len(s.overridden) == 0 {
+		return s.Base.Save(cfg)
+	}
+
+	out := *cfg
+	base := s.base
+	if base == nil {
+		base = &AgentConfig{}
+	}
+	baseStrings, baseInts, baseBools := envStrings(base), envInts(base), envBools(base)
+	for env, field := range envStrings(&out) {
+		if s.overridden[env] {
+			*field = *baseStrings[env]
+		}
+	}
+	for env, field := range envInts(&out) {
+		if s.overridden[env] {
+			*field = *baseInts[env]
+		}
+	}
+	for env, field := range envBools(&out) {
+		if s.overridden[env] {
+			*field = *baseBools[env]
+		}
+	}
+	if s.overridden[ENV_RPC_LIMITS] {
+		out.RpcLimits = base.RpcLimits
+	}
+	return s.Base.Save(&out)
+}
+
+func (s *EnvConfigStore) Delete() error {
+	if s.Base == nil {
+		return ErrConfigReadOnly
+	}
+	return s.Base.Delete()
+}
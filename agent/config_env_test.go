@@ -0,0 +1,74 @@
+package agent
+
+import "testing"
+
+// memConfigStore keeps a configuration in memory
+type memConfigStore struct {
+	cfg *AgentConfig
+}
+
+func (s *memConfigStore) Load() (*AgentConfig, error) {
+	if s.cfg == nil {
+		return nil, ErrConfigNotFound
+	}
+	cfg := *s.cfg
+	return &cfg, nil
+}
+
+func (s *memConfigStore) Save(cfg *AgentConfig) error {
+	saved := *cfg
+	s.cfg = &saved
+	return nil
+}
+
+func (s *memConfigStore) Delete() error {
+	s.cfg = nil
+	return nil
+}
+
+func TestEnvConfigStore(t *testing.T) {
+	base := &memConfigStore{cfg: &AgentConfig{AgentID: "agent", Token: "file token", ApiPort: 4222}}
+	store := NewEnvConfigStore(base)
+
+	t.Setenv(ENV_TOKEN, "env token")
+	t.Setenv(ENV_NKEY_SEED, "SUAEXAMPLE")
+	t.Setenv(ENV_API_PORT, "4333")
+	t.Setenv(ENV_JETSTREAM, "1")
+	cfg, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.AgentID != "agent" || cfg.Token != "env token" || cfg.NKeySeed != "SUAEXAMPLE" || cfg.ApiPort != 4333 || !cfg.JetStream {
+		t.Fatalf("loaded %+v, want the file overridden by the environment", cfg)
+	}
+
+	// the environment is not saved, the rest is
+	cfg.AgentPK = 7
+	if err := store.Save(cfg); err != nil {
+		t.Fatal(err)
+	}
+	saved := base.cfg
+	if saved.Token != "file token" || saved.NKeySeed != "" || saved.ApiPort != 4222 || saved.JetStream {
+		t.Errorf("saved %+v, want the values of the file", saved)
+	}
+	if saved.AgentID != "agent" || saved.AgentPK != 7 {
+		t.Errorf("saved %+v, want agent id and pk 7", saved)
+	}
+}
+
+func TestEnvConfigStoreNotFound(t *testing.T) {
+	store := NewEnvConfigStore(&memConfigStore{})
+	if _, err := store.Load(); err != ErrConfigNotFound {
+		t.Errorf("got %v, want ErrConfigNotFound", err)
+	}
+
+	// without a base, the environment is the configuration, and cannot be saved
+	t.Setenv(ENV_AGENT_ID, "agent")
+	store = NewEnvConfigStore(nil)
+	if cfg, err := store.Load(); err != nil || cfg.AgentID != "agent" {
+		t.Errorf("got %+v, %v, want agent", cfg, err)
+	}
+	if err := store.Save(&AgentConfig{}); err != ErrConfigReadOnly {
+		t.Errorf("saved: %v, want ErrConfigReadOnly", err)
+	}
+}
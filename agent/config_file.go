@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// FileConfigStore keeps the agent configuration in a JSON file readable only by its owner.
+// Secrets (the Token and NKey seed) are sealed by Sealer before they are written.
+type FileConfigStore struct {
+	Path   string
+	Sealer SecretSealer
+}
+
+// NewFileConfigStore returns a file store; a nil sealer stores secrets in plaintext
+func NewFileConfigStore(path string, sealer SecretSealer) *FileConfigStore {
+	if sealer == nil {
+		sealer = PlainSealer{}
+	}
+	return &FileConfigStore{Path: path, Sealer: sealer}
+}
+
+// Load reads the configuration, migrating and re-saving it if the schema is outdated
+// or if it still contains unsealed secrets
+func (s *FileConfigStore) Load() (*AgentConfig, error) {
+	fi, err := os.Stat(s.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrConfigNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s must not be accessible by group or others (mode %#o)", s.Path, fi.Mode().Perm())
+	}
+
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make(map[string]any)
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.Path, err)
+	}
+
+	migrated, err := migrateConfig(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	// round-trip through JSON to decode the migrated map into the config struct
+	data, err = json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &AgentConfig{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.Path, err)
+	}
+
+	resave := migrated
+	for name, field := range cfg.secrets() {
+		if len(*field) > 0 && !IsSealed(*field) && s.Sealer.Name() != SEALER_PLAIN {
+			resave = true
+		}
+		if *field, err = s.Sealer.Unseal(*field); err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", s.Path, name, err)
+		}
+	}
+
+	if resave {
+		if err := s.Save(cfg); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// Save atomically replaces the configuration file
+func (s *FileConfigStore) Save(cfg *AgentConfig) error {
+	dir := filepath.Dir(s.Path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	cfg.Schema = CONFIG_SCHEMA_VERSION
+	sealed := *cfg
+	for name, field := range sealed.secrets() {
+		if len(*field) == 0 {
+			continue
+		}
+		v, err := s.Sealer.Seal(*field)
+		if err != nil {
+			return fmt.Errorf("unable to seal %s: %w", name, err)
+		}
+		*field = v
+	}
+
+	data, err := json.MarshalIndent(&sealed, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.Path, data, 0600)
+}
+
+// Delete removes the configuration file
+func (s *FileConfigStore) Delete() error {
+	err := os.Remove(s.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory and renames it over path,
+// so readers never observe a partially written file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// persist the rename itself
+	if d, err := os.Open(filepath.Dir(path)); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+	return nil
+}
@@ -8,6 +8,10 @@ const (
 	// NATS_RMM_IDENTIFIER = "ACMERMM"
 
 	TASK_PREFIX = "RMM_"
+
+	// RPC_PROTOCOL_VERSION is advertised to the server; bump it on incompatible RPC changes.
+	// 1: bare replies, 2: shared.RpcResponse envelope
+	RPC_PROTOCOL_VERSION = 2
 )
 
 const (
@@ -19,6 +23,9 @@ const (
 	NATS_CMD_GETWINUPDATES      = "getwinupdates"
 	NATS_CMD_INSTALL_CHOCO      = "installchoco"
 	NATS_CMD_INSTALL_WINUPDATES = "installwinupdates"
+	NATS_CMD_JOB_CANCEL         = "canceljob"
+	NATS_CMD_JOB_LIST           = "jobs"
+	NATS_CMD_JOB_STATUS         = "jobstatus"
 	NATS_CMD_PING               = "ping"
 	NATS_CMD_PROCS_KILL         = "killproc"
 	NATS_CMD_PROCS_LIST         = "procs"
@@ -44,3 +51,46 @@ const (
 	NATS_CMD_WINSVC_EDIT        = "editwinsvc"
 	NATS_CMD_WMI                = "wmi"
 )
+
+const (
+	API_URL_CHECKIN     = "/api/v3/checkin/"
+	API_URL_CHECKRUNNER = "/api/v3/checkrunner/"
+	API_URL_SOFTWARE    = "/api/v3/software/"
+	API_URL_SYSINFO     = "/api/v3/sysinfo/"
+)
+
+const (
+	CHECKIN_MODE_DISKS        = "disks"
+	CHECKIN_MODE_HELLO        = "hello"
+	CHECKIN_MODE_LOGGEDONUSER = "loggedonuser"
+	CHECKIN_MODE_OSINFO       = "osinfo"
+	CHECKIN_MODE_PUBLICIP     = "publicip"
+	CHECKIN_MODE_SOFTWARE     = "software"
+	CHECKIN_MODE_STARTUP      = "startup"
+	CHECKIN_MODE_WINSERVICES  = "winservices"
+
+	NATS_MODE_DISKS       = "agent-disks"
+	NATS_MODE_HELLO       = "agent-hello"
+	NATS_MODE_OSINFO      = "agent-agentinfo"
+	NATS_MODE_PUBLICIP    = "agent-publicip"
+	NATS_MODE_WINSERVICES = "agent-winsvc"
+	NATS_MODE_SYSINFO     = "agent-sysinfo" // was "agent-wmi"
+)
+
+// Check Types
+const (
+	CHECK_TYPE_DISKSPACE  = "diskspace"
+	CHECK_TYPE_CPULOAD    = "cpuload"
+	CHECK_TYPE_MEMORY     = "memory"
+	CHECK_TYPE_PING       = "ping"
+	CHECK_TYPE_SCRIPT     = "script"
+	CHECK_TYPE_WINSVC     = "winsvc"
+	CHECK_TYPE_EVENTLOG   = "eventlog"
+	CHECK_TYPE_HTTP       = "http"
+	CHECK_TYPE_TCP        = "tcp"
+	CHECK_TYPE_DNS        = "dns"
+	CHECK_TYPE_CERTEXPIRY = "certexpiry"
+	CHECK_TYPE_PROCESS    = "process"
+	CHECK_TYPE_FILE       = "file"
+	CHECK_TYPE_LOGFILE    = "logfile"
+)
@@ -1,6 +1,8 @@
 package freebsd
 
 import (
+	"context"
+
 	"github.com/jetrmm/rmm-agent/agent"
 	jrmm "github.com/jetrmm/rmm-shared"
 	"github.com/kardianos/service"
@@ -70,22 +72,22 @@ func (a *freebsdAgent) RunScript(code string, shell string, args []string, timeo
 	panic("implement me")
 }
 
-func (a *freebsdAgent) CheckIn(nc *nats.Conn, mode string) {
+func (a *freebsdAgent) RunScriptContext(ctx context.Context, code string, shell string, args []string, timeout int) (stdout, stderr string, exitcode int, e error) {
 	// TODO implement me
 	panic("implement me")
 }
 
-func (a *freebsdAgent) CreateInternalTask(name, args, repeat string, start int) (bool, error) {
+func (a *freebsdAgent) CheckIn(nc *nats.Conn, mode string) {
 	// TODO implement me
 	panic("implement me")
 }
 
-func (a *freebsdAgent) CheckRunner() {
+func (a *freebsdAgent) CreateInternalTask(name, args, repeat string, start int) (bool, error) {
 	// TODO implement me
 	panic("implement me")
 }
 
-func (a *freebsdAgent) GetCheckInterval() (int, error) {
+func (a *freebsdAgent) CheckRunner() {
 	// TODO implement me
 	panic("implement me")
 }
@@ -6,12 +6,15 @@ type InstallInfo struct {
 	Headers     map[string]string
 	ServerURL   string        // JSON endpoint URL
 	ApiURL      string        // RPC endpoint (NATS) URL as host:port
+	NatsPort    int           // NATS port, defaults to NATS_DEFAULT_PORT
 	ClientID    int           // Client ID
 	SiteID      int           // Client Site ID
 	Description string        // Defaults to hostname
 	Token       string        // Authorization token (password)
 	RootCert    string        // Trusted Root Certificate
+	CredsFile   string        // NATS user JWT credentials; an NKey is generated if empty
 	Timeout     time.Duration // Installation timeout
 	Silent      bool          // Silent installation
+	NoService   bool          // Do not install the agent service, e.g. in containers
 	// AgentType   string // Workstation, Server
 }
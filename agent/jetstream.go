@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// JetStream command delivery
+const (
+	NATS_JS_STREAM      = "RMM_COMMANDS" // Stream holding the commands of all agents, created by the server
+	NATS_JS_ACK_WAIT    = 60 * time.Second
+	NATS_JS_MAX_DELIVER = 5
+	NATS_JS_MAX_PENDING = 16               // Commands handled concurrently
+	NATS_JS_MAX_AGE     = 24 * time.Hour   // Expiry of commands without an expiry header
+	NATS_JS_BUSY_DELAY  = 30 * time.Second // Redelivery delay of commands rejected as busy
+
+	NATS_HDR_REPLY   = "Rmm-Reply"   // Reply subject; the JetStream reply subject is used for acks
+	NATS_HDR_EXPIRES = "Rmm-Expires" // RFC 3339 time after which the command is discarded
+)
+
+// SubscribeRpc subscribes to the agent's commands, either directly on the AgentID subject or,
+// if enabled, through a durable JetStream consumer which keeps the commands sent while the
+// agent was offline
+func (a *Agent) SubscribeRpc(nc *nats.Conn) error {
+	if !a.JetStream {
+		sub, err := nc.Subscribe(a.AgentID, func(msg *nats.Msg) {
+			a.ProcessRpcMsg(nc, msg)
+		})
+		if err != nil {
+			return err
+		}
+		a.setDrainRpc(func() { _ = sub.Drain() })
+		return nil
+	}
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(a.Context(), 30*time.Second)
+	defer cancel()
+
+	cons, err := js.CreateOrUpdateConsumer(ctx, NATS_JS_STREAM, jetstream.ConsumerConfig{
+		Durable:       a.AgentID,
+		FilterSubject: a.AgentID,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       NATS_JS_ACK_WAIT,
+		MaxDeliver:    NATS_JS_MAX_DELIVER,
+		MaxAckPending: NATS_JS_MAX_PENDING,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create JetStream consumer on %s: %w", NATS_JS_STREAM, err)
+	}
+
+	cc, err := cons.Consume(func(msg jetstream.Msg) {
+		go a.processJetStreamMsg(nc, msg)
+	})
+	if err != nil {
+		return err
+	}
+	// unacked commands are redelivered once the agent is back
+	a.setDrainRpc(cc.Drain)
+	return nil
+}
+
+// processJetStreamMsg runs a durable command and acks it once its handler has completed
+func (a *Agent) processJetStreamMsg(nc *nats.Conn, msg jetstream.Msg) {
+	meta, err := msg.Metadata()
+	if err != nil {
+		a.Logger.Errorln("JetStream:", err)
+		_ = msg.Term()
+		return
+	}
+
+	if expires := commandExpiry(msg.Headers(), meta.Timestamp); time.Now().After(expires) {
+		a.Logger.Debugf("JetStream: discarding command #%d, expired at %s", meta.Sequence.Stream, expires)
+		_ = msg.Term()
+		return
+	}
+
+	// keep the command from being redelivered while a long-running handler is busy
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		t := time.NewTicker(NATS_JS_ACK_WAIT / 2)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				_ = msg.InProgress()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	m := &nats.Msg{
+		Subject: msg.Subject(),
+		Reply:   msg.Headers().Get(NATS_HDR_REPLY),
+		Header:  msg.Headers(),
+		Data:    msg.Data(),
+	}
+	err = a.Rpc.Handle(nc, m, msg.Ack)
+	switch {
+	case err == nil:
+	case IsBusy(err) && meta.NumDelivered < NATS_JS_MAX_DELIVER:
+		// try again once the running commands may have completed
+		a.Logger.Debugf("JetStream: command #%d delayed: %s", meta.Sequence.Stream, err)
+		_ = msg.NakWithDelay(NATS_JS_BUSY_DELAY)
+	case IsBusy(err):
+		a.Logger.Errorf("JetStream: discarding command #%d: %s", meta.Sequence.Stream, err)
+		a.Rpc.Reject(nc, m, err)
+		_ = msg.Term()
+	default:
+		// the command would fail the same way on every delivery
+		a.Logger.Errorln("JetStream:", err)
+		_ = msg.Term()
+	}
+}
+
+// commandExpiry returns when a command expires, from its header or its age
+func commandExpiry(h nats.Header, published time.Time) time.Time {
+	if v := h.Get(NATS_HDR_EXPIRES); len(v) > 0 {
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return t
+		}
+	}
+	return published.Add(NATS_JS_MAX_AGE)
+}
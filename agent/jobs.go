@@ -0,0 +1,272 @@
+package agent
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+	"github.com/oklog/ulid/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// Job retention
+const (
+	JOB_RETENTION    = time.Hour // Finished jobs are kept for status queries
+	JOB_MAX_FINISHED = 100       // Older finished jobs are removed first
+)
+
+type jobContextKey struct{}
+
+// Job is a long-running RPC which can be queried and cancelled while it runs
+type Job struct {
+	ID   string
+	Func string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	status    string
+	started   time.Time
+	finished  time.Time
+	pids      map[int32]bool
+	result    any
+	err       error
+	cancelled bool
+	noCancel  bool
+}
+
+// Context is cancelled when the job is cancelled or the agent stops.
+// Functions called with it record their processes with AddJobProcess.
+func (j *Job) Context() context.Context {
+	return j.ctx
+}
+
+// DisableCancel prevents the job from being cancelled, e.g. while the agent is being updated
+func (j *Job) DisableCancel() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.noCancel = true
+}
+
+// Cancel kills the processes of the job and their children, and cancels its context
+func (j *Job) Cancel() error {
+	j.mu.Lock()
+	if j.status != shared.JOB_STATUS_RUNNING {
+		j.mu.Unlock()
+		return NewRpcError(shared.RPC_ERR_INVALID, "job %s is %s", j.ID, j.status)
+	}
+	if j.noCancel {
+		j.mu.Unlock()
+		return NewRpcError(shared.RPC_ERR_FAILED, "job %s (%s) cannot be cancelled", j.ID, j.Func)
+	}
+	j.cancelled = true
+	pids := make([]int32, 0, len(j.pids))
+	for pid := range j.pids {
+		pids = append(pids, pid)
+	}
+	j.mu.Unlock()
+
+	j.cancel()
+	for _, pid := range pids {
+		_ = KillProc(pid)
+	}
+	return nil
+}
+
+// Info returns the state of the job; the result is only included if withResult is set
+func (j *Job) Info(withResult bool) shared.JobInfo {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	info := shared.JobInfo{
+		ID:      j.ID,
+		Func:    j.Func,
+		Status:  j.status,
+		Started: j.started,
+	}
+	if !j.finished.IsZero() {
+		finished := j.finished
+		info.Finished = &finished
+	}
+	for pid := range j.pids {
+		info.Pids = append(info.Pids, pid)
+	}
+	sort.Slice(info.Pids, func(a, b int) bool { return info.Pids[a] < info.Pids[b] })
+	if j.err != nil {
+		info.Error = j.err.Error()
+	}
+	if withResult {
+		info.Result = j.result
+	}
+	return info
+}
+
+// addProcess records a process of the job, returning a function to remove it once it has exited
+func (j *Job) addProcess(pid int32) (remove func()) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.pids[pid] = true
+	return func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		delete(j.pids, pid)
+	}
+}
+
+// finish records the result of the job
+func (j *Job) finish(result any, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.result, j.err = result, err
+	j.finished = time.Now()
+	switch {
+	case j.cancelled:
+		j.status = shared.JOB_STATUS_CANCELLED
+	case err != nil:
+		j.status = shared.JOB_STATUS_FAILED
+	default:
+		j.status = shared.JOB_STATUS_COMPLETED
+	}
+	j.cancel()
+}
+
+// JobFromContext returns the job running with ctx, if any
+func JobFromContext(ctx context.Context) (*Job, bool) {
+	job, ok := ctx.Value(jobContextKey{}).(*Job)
+	return job, ok
+}
+
+// AddJobProcess records a process started with the context of a job, so that it is killed
+// if the job is cancelled. Call the returned function once the process has exited.
+func AddJobProcess(ctx context.Context, pid int32) (remove func()) {
+	job, ok := JobFromContext(ctx)
+	if !ok {
+		return func() {}
+	}
+	return job.addProcess(pid)
+}
+
+// JobManager keeps track of the running and recently finished jobs
+type JobManager struct {
+	Logger *logrus.Logger
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+func NewJobManager(logger *logrus.Logger) *JobManager {
+	return &JobManager{
+		Logger: logger,
+		jobs:   make(map[string]*Job),
+	}
+}
+
+// Run runs fn as a new job, returning once it has completed
+func (m *JobManager) Run(ctx context.Context, fn string, run func(job *Job) (any, error)) (ret any, err error) {
+	job := m.start(ctx, fn)
+	defer func() {
+		if rec := recover(); rec != nil {
+			job.finish(nil, NewRpcError(shared.RPC_ERR_INTERNAL, "%v", rec))
+			panic(rec)
+		}
+		job.finish(ret, err)
+		m.Logger.Debugln("Job", job.ID, fn, job.Info(false).Status)
+	}()
+	return run(job)
+}
+
+// RunJob runs a long-running RPC as a job. The job ID is sent back at once and the result of
+// the handler is kept for jobstatus; with legacy replies, the result is sent back as before.
+func (m *JobManager) RunJob(req *RpcRequest, run func(job *Job) (any, error)) (any, error) {
+	return m.Run(req.Context(), req.Func, func(job *Job) (any, error) {
+		if !req.legacy {
+			if err := req.Respond(shared.JobRef{ID: job.ID}); err != nil {
+				req.Logger.Errorln("RPC", req.Func, "unable to respond:", err)
+			}
+		}
+		return run(job)
+	})
+}
+
+// Get returns a running or recently finished job
+func (m *JobManager) Get(id string) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, NewRpcError(shared.RPC_ERR_NOT_FOUND, "job not found: %s", id)
+	}
+	return job, nil
+}
+
+// List returns the running and recently finished jobs, oldest first
+func (m *JobManager) List() []shared.JobInfo {
+	m.mu.Lock()
+	jobs := make([]*Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobs = append(jobs, job)
+	}
+	m.mu.Unlock()
+
+	ret := make([]shared.JobInfo, 0, len(jobs))
+	for _, job := range jobs {
+		ret = append(ret, job.Info(false))
+	}
+	sort.Slice(ret, func(a, b int) bool { return ret[a].Started.Before(ret[b].Started) })
+	return ret
+}
+
+// start registers a new running job
+func (m *JobManager) start(ctx context.Context, fn string) *Job {
+	job := &Job{
+		ID:      ulid.Make().String(),
+		Func:    fn,
+		status:  shared.JOB_STATUS_RUNNING,
+		started: time.Now(),
+		pids:    make(map[int32]bool),
+	}
+	job.ctx, job.cancel = context.WithCancel(context.WithValue(ctx, jobContextKey{}, job))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune()
+	m.jobs[job.ID] = job
+	m.Logger.Debugln("Job", job.ID, fn, "started")
+	return job
+}
+
+// prune removes the jobs which finished more than JOB_RETENTION ago, and the oldest
+// finished jobs beyond JOB_MAX_FINISHED
+func (m *JobManager) prune() {
+	// the finish times are read once, under the lock of each job
+	type finishedJob struct {
+		id  string
+		end time.Time
+	}
+	var finished []finishedJob
+	for id, job := range m.jobs {
+		job.mu.Lock()
+		end := job.finished
+		job.mu.Unlock()
+
+		switch {
+		case end.IsZero():
+		case time.Since(end) > JOB_RETENTION:
+			delete(m.jobs, id)
+		default:
+			finished = append(finished, finishedJob{id: id, end: end})
+		}
+	}
+
+	if len(finished) < JOB_MAX_FINISHED {
+		return
+	}
+	sort.Slice(finished, func(a, b int) bool { return finished[a].end.Before(finished[b].end) })
+	for _, job := range finished[:len(finished)-JOB_MAX_FINISHED+1] {
+		delete(m.jobs, job.id)
+	}
+}
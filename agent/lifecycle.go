@@ -0,0 +1,173 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Shutdown timeouts
+const (
+	AGENT_SHUTDOWN_GRACE = 30 * time.Second // Time given to in-flight RPC handlers and checks
+	AGENT_CANCEL_TIMEOUT = 5 * time.Second  // Time given to cancelled work to kill its scripts and return
+	NATS_DRAIN_TIMEOUT   = 10 * time.Second // Time given to flush pending messages
+)
+
+// lifecycle is the state shared by the agent service goroutines, cancelled by Stop
+type lifecycle struct {
+	once     sync.Once
+	ctx      context.Context
+	cancel   context.CancelFunc
+	inflight sync.WaitGroup
+
+	mu       sync.Mutex
+	nc       *nats.Conn
+	drainRpc func()
+}
+
+func (l *lifecycle) init() {
+	l.once.Do(func() {
+		l.ctx, l.cancel = context.WithCancel(context.Background())
+	})
+}
+
+// Context returns the agent's root context, cancelled when the service stops
+func (a *Agent) Context() context.Context {
+	a.init()
+	return a.ctx
+}
+
+// Stopping reports whether the service is stopping
+func (a *Agent) Stopping() bool {
+	return a.Context().Err() != nil
+}
+
+// Track registers in-flight work which Stop waits for; call the returned function when it completes
+func (a *Agent) Track() (done func()) {
+	a.init()
+	a.inflight.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(a.inflight.Done)
+	}
+}
+
+// Connect connects the service to the NATS server; the connection is drained by Stop
+func (a *Agent) Connect() (*nats.Conn, error) {
+	opts, err := a.SetupNatsOptions()
+	if err != nil {
+		return nil, err
+	}
+	server := fmt.Sprintf("tls://%s:%d", a.ApiURL, a.ApiPort)
+	nc, err := nats.Connect(server, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	a.nc = nc
+	a.mu.Unlock()
+	return nc, nil
+}
+
+// conn returns the service's NATS connection, or nil before Connect
+func (a *Agent) conn() *nats.Conn {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.nc
+}
+
+// Shutdown stops accepting RPC requests and starting checks, gives in-flight handlers and checks
+// the grace period to complete, then cancels the root context, killing the scripts still running,
+// and drains NATS
+func (a *Agent) Shutdown(grace time.Duration) {
+	a.init()
+
+	a.mu.Lock()
+	nc, drainRpc := a.nc, a.drainRpc
+	a.drainRpc = nil
+	a.mu.Unlock()
+
+	if drainRpc != nil {
+		drainRpc()
+	}
+	// no check is tracked once stopped, so none is added while waiting
+	if a.Checks != nil {
+		a.Checks.Stop()
+	}
+
+	if !a.waitInflight(grace) {
+		a.Logger.Warnf("Shutdown: work still running after %s, cancelling", grace)
+		a.cancel()
+		if !a.waitInflight(AGENT_CANCEL_TIMEOUT) {
+			a.Logger.Warnln("Shutdown: cancelled work did not return")
+		}
+	}
+	a.cancel()
+
+	if nc == nil || nc.IsClosed() {
+		return
+	}
+	closed := make(chan struct{})
+	nc.SetClosedHandler(func(*nats.Conn) { close(closed) })
+	if err := nc.Drain(); err != nil {
+		a.Logger.Debugln("Shutdown: NATS drain:", err)
+		nc.Close()
+		return
+	}
+	select {
+	case <-closed:
+	case <-time.After(NATS_DRAIN_TIMEOUT):
+		a.Logger.Debugln("Shutdown: NATS drain timed out")
+		nc.Close()
+	}
+}
+
+// waitInflight waits for the running checks and RPC handlers, returning false if some are still running after d
+func (a *Agent) waitInflight(d time.Duration) bool {
+	deadline := time.Now().Add(d)
+	if !waitTimeout(&a.inflight, d) {
+		return false
+	}
+	return a.Rpc == nil || a.Rpc.Wait(time.Until(deadline))
+}
+
+// setDrainRpc sets how to stop receiving RPC requests on shutdown
+func (a *Agent) setDrainRpc(drain func()) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.drainRpc = drain
+}
+
+// waitTimeout waits for wg, returning false if it is still not done after d
+func waitTimeout(wg *sync.WaitGroup, d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// SleepContext pauses for d, returning false if ctx is done first
+func SleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -1 +1,349 @@
 package linux
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/jetrmm/rmm-agent/agent"
+	jrmm "github.com/jetrmm/rmm-shared"
+	"github.com/kardianos/service"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/host"
+	"github.com/sirupsen/logrus"
+)
+
+type linuxAgent struct {
+	agent.Agent
+}
+
+func NewAgent(logger *logrus.Logger, version string, isAdmin bool) agent.IAgent {
+	la := &linuxAgent{
+		Agent: agent.Agent{
+			Logger: logger,
+		},
+	}
+	la.IAgent = la
+
+	sealer, err := agent.NewSecretSealer(os.Getenv(ENV_SECRET_SEALER), keyPath())
+	if err != nil {
+		logger.Errorln(err)
+		sealer = agent.NewMachineKeySealer(keyPath())
+	}
+
+	store := agent.NewEnvConfigStore(agent.NewFileConfigStore(configPath(), sealer))
+	if !isAdmin {
+		// the configuration file is only readable by root
+		store = agent.NewEnvConfigStore(nil)
+	}
+	if err := la.LoadConfig(store, version); err != nil {
+		fmt.Println("Unable to read the agent configuration (agent not installed?)", err)
+		logger.Debugln("Unable to read the agent configuration (agent not installed?)")
+	}
+
+	la.registerRpcHandlers()
+	la.registerChecks()
+	if isAdmin {
+		la.SetupDataDir(dataDir())
+	}
+	return la
+}
+
+func configDir() string {
+	if dir := os.Getenv(ENV_CONFIG_DIR); len(dir) > 0 {
+		return dir
+	}
+	return AGENT_CONFIG_DIR
+}
+
+func dataDir() string {
+	if dir := os.Getenv(ENV_DATA_DIR); len(dir) > 0 {
+		return dir
+	}
+	return AGENT_DATA_DIR
+}
+
+func configPath() string {
+	return filepath.Join(configDir(), AGENT_CONFIG_FILE)
+}
+
+func keyPath() string {
+	return filepath.Join(configDir(), AGENT_KEY_FILE)
+}
+
+// GetStorage returns a list of physical, non-removable file systems
+func (a *linuxAgent) GetStorage() []jrmm.StorageDrive {
+	ret := make([]jrmm.StorageDrive, 0)
+	partitions, err := disk.Partitions(false)
+	if err != nil {
+		a.Logger.Debugln(err)
+		return ret
+	}
+
+	for _, p := range partitions {
+		// skip snap/squashfs loop mounts
+		if strings.HasPrefix(p.Device, "/dev/loop") {
+			continue
+		}
+
+		usage, err := disk.Usage(p.Mountpoint)
+		if err != nil {
+			a.Logger.Debugln(err)
+			continue
+		}
+
+		d := jrmm.StorageDrive{
+			Device:  p.Mountpoint,
+			Fstype:  p.Fstype,
+			Total:   strconv.FormatUint(usage.Total, 10),
+			Used:    strconv.FormatUint(usage.Used, 10),
+			Free:    strconv.FormatUint(usage.Free, 10),
+			Percent: int(usage.UsedPercent),
+		}
+		ret = append(ret, d)
+	}
+	return ret
+}
+
+// LoggedOnUser returns the first logged on user it finds
+func (a *linuxAgent) LoggedOnUser() string {
+	users, err := host.Users()
+	if err != nil {
+		a.Logger.Debugln("LoggedOnUser error", err)
+		return "None"
+	}
+
+	for _, u := range users {
+		if u.User != "" {
+			return u.User
+		}
+	}
+	return "None"
+}
+
+// GetCPULoadAvg Retrieve CPU load average
+func (a *linuxAgent) GetCPULoadAvg() int {
+	percent, err := cpu.Percent(10*time.Second, false)
+	if err != nil {
+		a.Logger.Debugln("Go CPU Check:", err)
+		return 0
+	}
+	return int(math.Round(percent[0]))
+}
+
+// SystemRebootRequired checks whether a system reboot is required
+func (a *linuxAgent) SystemRebootRequired() bool {
+	return agent.FileExists(REBOOT_REQUIRED_FILE)
+}
+
+// SysInfo Retrieves (and sends) system information
+func (a *linuxAgent) SysInfo() {
+	info := make(map[string]interface{})
+
+	hostInfo, err := host.Info()
+	if err != nil {
+		a.Logger.Debugln(err)
+	}
+
+	cpuInfo, err := cpu.Info()
+	if err != nil {
+		a.Logger.Debugln(err)
+	}
+
+	partitions, err := disk.Partitions(false)
+	if err != nil {
+		a.Logger.Debugln(err)
+	}
+
+	info["host"] = hostInfo
+	info["cpu"] = cpuInfo
+	info["disk"] = partitions
+	info["total_ram"] = a.TotalRAM()
+
+	payload := map[string]interface{}{
+		"agent_id": a.AgentID,
+		"sysinfo":  info,
+	}
+
+	_, rerr := a.RClient.R().SetBody(payload).Patch(agent.API_URL_SYSINFO)
+	if rerr != nil {
+		a.Logger.Debugln(rerr)
+	}
+}
+
+func (a *linuxAgent) SyncInfo() {
+	a.SysInfo()
+	time.Sleep(1 * time.Second)
+	a.SendSoftware()
+}
+
+// SendSoftware Send list of installed software
+func (a *linuxAgent) SendSoftware() {
+	sw := a.GetInstalledSoftware()
+	a.Logger.Debugln(sw)
+
+	payload := map[string]interface{}{
+		"agent_id": a.AgentID,
+		"software": sw,
+	}
+
+	_, err := a.RClient.R().SetBody(payload).Post(agent.API_URL_SOFTWARE)
+	if err != nil {
+		a.Logger.Debugln(err)
+	}
+}
+
+// RecoverAgent Recover the Agent
+func (a *linuxAgent) RecoverAgent() {
+	a.Logger.Debugln("Attempting ", agent.AGENT_NAME_LONG, " recovery on", a.GetHostname())
+	_, _ = runExe("systemctl", []string{"restart", SERVICE_NAME_AGENT}, 90)
+	a.Logger.Debugln(agent.AGENT_NAME_LONG, " recovery completed on", a.GetHostname())
+}
+
+// RecoverCMD runs a shell recovery command, detached from the agent's process group
+func (a *linuxAgent) RecoverCMD(command string) {
+	a.Logger.Infoln("Attempting shell recovery with command:", command)
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.SysProcAttr = detachedProcAttr()
+	cmd.Start()
+}
+
+// ShowStatus prints the agent service status
+func (a *linuxAgent) ShowStatus(version string) {
+	status := "Not Installed"
+	s, err := service.New(a, a.GetServiceConfig())
+	if err == nil {
+		if st, err := s.Status(); err == nil {
+			switch st {
+			case service.StatusRunning:
+				status = "Running"
+			case service.StatusStopped:
+				status = "Stopped"
+			}
+		}
+	}
+
+	fmt.Println("Agent Version", version)
+	fmt.Println("Agent Service:", status)
+}
+
+// AgentUpdate downloads a new agent binary, replaces the current executable and restarts the service
+func (a *linuxAgent) AgentUpdate(url, inno, version string) {
+	exe, err := os.Executable()
+	if err != nil {
+		a.Logger.Errorln(err)
+		return
+	}
+
+	a.Logger.Infof("Agent updating from %s to %s", a.Version, version)
+	a.Logger.Infoln("Downloading agent update from", url)
+
+	updater := filepath.Join(filepath.Dir(exe), fmt.Sprintf(".%s-%s", AGENT_FILENAME, version))
+
+	rClient := resty.New()
+	rClient.SetCloseConnection(true)
+	rClient.SetTimeout(15 * time.Minute)
+	rClient.SetDebug(a.Debug)
+	r, err := rClient.R().SetOutput(updater).Get(url)
+	if err != nil {
+		a.Logger.Errorln(err)
+		return
+	}
+	if r.IsError() {
+		a.Logger.Errorln("Download failed with status code", r.StatusCode())
+		os.Remove(updater)
+		return
+	}
+
+	if err := os.Chmod(updater, 0755); err != nil {
+		a.Logger.Errorln(err)
+		os.Remove(updater)
+		return
+	}
+
+	if err := os.Rename(updater, exe); err != nil {
+		a.Logger.Errorln("AgentUpdate unable to replace the agent binary:", err)
+		os.Remove(updater)
+		return
+	}
+
+	cmd := exec.Command("systemctl", "restart", SERVICE_NAME_AGENT)
+	cmd.SysProcAttr = detachedProcAttr()
+	cmd.Start()
+}
+
+// AgentUninstall removes the agent service and its configuration
+func (a *linuxAgent) AgentUninstall() {
+	s, err := service.New(a, a.GetServiceConfig())
+	if err == nil {
+		_ = s.Stop()
+		if err := s.Uninstall(); err != nil {
+			a.Logger.Errorln(err)
+		}
+	}
+	a.UninstallCleanup()
+}
+
+func (a *linuxAgent) UninstallCleanup() {
+	if err := a.Store.Delete(); err != nil {
+		a.Logger.Debugln(err)
+	}
+	if err := os.Remove(keyPath()); err != nil && !os.IsNotExist(err) {
+		a.Logger.Debugln(err)
+	}
+	a.CleanupTasks()
+}
+
+func (a *linuxAgent) GetServiceConfig() *service.Config {
+	exe, _ := os.Executable()
+	return &service.Config{
+		Name:        SERVICE_NAME_AGENT,
+		DisplayName: SERVICE_DISP_AGENT,
+		Description: SERVICE_DESC_AGENT,
+		Executable:  exe,
+		Arguments:   []string{"mode", "-m", AGENT_SVC},
+		Option: service.KeyValue{
+			"Restart": "always",
+		},
+	}
+}
+
+func (a *linuxAgent) RebootSystem() {
+	a.Logger.Debugln("Scheduling immediate reboot")
+	_, _ = runExe("shutdown", []string{"-r", "now"}, 15)
+}
+
+// runExe runs a binary without a shell
+func runExe(exe string, args []string, timeout int) (output [2]string, e error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	var outb, errb bytes.Buffer
+	cmd := exec.CommandContext(ctx, exe, args...)
+	// kill the children too, which would otherwise keep the output open
+	cmd.Cancel = func() error {
+		return agent.KillProc(int32(cmd.Process.Pid))
+	}
+	cmd.Stdout = &outb
+	cmd.Stderr = &errb
+	err := cmd.Run()
+	// a killed command fails too, so the timeout is checked first
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return [2]string{outb.String(), errb.String()}, fmt.Errorf("%s timed out after %d seconds: %w", exe, timeout, ctx.Err())
+	}
+	if err != nil {
+		return [2]string{outb.String(), errb.String()}, fmt.Errorf("%s: %s", err, errb.String())
+	}
+
+	return [2]string{outb.String(), errb.String()}, nil
+}
@@ -0,0 +1,23 @@
+package linux
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRunExe(t *testing.T) {
+	out, err := runExe("sh", []string{"-c", "echo out; echo err >&2"}, 10)
+	if err != nil || out != [2]string{"out\n", "err\n"} {
+		t.Errorf("got %q, %v", out, err)
+	}
+
+	if _, err := runExe("sh", []string{"-c", "exit 3"}, 10); err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("failed: got %v, want the exit status", err)
+	}
+
+	out, err = runExe("sh", []string{"-c", "echo started; sleep 10"}, 1)
+	if !errors.Is(err, context.DeadlineExceeded) || out[0] != "started\n" {
+		t.Errorf("timed out: got %q, %v, want the output so far and a timeout", out, err)
+	}
+}
@@ -0,0 +1,143 @@
+package linux
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/agent"
+	rmm "github.com/jetrmm/rmm-agent/shared"
+)
+
+// registerChecks registers the check types supported on Linux
+func (a *linuxAgent) registerChecks() {
+	a.Checks = agent.NewCheckScheduler(a.Context(), a.Logger, a.Track)
+	a.Checks.Register(agent.CHECK_TYPE_SCRIPT, a.ScriptCheck)
+	agent.RegisterCommonChecks(a.Checks, &a.Agent)
+}
+
+// RunScript writes the script to a temporary file and runs it with the given interpreter
+// (sh, bash, python3, perl, pwsh, ...)
+func (a *linuxAgent) RunScript(code string, interpreter string, args []string, timeout int) (stdout, stderr string, exitcode int, e error) {
+	return a.RunScriptContext(a.Context(), code, interpreter, args, timeout)
+}
+
+// RunScriptContext runs a script like RunScript, killing it along with its children if ctx is done
+func (a *linuxAgent) RunScriptContext(parent context.Context, code string, interpreter string, args []string, timeout int) (stdout, stderr string, exitcode int, e error) {
+	content := []byte(code)
+
+	dir := filepath.Join(os.TempDir(), agent.AGENT_TEMP_DIR)
+	if !agent.FileExists(dir) {
+		a.CreateAgentTempDir()
+	}
+
+	const defaultExitCode = 1
+
+	var (
+		outb bytes.Buffer
+		errb bytes.Buffer
+		exe  string
+	)
+
+	switch interpreter {
+	case "", "sh", "shell":
+		exe = "/bin/sh"
+	case "powershell":
+		exe = "pwsh"
+	default:
+		exe = interpreter
+	}
+
+	tmpfn, err := os.CreateTemp(dir, "script*")
+	if err != nil {
+		a.Logger.Errorln(err)
+		return "", err.Error(), 85, err
+	}
+	defer os.Remove(tmpfn.Name())
+
+	if _, err := tmpfn.Write(content); err != nil {
+		a.Logger.Errorln(err)
+		return "", err.Error(), 85, err
+	}
+	if err := tmpfn.Close(); err != nil {
+		a.Logger.Errorln(err)
+		return "", err.Error(), 85, err
+	}
+
+	cmdArgs := append([]string{tmpfn.Name()}, args...)
+
+	ctx, cancel := context.WithTimeout(parent, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	cmd := exec.Command(exe, cmdArgs...)
+	cmd.SysProcAttr = procGroupAttr()
+	cmd.Stdout, cmd.Stderr = agent.OutputWriters(parent, &outb, &errb)
+
+	if cmdErr := cmd.Start(); cmdErr != nil {
+		a.Logger.Debugln(cmdErr)
+		return "", cmdErr.Error(), 65, cmdErr
+	}
+	pid := int32(cmd.Process.Pid)
+	defer agent.AddJobProcess(parent, pid)()
+
+	// exec.CommandContext() only kills the parent process, so kill the whole tree ourselves,
+	// on timeout, when the job is cancelled or when the service stops
+	exited := make(chan struct{})
+	go func(p int32) {
+		select {
+		case <-ctx.Done():
+			_ = agent.KillProc(p)
+		case <-exited:
+		}
+	}(pid)
+
+	cmdErr := cmd.Wait()
+	close(exited)
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		stdout = outb.String()
+		stderr = fmt.Sprintf("%s\nScript timed out after %d seconds", errb.String(), timeout)
+		exitcode = 98
+		a.Logger.Debugln("Script check timeout:", ctx.Err())
+	} else if ctx.Err() != nil {
+		stdout = outb.String()
+		stderr = fmt.Sprintf("%s\nScript cancelled", errb.String())
+		exitcode = 99
+		a.Logger.Debugln("Script cancelled:", ctx.Err())
+	} else {
+		stdout = outb.String()
+		stderr = errb.String()
+
+		// get the exit code
+		var exitError *exec.ExitError
+		if cmdErr == nil {
+			exitcode = 0
+		} else if errors.As(cmdErr, &exitError) {
+			exitcode = exitError.ExitCode()
+		} else {
+			exitcode = defaultExitCode
+		}
+	}
+	return stdout, stderr, exitcode, nil
+}
+
+// ScriptCheck runs a script and sends the results back to the server
+func (a *linuxAgent) ScriptCheck(ctx context.Context, data rmm.Check) {
+	start := time.Now()
+	stdout, stderr, retcode, _ := a.RunScriptContext(ctx, data.Script.Code, data.Script.Interpreter, data.ScriptArgs, data.Timeout)
+
+	payload := map[string]interface{}{
+		"id":      data.CheckPK,
+		"stdout":  stdout,
+		"stderr":  stderr,
+		"retcode": retcode,
+		"runtime": time.Since(start).Seconds(),
+	}
+
+	a.ReportCheck(data, payload, "")
+}
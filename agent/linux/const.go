@@ -0,0 +1,30 @@
+package linux
+
+const (
+	AGENT_FILENAME = "rmmagent"
+
+	SERVICE_NAME_AGENT = "rmmagent"
+	SERVICE_DISP_AGENT = "RMM Agent Service"
+	SERVICE_DESC_AGENT = "RMM Agent Service"
+
+	AGENT_SVC = "agentsvc"
+
+	// Configuration
+	AGENT_CONFIG_DIR  = "/etc/rmm"
+	AGENT_CONFIG_FILE = "agent.json"
+	AGENT_KEY_FILE    = "agent.key"
+	AGENT_DATA_DIR    = "/var/lib/rmm" // Outbox, check state
+
+	// Selects the secret sealer backend (machineid, keyring or plain)
+	ENV_SECRET_SEALER = "RMM_SECRET_SEALER"
+	// Overrides AGENT_CONFIG_DIR, e.g. for tests
+	ENV_CONFIG_DIR = "RMM_CONFIG_DIR"
+	// Overrides AGENT_DATA_DIR
+	ENV_DATA_DIR = "RMM_DATA_DIR"
+
+	// Internal tasks are scheduled through cron
+	CRON_DIR = "/etc/cron.d"
+
+	// Debian/Ubuntu flag file for pending reboots
+	REBOOT_REQUIRED_FILE = "/var/run/reboot-required"
+)
@@ -0,0 +1,201 @@
+package linux
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/jetrmm/rmm-agent/agent"
+	"github.com/kardianos/service"
+	"github.com/nats-io/nats.go"
+)
+
+func (a *linuxAgent) Install(i *agent.InstallInfo, agentID string) {
+	if agent.FileExists(configPath()) {
+		fmt.Println("Existing installation found and must be removed before attempting to reinstall.")
+		a.installerMsg(fmt.Sprintf("Remove %s after uninstalling the %s service, and then re-run this installer.", configPath(), SERVICE_NAME_AGENT), "error")
+	}
+
+	i.Headers = map[string]string{
+		"Content-Type":  "application/json",
+		"Authorization": fmt.Sprintf("Token %s", i.Token),
+	}
+	a.AgentID = agentID
+	a.Logger.Debugln("Agent ID:", a.AgentID)
+
+	parsedUrl, err := url.Parse(i.ServerURL)
+	if err != nil {
+		a.installerMsg(err.Error(), "error")
+	}
+
+	if parsedUrl.Scheme != "https" && parsedUrl.Scheme != "http" {
+		a.installerMsg("Invalid URL: must begin with https or http", "error")
+	}
+
+	// strip the port, if any, to get the host for NATS
+	i.ApiURL = parsedUrl.Hostname()
+	a.Logger.Debugln("Agent API Endpoint:", i.ApiURL)
+
+	if i.NatsPort == 0 {
+		i.NatsPort = agent.NATS_DEFAULT_PORT
+	}
+	terr := agent.TestTCP(fmt.Sprintf("%s:%d", i.ApiURL, i.NatsPort))
+	if terr != nil {
+		a.installerMsg(fmt.Sprintf("ERROR: Either port %d TCP is not open on your RMM server, or the NATS service is not running.\n\n%s",
+			i.NatsPort, terr.Error()), "error")
+	}
+
+	baseURL := parsedUrl.Scheme + "://" + parsedUrl.Host
+	a.Logger.Debugln("Base URL:", baseURL)
+
+	iClient := resty.New()
+	iClient.SetCloseConnection(true)
+	iClient.SetTimeout(15 * time.Second)
+	iClient.SetDebug(a.Debug)
+	iClient.SetHeaders(i.Headers)
+
+	// Set local certificate if applicable
+	if len(i.RootCert) > 0 {
+		if !agent.FileExists(i.RootCert) {
+			a.installerMsg(fmt.Sprintf("%s does not exist", i.RootCert), "error")
+		}
+		iClient.SetRootCertificate(i.RootCert)
+	}
+
+	creds, cerr := iClient.R().Get(fmt.Sprintf("%s/api/v3/installer/", baseURL))
+	if cerr != nil {
+		a.installerMsg(cerr.Error(), "error")
+	}
+	if creds.StatusCode() == 401 {
+		a.installerMsg("Installer token has expired. Please generate a new one.", "error")
+	}
+
+	verPayload := map[string]string{"version": a.Version}
+
+	iVersion, ierr := iClient.R().SetBody(verPayload).Post(fmt.Sprintf("%s/api/v3/installer/", baseURL))
+	if ierr != nil {
+		a.installerMsg(ierr.Error(), "error")
+	}
+	if iVersion.StatusCode() != 200 {
+		a.installerMsg(iVersion.String(), "error")
+	}
+
+	if len(i.CredsFile) > 0 && !agent.FileExists(i.CredsFile) {
+		a.installerMsg(fmt.Sprintf("%s does not exist", i.CredsFile), "error")
+	}
+
+	a.Logger.Infoln("Adding agent to the dashboard")
+
+	type NewAgentResp struct {
+		AgentPK int    `json:"pk"`
+		Token   string `json:"token"`
+	}
+
+	agentPayload := map[string]interface{}{
+		"agent_id":    a.AgentID,
+		"hostname":    a.GetHostname(),
+		"client":      i.ClientID,
+		"site":        i.SiteID,
+		"description": i.Description,
+	}
+
+	// authenticate with NATS using a per-agent NKey unless JWT credentials were provided
+	var nkeySeed string
+	if len(i.CredsFile) == 0 {
+		seed, pub, err := agent.GenerateNKey()
+		if err != nil {
+			a.installerMsg(fmt.Sprintf("Unable to generate the agent NKey: %s", err), "error")
+		}
+		nkeySeed = seed
+		agentPayload["nkey"] = pub
+	}
+
+	iClient.SetTimeout(i.Timeout * time.Second)
+	r, err := iClient.R().SetBody(agentPayload).SetResult(&NewAgentResp{}).Post(fmt.Sprintf("%s/api/v3/newagent/", baseURL))
+	if err != nil {
+		a.installerMsg(err.Error(), "error")
+	}
+	if r.StatusCode() != 200 {
+		a.installerMsg(r.String(), "error")
+	}
+
+	agentPK := r.Result().(*NewAgentResp).AgentPK
+	authToken := r.Result().(*NewAgentResp).Token
+
+	a.Logger.Debugln("Agent PK:", agentPK)
+
+	err = a.Store.Save(&agent.AgentConfig{
+		AgentID:   a.AgentID,
+		AgentPK:   agentPK,
+		BaseURL:   baseURL,
+		ApiURL:    i.ApiURL,
+		ApiPort:   i.NatsPort,
+		Token:     authToken,
+		Cert:      i.RootCert,
+		NKeySeed:  nkeySeed,
+		CredsFile: i.CredsFile,
+	})
+	if err != nil {
+		a.installerMsg(fmt.Sprintf("Unable to save the agent configuration: %s", err), "error")
+	}
+
+	// Refresh our agent with new values
+	if err := a.LoadConfig(a.Store, a.Version); err != nil {
+		a.installerMsg(fmt.Sprintf("Unable to read the agent configuration: %s", err), "error")
+	}
+
+	a.Logger.Debugln("Getting system information")
+	a.SysInfo()
+
+	// Check in once via NATS
+	server := fmt.Sprintf("tls://%s:%d", a.ApiURL, a.ApiPort)
+	var nc *nats.Conn
+	opts, err := a.SetupNatsOptions()
+	if err == nil {
+		nc, err = nats.Connect(server, opts...)
+	}
+	if err != nil {
+		a.Logger.Errorln(err)
+	} else {
+		startup := []string{agent.CHECKIN_MODE_HELLO, agent.CHECKIN_MODE_OSINFO, agent.CHECKIN_MODE_DISKS, agent.CHECKIN_MODE_PUBLICIP, agent.CHECKIN_MODE_SOFTWARE, agent.CHECKIN_MODE_LOGGEDONUSER}
+		for _, mode := range startup {
+			a.CheckIn(nc, mode)
+			time.Sleep(200 * time.Millisecond)
+		}
+		nc.Close()
+	}
+
+	a.Logger.Debugln("Creating temporary directory")
+	a.CreateAgentTempDir()
+
+	if !i.NoService {
+		a.Logger.Infoln("Installing service...")
+		if err := a.InstallService(); err != nil {
+			a.installerMsg(fmt.Sprintf("Unable to install the agent service: %s", err), "error")
+		}
+	}
+
+	a.installerMsg("Installation was successful!\nPlease allow a few minutes for the agent to show up in the RMM server", "info")
+}
+
+// InstallService installs and starts the agent's systemd service
+func (a *linuxAgent) InstallService() error {
+	s, err := service.New(a, a.GetServiceConfig())
+	if err != nil {
+		return err
+	}
+
+	if err := s.Install(); err != nil {
+		return err
+	}
+	return s.Start()
+}
+
+func (a *linuxAgent) installerMsg(msg, alert string) {
+	fmt.Println(strings.TrimSpace(msg))
+	if alert == "error" {
+		a.Logger.Fatalln(msg)
+	}
+}
@@ -0,0 +1,88 @@
+package linux
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// Supported package managers
+const (
+	PKG_MGR_APT = "apt"
+	PKG_MGR_DNF = "dnf"
+	PKG_MGR_YUM = "yum"
+)
+
+// InstallPkgMgr is a no-op on Linux; the distribution's package manager is always present
+func (a *linuxAgent) InstallPkgMgr(pkgMgr string) {
+	a.Logger.Debugln("Package manager installation not required on Linux:", pkgMgr)
+}
+
+func (a *linuxAgent) RemovePkgMgr(pkgMgr string) {
+
+}
+
+func (a *linuxAgent) InstallPackage(pkgMgr string, pkgName string) (string, error) {
+	switch a.pkgMgr(pkgMgr) {
+	case PKG_MGR_APT:
+		return a.runPkgMgr("apt-get", "install", "-y", pkgName)
+	case PKG_MGR_DNF, PKG_MGR_YUM:
+		return a.runPkgMgr(a.pkgMgr(pkgMgr), "install", "-y", pkgName)
+	}
+	return "", fmt.Errorf("unsupported package manager: %s", pkgMgr)
+}
+
+func (a *linuxAgent) RemovePackage(pkgMgr string, pkgName string) (string, error) {
+	switch a.pkgMgr(pkgMgr) {
+	case PKG_MGR_APT:
+		return a.runPkgMgr("apt-get", "remove", "-y", pkgName)
+	case PKG_MGR_DNF, PKG_MGR_YUM:
+		return a.runPkgMgr(a.pkgMgr(pkgMgr), "remove", "-y", pkgName)
+	}
+	return "", fmt.Errorf("unsupported package manager: %s", pkgMgr)
+}
+
+func (a *linuxAgent) UpdatePackage(pkgMgr string, pkgName string) (string, error) {
+	switch a.pkgMgr(pkgMgr) {
+	case PKG_MGR_APT:
+		return a.runPkgMgr("apt-get", "install", "--only-upgrade", "-y", pkgName)
+	case PKG_MGR_DNF, PKG_MGR_YUM:
+		return a.runPkgMgr(a.pkgMgr(pkgMgr), "upgrade", "-y", pkgName)
+	}
+	return "", fmt.Errorf("unsupported package manager: %s", pkgMgr)
+}
+
+// PkgManagers returns the package managers installed on the system
+func (a *linuxAgent) PkgManagers() []string {
+	ret := make([]string, 0)
+	for _, mgr := range []string{PKG_MGR_APT, PKG_MGR_DNF, PKG_MGR_YUM} {
+		if _, err := exec.LookPath(mgr); err == nil {
+			ret = append(ret, mgr)
+		}
+	}
+	return ret
+}
+
+// pkgMgr returns the requested package manager, or detects the system's one if empty
+func (a *linuxAgent) pkgMgr(pkgMgr string) string {
+	if pkgMgr != "" {
+		return pkgMgr
+	}
+	for _, mgr := range []string{PKG_MGR_APT, PKG_MGR_DNF, PKG_MGR_YUM} {
+		if _, err := exec.LookPath(mgr); err == nil {
+			return mgr
+		}
+	}
+	return ""
+}
+
+func (a *linuxAgent) runPkgMgr(exe string, args ...string) (string, error) {
+	out, err := runExe(exe, args, 1200)
+	if err != nil {
+		a.Logger.Errorln(err)
+		return err.Error(), err
+	}
+	if out[1] != "" {
+		return out[1], nil
+	}
+	return out[0], nil
+}
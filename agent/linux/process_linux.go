@@ -0,0 +1,55 @@
+package linux
+
+import (
+	"fmt"
+
+	gops "github.com/shirou/gopsutil/v3/process"
+)
+
+type ProcessMsg struct {
+	Name     string `json:"name"`
+	Pid      int    `json:"pid"`
+	MemBytes uint64 `json:"membytes"`
+	Username string `json:"username"`
+	UID      int    `json:"id"`
+	CPU      string `json:"cpu_percent"`
+}
+
+func (a *linuxAgent) GetRunningProcesses() []ProcessMsg {
+	ret := make([]ProcessMsg, 0)
+
+	procs, err := gops.Processes()
+	if err != nil {
+		a.Logger.Debugln(err)
+		return ret
+	}
+
+	for _, p := range procs {
+		name, err := p.Name()
+		if err != nil {
+			continue
+		}
+
+		var rss uint64
+		if m, err := p.MemoryInfo(); err == nil {
+			rss = m.RSS
+		}
+		cpu, _ := p.CPUPercent()
+		user, _ := p.Username()
+		// real, effective, saved and filesystem UIDs
+		uid := -1
+		if uids, err := p.Uids(); err == nil && len(uids) > 0 {
+			uid = int(uids[0])
+		}
+
+		ret = append(ret, ProcessMsg{
+			Name:     name,
+			Pid:      int(p.Pid),
+			MemBytes: rss,
+			Username: user,
+			UID:      uid,
+			CPU:      fmt.Sprintf("%.1f", cpu),
+		})
+	}
+	return ret
+}
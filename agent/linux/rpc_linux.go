@@ -0,0 +1,135 @@
+package linux
+
+import (
+	"os"
+	"time"
+
+	. "github.com/jetrmm/rmm-agent/agent"
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+type NatsMsg struct {
+	shared.RpcPayload
+	RecoveryCommand string `json:"recoverycommand"`
+}
+
+// RunService handles incoming RPC (NATS) payloads from server and dispatches tasks
+func (a *linuxAgent) RunService() {
+	a.Logger.Infoln("Agent service started")
+	nc, err := a.Connect()
+	if err != nil {
+		a.Logger.Fatalln(err)
+	}
+
+	go a.RunAgentService(nc)
+	go a.Outbox.Run(a.Context())
+
+	if err := a.SubscribeRpc(nc); err != nil {
+		a.Logger.Fatalln(err)
+	}
+
+	nc.Flush()
+
+	if err := nc.LastError(); err != nil {
+		a.Logger.Errorln(err)
+		os.Exit(1)
+	}
+
+	<-a.Context().Done()
+}
+
+// registerRpcHandlers registers the RPC functions supported on Linux
+func (a *linuxAgent) registerRpcHandlers() {
+	a.Rpc = NewRpcRegistry(a.Logger)
+	a.Rpc.LegacyReplies = a.LegacyReplies
+	a.Rpc.Compression = a.Compression
+	a.Rpc.Context = a.Context()
+	a.Jobs = NewJobManager(a.Logger)
+	RegisterCommonRpcHandlers(a.Rpc, a, a.Jobs)
+
+	a.Rpc.Register(NATS_CMD_PROCS_LIST, a.rpcProcsList)
+	a.Rpc.Register(NATS_CMD_RAWCMD, a.rpcRawCmd)
+	a.Rpc.Register(NATS_CMD_REBOOT_NEEDED, a.rpcRebootNeeded)
+	a.Rpc.Register(NATS_CMD_SYSINFO, a.rpcSysInfo)
+	a.Rpc.Register(NATS_CMD_RUNCHECKS, a.rpcRunChecks)
+	a.Rpc.Register("recoverycmd", TypedHandler(a.rpcRecoveryCmd))
+	a.Rpc.Register(NATS_CMD_AGENT_UPDATE, a.rpcAgentUpdate)
+	a.Rpc.Register(NATS_CMD_AGENT_UNINSTALL, a.rpcAgentUninstall)
+
+	a.SetupRpcLimits(map[string]int{
+		NATS_CMD_AGENT_UPDATE: 1,
+	})
+	// a second request is rejected while one is running, rather than run after it
+	a.Rpc.NoQueue(NATS_CMD_AGENT_UPDATE)
+}
+
+func (a *linuxAgent) rpcProcsList(req *RpcRequest) (any, error) {
+	return a.GetRunningProcesses(), nil
+}
+
+func (a *linuxAgent) rpcRawCmd(req *RpcRequest) (any, error) {
+	shell := req.Data["shell"]
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	out, _ := runExe(shell, []string{"-c", req.Data["command"]}, req.Timeout)
+	if out[1] != "" {
+		return out[1], nil
+	}
+	return out[0], nil
+}
+
+func (a *linuxAgent) rpcRebootNeeded(req *RpcRequest) (any, error) {
+	return a.SystemRebootRequired(), nil
+}
+
+func (a *linuxAgent) rpcSysInfo(req *RpcRequest) (any, error) {
+	modes := []string{CHECKIN_MODE_OSINFO, CHECKIN_MODE_PUBLICIP, CHECKIN_MODE_DISKS}
+	for _, mode := range modes {
+		a.CheckIn(req.Conn, mode)
+		time.Sleep(200 * time.Millisecond)
+	}
+	a.SysInfo()
+	return "ok", nil
+}
+
+func (a *linuxAgent) rpcRunChecks(req *RpcRequest) (any, error) {
+	if a.ChecksRunning() {
+		a.Logger.Debugln("Checks are already running, please wait")
+		return nil, NewRpcError(shared.RPC_ERR_BUSY, "busy")
+	}
+
+	_ = req.Respond("ok")
+	a.Logger.Debugln("Running checks")
+	if err := a.RunChecks(true); err != nil {
+		a.Logger.Errorln("RPC RunChecks", err)
+	}
+	return nil, nil
+}
+
+func (a *linuxAgent) rpcRecoveryCmd(req *RpcRequest, p *NatsMsg) (any, error) {
+	_ = req.Respond("ok")
+	_ = req.Ack()
+	a.RecoverCMD(p.RecoveryCommand)
+	return nil, nil
+}
+
+func (a *linuxAgent) rpcAgentUpdate(req *RpcRequest) (any, error) {
+	return a.Jobs.RunJob(req, func(job *Job) (any, error) {
+		job.DisableCancel()
+		_ = req.Respond("ok") // legacy replies
+		_ = req.Ack()
+		a.AgentUpdate(req.Data["url"], req.Data["inno"], req.Data["version"])
+		return nil, nil
+	})
+}
+
+func (a *linuxAgent) rpcAgentUninstall(req *RpcRequest) (any, error) {
+	_ = req.Respond("ok")
+	_ = req.Ack()
+	a.AgentUninstall()
+	req.Conn.Flush()
+	req.Conn.Close()
+	os.Exit(0)
+	return nil, nil
+}
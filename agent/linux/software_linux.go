@@ -0,0 +1,63 @@
+package linux
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+
+	jrmm "github.com/jetrmm/rmm-shared"
+)
+
+// GetInstalledSoftware returns the packages installed through dpkg or rpm
+func (a *linuxAgent) GetInstalledSoftware() []jrmm.Software {
+	ret := make([]jrmm.Software, 0)
+
+	var (
+		out    [2]string
+		err    error
+		source string
+	)
+
+	if _, lerr := exec.LookPath("dpkg-query"); lerr == nil {
+		source = "dpkg"
+		out, err = runExe("dpkg-query", []string{"-W", "-f", `${Package}\t${Version}\t${Maintainer}\t${Installed-Size}\n`}, 60)
+	} else if _, lerr := exec.LookPath("rpm"); lerr == nil {
+		source = "rpm"
+		out, err = runExe("rpm", []string{"-qa", "--queryformat", `%{NAME}\t%{VERSION}-%{RELEASE}\t%{VENDOR}\t%{SIZE}\t%{INSTALLTIME}\n`}, 60)
+	} else {
+		a.Logger.Debugln("No supported package database found")
+		return ret
+	}
+
+	if err != nil {
+		a.Logger.Debugln(err)
+		return ret
+	}
+
+	for _, line := range strings.Split(out[0], "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 4 || fields[0] == "" {
+			continue
+		}
+
+		sw := jrmm.Software{
+			Name:      fields[0],
+			Version:   fields[1],
+			Publisher: fields[2],
+			Source:    source,
+		}
+
+		size, _ := strconv.ParseUint(fields[3], 10, 64)
+		if source == "dpkg" {
+			// Installed-Size is in KiB
+			size *= 1024
+		}
+		sw.Size = strconv.FormatUint(size, 10)
+
+		if len(fields) > 4 {
+			sw.InstallDate = fields[4]
+		}
+		ret = append(ret, sw)
+	}
+	return ret
+}
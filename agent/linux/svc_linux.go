@@ -0,0 +1,190 @@
+package linux
+
+import (
+	"math/rand"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/agent"
+	rmm "github.com/jetrmm/rmm-agent/shared"
+	jrmm "github.com/jetrmm/rmm-shared"
+	"github.com/nats-io/nats.go"
+)
+
+func (a *linuxAgent) RunAgentService(nc *nats.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		a.linuxAgentSvc(nc)
+	}()
+	go func() {
+		defer wg.Done()
+		a.CheckRunner()
+	}()
+	wg.Wait()
+}
+
+func (a *linuxAgent) linuxAgentSvc(nc *nats.Conn) {
+	a.Logger.Infoln("Agent service started")
+
+	a.CreateAgentTempDir()
+
+	ctx := a.Context()
+	sleepDelay := randRange(14, 22)
+	a.Logger.Debugf("Sleeping for %v seconds", sleepDelay)
+	if !agent.SleepContext(ctx, time.Duration(sleepDelay)*time.Second) {
+		return
+	}
+
+	startup := []string{agent.CHECKIN_MODE_HELLO, agent.CHECKIN_MODE_OSINFO, agent.CHECKIN_MODE_DISKS, agent.CHECKIN_MODE_PUBLICIP, agent.CHECKIN_MODE_SOFTWARE, agent.CHECKIN_MODE_LOGGEDONUSER}
+	for _, s := range startup {
+		a.CheckIn(nc, s)
+		if !agent.SleepContext(ctx, time.Duration(randRange(300, 900))*time.Millisecond) {
+			return
+		}
+	}
+
+	if !agent.SleepContext(ctx, time.Duration(randRange(2, 7))*time.Second) {
+		return
+	}
+	a.CheckIn(nc, agent.CHECKIN_MODE_STARTUP)
+
+	checkInTicker := time.NewTicker(time.Duration(randRange(40, 110)) * time.Second)
+	defer checkInTicker.Stop()
+	checkInOSTicker := time.NewTicker(time.Duration(randRange(250, 450)) * time.Second)
+	defer checkInOSTicker.Stop()
+	checkInPubIPTicker := time.NewTicker(time.Duration(randRange(300, 500)) * time.Second)
+	defer checkInPubIPTicker.Stop()
+	checkInDisksTicker := time.NewTicker(time.Duration(randRange(200, 600)) * time.Second)
+	defer checkInDisksTicker.Stop()
+	checkInLoggedUserTicker := time.NewTicker(time.Duration(randRange(850, 1400)) * time.Second)
+	defer checkInLoggedUserTicker.Stop()
+	checkInSWTicker := time.NewTicker(time.Duration(randRange(2400, 3000)) * time.Second)
+	defer checkInSWTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-checkInTicker.C:
+			a.CheckIn(nc, agent.CHECKIN_MODE_HELLO)
+		case <-checkInOSTicker.C:
+			a.CheckIn(nc, agent.CHECKIN_MODE_OSINFO)
+		case <-checkInPubIPTicker.C:
+			a.CheckIn(nc, agent.CHECKIN_MODE_PUBLICIP)
+		case <-checkInDisksTicker.C:
+			a.CheckIn(nc, agent.CHECKIN_MODE_DISKS)
+		case <-checkInLoggedUserTicker.C:
+			a.CheckIn(nc, agent.CHECKIN_MODE_LOGGEDONUSER)
+		case <-checkInSWTicker.C:
+			a.CheckIn(nc, agent.CHECKIN_MODE_SOFTWARE)
+		}
+	}
+}
+
+// CheckIn Check in with the server
+func (a *linuxAgent) CheckIn(nc *nats.Conn, mode string) {
+	var rerr error
+	var payload interface{}
+	var nMode string
+
+	// Outgoing payload to server
+	switch mode {
+	case agent.CHECKIN_MODE_HELLO:
+		nMode = agent.NATS_MODE_HELLO
+		payload = rmm.CheckInHello{
+			AgentId:           a.AgentID,
+			Version:           a.Version,
+			AgentCapabilities: a.Capabilities(),
+		}
+
+	case agent.CHECKIN_MODE_STARTUP:
+		payload = rmm.CheckInStartup{
+			AgentHeader: rmm.AgentHeader{
+				Func:    "startup",
+				AgentId: a.AgentID,
+				Version: a.Version,
+			},
+			AgentCapabilities: a.Capabilities(),
+		}
+
+	case agent.CHECKIN_MODE_OSINFO:
+		plat, osInfo := a.OSInfo()
+
+		nMode = agent.NATS_MODE_OSINFO
+		payload = jrmm.AgentInfoNats{
+			AgentId:      a.AgentID,
+			Username:     a.LoggedOnUser(),
+			Hostname:     a.GetHostname(),
+			OS:           osInfo,
+			Platform:     plat,
+			TotalRAM:     a.TotalRAM(),
+			BootTime:     a.BootTime(),
+			RebootNeeded: a.SystemRebootRequired(),
+			GoArch:       runtime.GOARCH,
+		}
+
+	case agent.CHECKIN_MODE_PUBLICIP:
+		nMode = agent.NATS_MODE_PUBLICIP
+		payload = jrmm.PublicIPNats{
+			AgentId:  a.AgentID,
+			PublicIP: a.PublicIP(),
+		}
+
+	case agent.CHECKIN_MODE_DISKS:
+		nMode = agent.NATS_MODE_DISKS
+		payload = jrmm.WinDisksNats{
+			AgentId: a.AgentID,
+			Drives:  a.GetStorage(),
+		}
+
+	case agent.CHECKIN_MODE_LOGGEDONUSER:
+		payload = rmm.CheckInLoggedUser{
+			AgentHeader: rmm.AgentHeader{
+				Func:    "loggedonuser",
+				AgentId: a.AgentID,
+				Version: a.Version,
+			},
+			Username: a.LoggedOnUser(),
+		}
+
+	case agent.CHECKIN_MODE_SOFTWARE:
+		payload = rmm.CheckInSW{
+			AgentHeader: rmm.AgentHeader{
+				Func:    "software",
+				AgentId: a.AgentID,
+				Version: a.Version,
+			},
+			InstalledSW: a.GetInstalledSoftware(),
+		}
+
+	default:
+		a.Logger.Debugln("Checkin mode not supported:", mode)
+		return
+	}
+
+	// Send via NATS
+	if len(nMode) > 0 {
+		if err := a.PublishCheckIn(nc, nMode, payload); err != nil {
+			a.Logger.Debugln("Checkin:", err)
+		}
+		return
+	}
+
+	// Send via JSON
+	if mode == agent.CHECKIN_MODE_STARTUP {
+		_, rerr = a.SendApi("checkin:"+mode, http.MethodPost, agent.API_URL_CHECKIN, payload, true)
+	} else {
+		_, rerr = a.SendApi("checkin:"+mode, http.MethodPut, agent.API_URL_CHECKIN, payload, true)
+	}
+	if rerr != nil {
+		a.Logger.Debugln("Checkin:", rerr)
+	}
+}
+
+func randRange(min, max int) int {
+	return rand.Intn(max-min) + min
+}
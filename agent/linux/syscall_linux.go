@@ -0,0 +1,13 @@
+package linux
+
+import "syscall"
+
+// detachedProcAttr starts a process in its own session so that it outlives the agent
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+// procGroupAttr starts a process in its own process group so that its children can be killed with it
+func procGroupAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
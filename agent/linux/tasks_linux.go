@@ -0,0 +1,110 @@
+package linux
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/agent"
+	rmm "github.com/jetrmm/rmm-agent/shared"
+)
+
+func (a *linuxAgent) RunTask(id int) error {
+	data := rmm.AutomatedTask{}
+	url := fmt.Sprintf("/api/v3/%d/%s/taskrunner/", id, a.AgentID)
+
+	r1, gerr := a.RClient.R().Get(url)
+	if gerr != nil {
+		a.Logger.Debugln(gerr)
+		return gerr
+	}
+
+	if r1.IsError() {
+		a.Logger.Debugln("Run Task:", r1.String())
+		return nil
+	}
+
+	if err := json.Unmarshal(r1.Body(), &data); err != nil {
+		a.Logger.Debugln(err)
+		return err
+	}
+
+	start := time.Now()
+	stdout, stderr, retcode, _ := a.RunScript(data.TaskScript.Code, data.TaskScript.Interpreter, data.Args, data.Timeout)
+
+	type TaskResult struct {
+		Stdout   string  `json:"stdout"`
+		Stderr   string  `json:"stderr"`
+		RetCode  int     `json:"retcode"`
+		ExecTime float64 `json:"execution_time"`
+	}
+
+	payload := TaskResult{
+		Stdout:   stdout,
+		Stderr:   stderr,
+		RetCode:  retcode,
+		ExecTime: time.Since(start).Seconds(),
+	}
+
+	// queued results are delivered once the server is reachable again
+	_, perr := a.SendApi(fmt.Sprintf("task:%d", id), http.MethodPatch, url, payload, false)
+	if perr != nil && !errors.Is(perr, agent.ErrQueued) {
+		a.Logger.Debugln(perr)
+		return perr
+	}
+	return nil
+}
+
+// CreateInternalTask creates predefined RMM agent internal tasks as cron jobs,
+// running every 'repeat' minutes. The start offset is not supported by cron and is ignored.
+func (a *linuxAgent) CreateInternalTask(name, args, repeat string, start int) (bool, error) {
+	minutes, err := strconv.Atoi(repeat)
+	if err != nil || minutes < 1 || minutes > 59 {
+		return false, fmt.Errorf("invalid repeat interval: %s", repeat)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return false, err
+	}
+
+	entry := fmt.Sprintf("*/%d * * * * root %s %s\n", minutes, exe, args)
+	if err := os.WriteFile(cronFile(name), []byte(entry), 0644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CleanupTasks removes all RMM cron jobs during uninstall
+func (a *linuxAgent) CleanupTasks() {
+	for _, task := range a.ListTasks() {
+		os.Remove(cronFile(task))
+	}
+}
+
+// ListTasks returns the names of all RMM cron jobs
+func (a *linuxAgent) ListTasks() []string {
+	ret := make([]string, 0)
+	files, err := filepath.Glob(filepath.Join(CRON_DIR, agent.TASK_PREFIX+"*"))
+	if err != nil {
+		return ret
+	}
+	for _, f := range files {
+		ret = append(ret, filepath.Base(f))
+	}
+	return ret
+}
+
+// cronFile returns the cron.d path for a task; cron ignores file names containing dots
+func cronFile(name string) string {
+	if !strings.HasPrefix(name, agent.TASK_PREFIX) {
+		name = agent.TASK_PREFIX + name
+	}
+	return filepath.Join(CRON_DIR, strings.ReplaceAll(name, ".", "_"))
+}
@@ -0,0 +1,483 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/oklog/ulid/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// Outbox limits
+const (
+	OUTBOX_DIR           = "outbox"         // In the agent data directory
+	OUTBOX_MAX_AGE       = 24 * time.Hour   // Older payloads are dropped
+	OUTBOX_MAX_SIZE      = 64 * 1024 * 1024 // The oldest payloads are dropped above this size
+	OUTBOX_RETRY_MIN     = 5 * time.Second  // First retry delay, doubled after each failed attempt
+	OUTBOX_RETRY_MAX     = 5 * time.Minute  // up to this delay
+	OUTBOX_SCAN_INTERVAL = 1 * time.Minute  // Payloads queued by other agent processes are picked up this often
+	outboxTmpPrefix      = ".tmp-"
+)
+
+// ErrQueued is returned when a payload could not be delivered now and will be retried from the outbox
+var ErrQueued = errors.New("queued in the outbox")
+
+// OutboxEntry is a queued payload: an API request if URL is set, a NATS message otherwise
+type OutboxEntry struct {
+	ID      string      `json:"id"`
+	Key     string      `json:"key"`
+	Method  string      `json:"method,omitempty"`
+	URL     string      `json:"url,omitempty"`
+	Subject string      `json:"subject,omitempty"`
+	Reply   string      `json:"reply,omitempty"`
+	Header  nats.Header `json:"header,omitempty"`
+	Body    []byte      `json:"body"`
+}
+
+// retryError is a failed delivery which is retried later. If the server could not be reached at
+// all, the other payloads sent the same way (API or NATS) are not attempted either.
+type retryError struct {
+	err         error
+	unreachable bool
+}
+
+func (e *retryError) Error() string { return e.err.Error() }
+func (e *retryError) Unwrap() error { return e.err }
+
+// Outbox keeps the payloads which could not be delivered to the server in a directory, one file
+// per payload named after its ULID, so that several agent processes can queue to it, and retries
+// them in order. A payload is only sent once the previous ones with the same key are delivered.
+type Outbox struct {
+	Dir     string
+	MaxAge  time.Duration
+	MaxSize int64
+	Logger  *logrus.Logger
+	// Deliver sends a payload; a *retryError keeps it queued, other errors drop it
+	Deliver func(e *OutboxEntry) error
+
+	mu    sync.Mutex
+	added chan struct{}
+	wake  chan struct{}
+
+	// queued indexes the names of the queued files by key, as of the last scan of Dir and the
+	// changes made since, so that Pending doesn't read the directory
+	qmu    sync.Mutex
+	queued map[string]map[string]bool
+}
+
+// NewOutbox returns an outbox queueing to dir, which is created on first use
+func NewOutbox(dir string, logger *logrus.Logger, deliver func(e *OutboxEntry) error) *Outbox {
+	return &Outbox{
+		Dir:     dir,
+		MaxAge:  OUTBOX_MAX_AGE,
+		MaxSize: OUTBOX_MAX_SIZE,
+		Logger:  logger,
+		Deliver: deliver,
+		added:   make(chan struct{}, 1),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// SetupDataDir keeps the state of the agent in dataDir: the payloads the server does not receive,
+// in the outbox, and the state of the checks
+func (a *Agent) SetupDataDir(dataDir string) {
+	a.Outbox = NewOutbox(filepath.Join(dataDir, OUTBOX_DIR), a.Logger, a.deliverOutbox)
+	a.Checks.StateDir = filepath.Join(dataDir, CHECK_STATE_DIR)
+}
+
+// Put queues a payload. With replace, the queued payloads with the same key are dropped first,
+// for payloads such as check-ins where only the latest matters.
+func (o *Outbox) Put(e *OutboxEntry, replace bool) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := os.MkdirAll(o.Dir, 0700); err != nil {
+		return err
+	}
+	if replace {
+		names, err := o.names()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if keyOfName(name) == outboxKey(e.Key) {
+				o.remove(name)
+			}
+		}
+	}
+
+	if len(e.ID) == 0 {
+		e.ID = ulid.Make().String()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(o.Dir, outboxTmpPrefix)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(o.Dir, e.ID+"_"+outboxKey(e.Key)+".json"))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	o.index(e.ID+"_"+outboxKey(e.Key)+".json", true)
+
+	o.prune()
+	select {
+	case o.added <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Pending reports whether payloads with the given key are queued. Payloads queued by other agent
+// processes are only known once the directory is scanned again, see OUTBOX_SCAN_INTERVAL.
+func (o *Outbox) Pending(key string) bool {
+	o.qmu.Lock()
+	scanned := o.queued != nil
+	pending := len(o.queued[outboxKey(key)]) > 0
+	o.qmu.Unlock()
+	if scanned {
+		return pending
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	names, err := o.names()
+	if err != nil {
+		return false
+	}
+	for _, name := range names {
+		if keyOfName(name) == outboxKey(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Notify retries the queued payloads now, e.g. once the NATS connection is re-established
+func (o *Outbox) Notify() {
+	if o == nil {
+		return
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Flush delivers the queued payloads in order and returns how many are left
+func (o *Outbox) Flush() int {
+	o.mu.Lock()
+	names := o.prune()
+	o.mu.Unlock()
+
+	blocked := make(map[string]bool)
+	unreachable := make(map[bool]bool) // by API or NATS
+	left := 0
+	for _, name := range names {
+		key := keyOfName(name)
+		if blocked[key] {
+			left++
+			continue
+		}
+
+		e, err := o.read(name)
+		if os.IsNotExist(err) {
+			// replaced or dropped meanwhile
+			continue
+		} else if err != nil {
+			o.Logger.Warnln("Outbox: dropping unreadable payload", name, err)
+			o.remove(name)
+			continue
+		}
+		api := len(e.URL) > 0
+		if unreachable[api] {
+			left++
+			continue
+		}
+
+		err = o.Deliver(e)
+		var retry *retryError
+		switch {
+		case err == nil:
+			o.remove(name)
+		case errors.As(err, &retry):
+			o.Logger.Debugf("Outbox: %s: %s", e.Key, err)
+			unreachable[api] = retry.unreachable
+			blocked[key] = true
+			left++
+		default:
+			o.Logger.Warnf("Outbox: dropping %s, rejected by the server: %s", e.Key, err)
+			o.remove(name)
+		}
+	}
+	return left
+}
+
+// Run retries the queued payloads with an exponential backoff until ctx is done
+func (o *Outbox) Run(ctx context.Context) {
+	if o == nil {
+		return
+	}
+
+	delay := OUTBOX_RETRY_MIN
+	for {
+		wait := OUTBOX_SCAN_INTERVAL
+		added := o.added
+		if left := o.Flush(); left > 0 {
+			o.Logger.Debugf("Outbox: %d payload(s) queued, retrying in %s", left, delay)
+			wait = delay
+			delay = min(delay*2, OUTBOX_RETRY_MAX)
+			// new payloads wait for the next attempt
+			added = nil
+		} else {
+			delay = OUTBOX_RETRY_MIN
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-o.wake:
+			delay = OUTBOX_RETRY_MIN
+		case <-added:
+		case <-t.C:
+		}
+		t.Stop()
+	}
+}
+
+// prune drops the payloads older than MaxAge, then the oldest ones above MaxSize, and returns the
+// names of the others, oldest first
+func (o *Outbox) prune() []string {
+	names, err := o.names()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			o.Logger.Debugln("Outbox:", err)
+		}
+		return nil
+	}
+
+	sizes := make([]int64, len(names))
+	var total int64
+	kept := names[:0]
+	for _, name := range names {
+		info, err := os.Stat(filepath.Join(o.Dir, name))
+		if err != nil {
+			continue
+		}
+		if time.Since(info.ModTime()) > o.MaxAge {
+			o.Logger.Warnln("Outbox: dropping expired payload", name)
+			o.remove(name)
+			continue
+		}
+		sizes[len(kept)] = info.Size()
+		total += info.Size()
+		kept = append(kept, name)
+	}
+
+	drop := 0
+	for total > o.MaxSize && drop < len(kept) {
+		o.Logger.Warnln("Outbox: full, dropping payload", kept[drop])
+		o.remove(kept[drop])
+		total -= sizes[drop]
+		drop++
+	}
+	return kept[drop:]
+}
+
+// names returns the queued files, oldest first, and indexes them
+func (o *Outbox) names() ([]string, error) {
+	entries, err := os.ReadDir(o.Dir)
+	if os.IsNotExist(err) {
+		o.reindex(nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.Type().IsRegular() && strings.HasSuffix(e.Name(), ".json") && !strings.HasPrefix(e.Name(), outboxTmpPrefix) {
+			ret = append(ret, e.Name())
+		}
+	}
+	sort.Strings(ret)
+	o.reindex(ret)
+	return ret, nil
+}
+
+// reindex replaces the index of the queued files
+func (o *Outbox) reindex(names []string) {
+	queued := make(map[string]map[string]bool)
+	for _, name := range names {
+		key := keyOfName(name)
+		if queued[key] == nil {
+			queued[key] = make(map[string]bool)
+		}
+		queued[key][name] = true
+	}
+	o.qmu.Lock()
+	o.queued = queued
+	o.qmu.Unlock()
+}
+
+// index adds a queued file to the index, or removes it
+func (o *Outbox) index(name string, add bool) {
+	o.qmu.Lock()
+	defer o.qmu.Unlock()
+	if o.queued == nil {
+		// not scanned yet
+		return
+	}
+	key := keyOfName(name)
+	if add {
+		if o.queued[key] == nil {
+			o.queued[key] = make(map[string]bool)
+		}
+		o.queued[key][name] = true
+	} else {
+		delete(o.queued[key], name)
+	}
+}
+
+func (o *Outbox) read(name string) (*OutboxEntry, error) {
+	data, err := os.ReadFile(filepath.Join(o.Dir, name))
+	if err != nil {
+		return nil, err
+	}
+	e := &OutboxEntry{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (o *Outbox) remove(name string) {
+	if err := os.Remove(filepath.Join(o.Dir, name)); err != nil && !os.IsNotExist(err) {
+		o.Logger.Debugln("Outbox:", err)
+		return
+	}
+	o.index(name, false)
+}
+
+// outboxKey returns the key as used in file names
+func outboxKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '-'
+	}, key)
+}
+
+// keyOfName returns the key of a queued file, named <ULID>_<key>.json
+func keyOfName(name string) string {
+	_, key, _ := strings.Cut(strings.TrimSuffix(name, ".json"), "_")
+	return key
+}
+
+// SendApi sends a JSON request to the API. If the server is unreachable or fails, or earlier
+// payloads with the same key are still queued, the request is queued in the outbox and ErrQueued
+// is returned without a response. Other errors, including 4xx responses, are returned as-is.
+// With replace, the queued payloads with the same key are dropped, as for check-ins where only
+// the latest matters, see Outbox.Put.
+func (a *Agent) SendApi(key, method, url string, payload any, replace bool) (*resty.Response, error) {
+	if a.Outbox == nil {
+		return a.RClient.R().SetBody(payload).Execute(method, url)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	e := &OutboxEntry{Key: key, Method: method, URL: url, Body: body}
+	if !a.Outbox.Pending(key) {
+		resp, err := a.apiRequest(e)
+		var retry *retryError
+		if aerr := apiError(resp, err); !errors.As(aerr, &retry) {
+			return resp, err
+		}
+		a.Logger.Debugf("%s %s: %s, queueing", method, url, retry)
+	}
+
+	if err := a.Outbox.Put(e, replace); err != nil {
+		return nil, fmt.Errorf("outbox: %w", err)
+	}
+	return nil, ErrQueued
+}
+
+// SendCheckResult sends a check result to the server and returns the check status it replied
+// with. Results are queued while the server is unreachable, in order for each check.
+func (a *Agent) SendCheckResult(checkPK int, payload any) (string, error) {
+	resp, err := a.SendApi(fmt.Sprintf("check:%d", checkPK), http.MethodPatch, API_URL_CHECKRUNNER, payload, false)
+	if err != nil {
+		return "", err
+	}
+	return resp.String(), nil
+}
+
+// deliverOutbox sends a queued payload with the current API client and NATS connection
+func (a *Agent) deliverOutbox(e *OutboxEntry) error {
+	if len(e.URL) > 0 {
+		return apiError(a.apiRequest(e))
+	}
+
+	nc := a.conn()
+	if nc == nil || !nc.IsConnected() {
+		return &retryError{err: nats.ErrConnectionClosed, unreachable: true}
+	}
+	msg := nats.NewMsg(e.Subject)
+	msg.Reply = e.Reply
+	for k, v := range e.Header {
+		msg.Header[k] = v
+	}
+	msg.Data = e.Body
+	if err := publishMsg(nc, msg, a.Compression, true); err != nil {
+		return &retryError{err: err, unreachable: true}
+	}
+	return nil
+}
+
+func (a *Agent) apiRequest(e *OutboxEntry) (*resty.Response, error) {
+	return a.RClient.R().
+		SetHeader("Content-Type", "application/json").
+		SetBody(e.Body).
+		Execute(e.Method, e.URL)
+}
+
+// apiError classifies the result of an API request: unreachable servers, 5xx, 408 and 429
+// responses are retried, other 4xx responses are not
+func apiError(resp *resty.Response, err error) error {
+	if err != nil {
+		return &retryError{err: err, unreachable: true}
+	}
+	switch code := resp.StatusCode(); {
+	case code >= 500, code == http.StatusRequestTimeout, code == http.StatusTooManyRequests:
+		return &retryError{err: fmt.Errorf("server replied %s", resp.Status())}
+	case resp.IsError():
+		return fmt.Errorf("server replied %s: %s", resp.Status(), strings.TrimSpace(resp.String()))
+	}
+	return nil
+}
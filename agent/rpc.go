@@ -1,18 +1,29 @@
 package agent
 
 import (
-	"github.com/nats-io/nats.go"
+	"fmt"
 	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
 )
 
-// SetupNatsOptions
-// todo: review authentication
-// https://docs.nats.io/running-a-nats-service/configuration/securing_nats/auth_intro/nkey_auth
-func (a *Agent) SetupNatsOptions() []nats.Option {
+// SetupNatsOptions returns the options to connect to NATS with; it fails if the agent has no
+// credentials to authenticate with, rather than connecting unauthenticated
+func (a *Agent) SetupNatsOptions() ([]nats.Option, error) {
 	totalWait := 10 * time.Minute
 	opts := make([]nats.Option, 0)
 	opts = append(opts, nats.Name(a.AgentID))
-	opts = append(opts, nats.UserInfo(a.AgentID, a.Token))
+	// check-ins are published on the agent's own subject; don't receive them back as RPC requests
+	opts = append(opts, nats.NoEcho())
+	if len(a.Cert) > 0 {
+		opts = append(opts, nats.RootCAs(a.Cert))
+	}
+	auth, err := a.natsAuth()
+	if err != nil {
+		return nil, fmt.Errorf("NATS authentication: %w", err)
+	}
+	opts = append(opts, auth)
 	opts = append(opts, nats.ReconnectWait(time.Second*5))
 	opts = append(opts, nats.RetryOnFailedConnect(true))
 	opts = append(opts, nats.MaxReconnects(-1))
@@ -26,12 +37,18 @@ func (a *Agent) SetupNatsOptions() []nats.Option {
 	}))
 	opts = append(opts, nats.ReconnectHandler(func(nc *nats.Conn) {
 		a.Logger.Printf("NATS Reconnected [%s]", nc.ConnectedUrl())
+		a.Outbox.Notify()
 	}))
+	// errors are reported, the client keeps reconnecting; the process only exits through Stop
 	opts = append(opts, nats.ErrorHandler(func(conn *nats.Conn, subscription *nats.Subscription, err error) {
-		a.Logger.Fatalf("NATS Error: %v", err)
+		a.Logger.Errorf("NATS Error: %v", err)
 	}))
 	opts = append(opts, nats.ClosedHandler(func(nc *nats.Conn) {
-		a.Logger.Fatalf("NATS Exiting: %v", nc.LastError())
+		if err := nc.LastError(); err != nil {
+			a.Logger.Errorf("NATS Closed: %v", err)
+			return
+		}
+		a.Logger.Debugln("NATS Closed")
 	}))
 	// if a.Insecure {
 	// 	insecureConf := &tls.Config{
@@ -39,5 +56,51 @@ func (a *Agent) SetupNatsOptions() []nats.Option {
 	// 	}
 	// 	opts = append(opts, nats.Secure(insecureConf))
 	// }
-	return opts
+	return opts, nil
+}
+
+// natsAuth picks the strongest configured authentication: JWT user credentials,
+// then an NKey signing the server's nonce, then the legacy user and token.
+// https://docs.nats.io/running-a-nats-service/configuration/securing_nats/auth_intro/nkey_auth
+func (a *Agent) natsAuth() (nats.Option, error) {
+	if len(a.CredsFile) > 0 {
+		if !FileExists(a.CredsFile) {
+			return nil, fmt.Errorf("credentials file %s does not exist", a.CredsFile)
+		}
+		return nats.UserCredentials(a.CredsFile), nil
+	}
+
+	if len(a.NKeySeed) > 0 {
+		kp, err := nkeys.FromSeed([]byte(a.NKeySeed))
+		if err != nil {
+			return nil, fmt.Errorf("invalid NKey seed: %w", err)
+		}
+		pub, err := kp.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		// the key pair only signs the nonce, the seed itself never leaves the agent
+		return nats.Nkey(pub, kp.Sign), nil
+	}
+
+	return nats.UserInfo(a.AgentID, a.Token), nil
+}
+
+// GenerateNKey creates a new NKey user key pair for the agent, returning its seed and public key
+func GenerateNKey() (seed, pub string, err error) {
+	kp, err := nkeys.CreateUser()
+	if err != nil {
+		return "", "", err
+	}
+	defer kp.Wipe()
+
+	s, err := kp.Seed()
+	if err != nil {
+		return "", "", err
+	}
+	pub, err = kp.PublicKey()
+	if err != nil {
+		return "", "", err
+	}
+	return string(s), pub, nil
 }
@@ -0,0 +1,122 @@
+package agent
+
+import (
+	"time"
+)
+
+// RegisterCommonRpcHandlers registers the RPC functions every platform supports
+func RegisterCommonRpcHandlers(r *RpcRegistry, a IAgent, jobs *JobManager) {
+	r.Register(NATS_CMD_PING, func(req *RpcRequest) (any, error) {
+		return "pong", nil
+	})
+
+	r.Register(NATS_CMD_PUBLICIP, func(req *RpcRequest) (any, error) {
+		return a.PublicIP(), nil
+	})
+
+	r.Register(NATS_CMD_CPULOADAVG, func(req *RpcRequest) (any, error) {
+		return a.GetCPULoadAvg(), nil
+	})
+
+	r.Register(NATS_CMD_SOFTWARE_LIST, func(req *RpcRequest) (any, error) {
+		return a.GetInstalledSoftware(), nil
+	})
+
+	r.Register(NATS_CMD_PROCS_KILL, func(req *RpcRequest) (any, error) {
+		if err := KillProc(req.ProcPID); err != nil {
+			return nil, err
+		}
+		return "ok", nil
+	})
+
+	// replies with the job ID, the output is returned by jobstatus and, if
+	// requested, streamed while the script runs
+	r.Register(NATS_CMD_SCRIPT_RUN, func(req *RpcRequest) (any, error) {
+		return jobs.RunJob(req, func(job *Job) (any, error) {
+			stdout, stderr, _, err := runScriptJob(a, req, job)
+			if err != nil {
+				return nil, err
+			}
+			return stdout + stderr, nil
+		})
+	})
+
+	// replies with the job ID, jobstatus returns the output, exit code and execution time
+	r.Register(NATS_CMD_SCRIPT_RUN_FULL, func(req *RpcRequest) (any, error) {
+		return jobs.RunJob(req, func(job *Job) (any, error) {
+			start := time.Now()
+			stdout, stderr, retcode, _ := runScriptJob(a, req, job)
+			return struct {
+				Stdout   string  `json:"stdout"`
+				Stderr   string  `json:"stderr"`
+				Retcode  int     `json:"retcode"`
+				ExecTime float64 `json:"execution_time"`
+			}{stdout, stderr, retcode, time.Since(start).Seconds()}, nil
+		})
+	})
+
+	r.Register(NATS_CMD_JOB_LIST, func(req *RpcRequest) (any, error) {
+		return jobs.List(), nil
+	})
+
+	r.Register(NATS_CMD_JOB_STATUS, func(req *RpcRequest) (any, error) {
+		job, err := jobs.Get(req.Data["job_id"])
+		if err != nil {
+			return nil, err
+		}
+		return job.Info(true), nil
+	})
+
+	r.Register(NATS_CMD_JOB_CANCEL, func(req *RpcRequest) (any, error) {
+		job, err := jobs.Get(req.Data["job_id"])
+		if err != nil {
+			return nil, err
+		}
+		if err := job.Cancel(); err != nil {
+			return nil, err
+		}
+		return job.Info(false), nil
+	})
+
+	// jobs are queried and cancelled even when all the workers are busy
+	r.Exempt(NATS_CMD_JOB_LIST, NATS_CMD_JOB_STATUS, NATS_CMD_JOB_CANCEL)
+
+	r.Register(NATS_CMD_TASK_RUN, func(req *RpcRequest) (any, error) {
+		req.Logger.Debugln("Running task")
+		_ = a.RunTask(req.TaskId)
+		return nil, nil
+	})
+
+	r.Register(NATS_CMD_SYNC, func(req *RpcRequest) (any, error) {
+		req.Logger.Debugln("Sending system info and software")
+		a.SyncInfo()
+		return nil, nil
+	})
+
+	r.Register(NATS_CMD_RECOVER, func(req *RpcRequest) (any, error) {
+		switch req.Data["mode"] {
+		case "jetagent":
+			req.Logger.Debugln("Recovering agent")
+			// the service is restarted, don't let the command be redelivered
+			_ = req.Ack()
+			a.RecoverAgent()
+		}
+		return "ok", nil
+	})
+
+	r.Register(NATS_CMD_REBOOT_NOW, func(req *RpcRequest) (any, error) {
+		_ = req.Respond("ok")
+		_ = req.Ack()
+		a.RebootSystem()
+		return nil, nil
+	})
+}
+
+// runScriptJob runs the script of a runscript or runscriptfull request, streaming
+// its output if the request has a "stream" subject
+func runScriptJob(a IAgent, req *RpcRequest, job *Job) (stdout, stderr string, retcode int, err error) {
+	stream := NewOutputStream(req, job)
+	stdout, stderr, retcode, err = a.RunScriptContext(stream.Context(job.Context()), req.Data["code"], req.Data["shell"], req.ScriptArgs, req.Timeout)
+	stream.Close(retcode, err)
+	return
+}
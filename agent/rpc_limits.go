@@ -0,0 +1,203 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+// RPC concurrency defaults
+const (
+	RPC_MAX_CONCURRENT = 8                // Handlers running at once, across all functions
+	RPC_MAX_QUEUED     = 64               // Requests waiting for a worker; more are rejected at once
+	RPC_QUEUE_TIMEOUT  = 30 * time.Second // Time a request may wait for a worker
+)
+
+// rpcLimiter bounds the handlers running at once, globally and per function
+type rpcLimiter struct {
+	once    sync.Once
+	global  chan struct{}
+	queued  atomic.Int32
+	mu      sync.RWMutex
+	perFunc map[string]chan struct{}
+	exempt  map[string]bool
+	noQueue map[string]bool
+}
+
+// SetupRpcLimits applies the configured concurrency to the RPC registry. The per-function
+// limits of the platform are used unless the configuration overrides them.
+func (a *Agent) SetupRpcLimits(defaults map[string]int) {
+	a.Rpc.SetConcurrency(a.RpcMaxConc, time.Duration(a.RpcQueueTime)*time.Second)
+	for fn, n := range defaults {
+		if _, ok := a.RpcLimits[fn]; !ok {
+			a.Rpc.Limit(fn, n)
+		}
+	}
+	for fn, n := range a.RpcLimits {
+		a.Rpc.Limit(fn, n)
+	}
+}
+
+// SetConcurrency sets the maximum number of handlers running at once and how long requests may
+// wait for one to complete; zero values keep the defaults. It must be called before Dispatch.
+func (r *RpcRegistry) SetConcurrency(max int, queueTimeout time.Duration) {
+	if max > 0 {
+		r.MaxConcurrent = max
+	}
+	if queueTimeout > 0 {
+		r.QueueTimeout = queueTimeout
+	}
+}
+
+// Limit sets the maximum number of concurrent requests of a function, e.g. 1 for agent updates
+func (r *RpcRegistry) Limit(fn string, n int) {
+	r.limiter.mu.Lock()
+	defer r.limiter.mu.Unlock()
+	if r.limiter.perFunc == nil {
+		r.limiter.perFunc = make(map[string]chan struct{})
+	}
+	if n <= 0 {
+		delete(r.limiter.perFunc, fn)
+		return
+	}
+	r.limiter.perFunc[fn] = make(chan struct{}, n)
+}
+
+// Exempt lets functions run without waiting for a worker, e.g. to cancel jobs while all the workers are busy
+func (r *RpcRegistry) Exempt(fns ...string) {
+	r.limiter.mu.Lock()
+	defer r.limiter.mu.Unlock()
+	if r.limiter.exempt == nil {
+		r.limiter.exempt = make(map[string]bool)
+	}
+	for _, fn := range fns {
+		r.limiter.exempt[fn] = true
+	}
+}
+
+// NoQueue rejects the requests of functions at their limit at once rather than queueing them,
+// e.g. an agent update while another one is running
+func (r *RpcRegistry) NoQueue(fns ...string) {
+	r.limiter.mu.Lock()
+	defer r.limiter.mu.Unlock()
+	if r.limiter.noQueue == nil {
+		r.limiter.noQueue = make(map[string]bool)
+	}
+	for _, fn := range fns {
+		r.limiter.noQueue[fn] = true
+	}
+}
+
+// Limits returns the per-function limits
+func (r *RpcRegistry) Limits() map[string]int {
+	r.limiter.mu.RLock()
+	defer r.limiter.mu.RUnlock()
+	ret := make(map[string]int, len(r.limiter.perFunc))
+	for fn, sem := range r.limiter.perFunc {
+		ret[fn] = cap(sem)
+	}
+	return ret
+}
+
+// acquire waits for a free worker for fn, within the queue timeout; functions set by NoQueue
+// do not wait for their own limit.
+// The returned function releases the worker.
+func (r *RpcRegistry) acquire(fn string) (release func(), err error) {
+	l := &r.limiter
+	l.once.Do(func() {
+		l.global = make(chan struct{}, r.MaxConcurrent)
+	})
+
+	l.mu.RLock()
+	sem, limited := l.perFunc[fn]
+	exempt := l.exempt[fn]
+	noQueue := l.noQueue[fn]
+	l.mu.RUnlock()
+	if exempt {
+		return func() {}, nil
+	}
+
+	if l.queued.Add(1) > RPC_MAX_QUEUED {
+		l.queued.Add(-1)
+		return nil, NewRpcError(shared.RPC_ERR_BUSY, "busy: too many queued requests")
+	}
+	defer l.queued.Add(-1)
+
+	ctx, cancel := context.WithTimeout(r.Context, r.QueueTimeout)
+	defer cancel()
+
+	if limited && noQueue {
+		select {
+		case sem <- struct{}{}:
+		default:
+			return nil, NewRpcError(shared.RPC_ERR_BUSY, "busy: %s is already running", fn)
+		}
+	} else if limited {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, NewRpcError(shared.RPC_ERR_BUSY, "busy: %s is limited to %d concurrent requests", fn, cap(sem))
+		}
+	}
+
+	select {
+	case l.global <- struct{}{}:
+	case <-ctx.Done():
+		if limited {
+			<-sem
+		}
+		return nil, NewRpcError(shared.RPC_ERR_BUSY, "busy: %d requests running", cap(l.global))
+	}
+
+	return func() {
+		<-l.global
+		if limited {
+			<-sem
+		}
+	}, nil
+}
+
+// IsBusy reports whether err is a busy rejection
+func IsBusy(err error) bool {
+	var rpcErr *RpcError
+	return errors.As(err, &rpcErr) && rpcErr.Code == shared.RPC_ERR_BUSY
+}
+
+// ParseRpcLimits parses per-function limits written as "fn=n,fn=n"
+func ParseRpcLimits(s string) (map[string]int, error) {
+	ret := make(map[string]int)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		fn, n, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid RPC limit %q, expected fn=n", item)
+		}
+		i, err := strconv.Atoi(strings.TrimSpace(n))
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("invalid RPC limit %q: %s is not a valid number", item, n)
+		}
+		ret[strings.TrimSpace(fn)] = i
+	}
+	return ret, nil
+}
+
+// FormatRpcLimits is the reverse of ParseRpcLimits
+func FormatRpcLimits(limits map[string]int) string {
+	items := make([]string, 0, len(limits))
+	for fn, n := range limits {
+		items = append(items, fmt.Sprintf("%s=%d", fn, n))
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,45 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRpcLimits(t *testing.T) {
+	tests := []struct {
+		s    string
+		want map[string]int // nil for an error
+	}{
+		{"", map[string]int{}},
+		{"runscript=2", map[string]int{"runscript": 2}},
+		{" runscript = 2 , runchecks=1,", map[string]int{"runscript": 2, "runchecks": 1}},
+		{"agentupdate=0", map[string]int{"agentupdate": 0}},
+		{"runscript=1,runscript=3", map[string]int{"runscript": 3}},
+		{"runscript", nil},
+		{"runscript=two", nil},
+		{"runscript=-1", nil},
+	}
+	for _, tt := range tests {
+		got, err := ParseRpcLimits(tt.s)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("ParseRpcLimits(%q) = %v, want an error", tt.s, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseRpcLimits(%q) = %v, %v, want %v", tt.s, got, err, tt.want)
+		}
+	}
+}
+
+func TestFormatRpcLimits(t *testing.T) {
+	limits := map[string]int{"runscript": 2, "agentupdate": 1}
+	s := FormatRpcLimits(limits)
+	if s != "agentupdate=1,runscript=2" {
+		t.Errorf("FormatRpcLimits = %q", s)
+	}
+	if got, err := ParseRpcLimits(s); err != nil || !reflect.DeepEqual(got, limits) {
+		t.Errorf("ParseRpcLimits(%q) = %v, %v, want %v", s, got, err, limits)
+	}
+}
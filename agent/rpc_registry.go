@@ -0,0 +1,353 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/shared"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+// RpcHandler processes a single RPC request. The returned value is encoded and sent back
+// to the server; returning a nil value and a nil error sends no reply.
+type RpcHandler func(req *RpcRequest) (any, error)
+
+// RpcError is a handler error with a response code (shared.RPC_ERR_*).
+// Handlers returning other errors reply with shared.RPC_ERR_FAILED.
+type RpcError struct {
+	Code    string
+	Message string
+}
+
+func NewRpcError(code, format string, args ...any) *RpcError {
+	return &RpcError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *RpcError) Error() string {
+	return e.Message
+}
+
+// RpcRequest is an incoming RPC (NATS) message along with its decoded header.
+// Replies are published to Msg.Reply, encoded with the same codec as the request.
+type RpcRequest struct {
+	shared.RpcPayload
+	Conn   *nats.Conn
+	Msg    *nats.Msg
+	Logger *logrus.Logger
+
+	ctx       context.Context
+	codec     Codec
+	encoding  string
+	chunked   bool // The requester joins replies split into chunks
+	start     time.Time
+	legacy    bool
+	mu        sync.Mutex
+	responded bool
+	ack       func() error
+}
+
+// Context is cancelled when the agent stops and the shutdown grace period has elapsed
+func (r *RpcRequest) Context() context.Context {
+	return r.ctx
+}
+
+// Decode unmarshals the raw message into v, e.g. a platform-specific payload
+func (r *RpcRequest) Decode(v any) error {
+	return r.codec.Decode(r.Msg.Data, v)
+}
+
+// Respond replies to the server with a successful result. Only the first reply is sent.
+func (r *RpcRequest) Respond(v any) error {
+	if r.legacy {
+		return r.reply(v)
+	}
+	return r.reply(&shared.RpcResponse{
+		Status:   shared.RPC_STATUS_OK,
+		Duration: time.Since(r.start).Milliseconds(),
+		Data:     v,
+	})
+}
+
+// RespondError replies to the server with an error, see RpcError. Only the first reply is sent.
+func (r *RpcRequest) RespondError(err error) error {
+	if r.legacy {
+		return r.reply(err.Error())
+	}
+
+	code := shared.RPC_ERR_FAILED
+	var rpcErr *RpcError
+	if errors.As(err, &rpcErr) {
+		code = rpcErr.Code
+	}
+	return r.reply(&shared.RpcResponse{
+		Status:   shared.RPC_STATUS_ERROR,
+		Code:     code,
+		Message:  err.Error(),
+		Duration: time.Since(r.start).Milliseconds(),
+	})
+}
+
+// reply encodes v and publishes it to the reply subject, unless a reply was already sent
+func (r *RpcRequest) reply(v any) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.responded {
+		return nil
+	}
+	r.responded = true
+
+	if len(r.Msg.Reply) == 0 {
+		return nats.ErrMsgNoReply
+	}
+	resp, err := newCodecMsg(r.codec, r.Msg.Reply, "", v)
+	if err != nil {
+		return err
+	}
+	err = publishMsg(r.Conn, resp, r.encoding, r.chunked)
+	if errors.Is(err, ErrPayloadTooLarge) {
+		// a requester which can't join chunks, e.g. nc.Request(), gets an error instead of a part of the reply
+		var tooLarge any = err.Error()
+		if !r.legacy {
+			tooLarge = &shared.RpcResponse{
+				Status:   shared.RPC_STATUS_ERROR,
+				Code:     shared.RPC_ERR_FAILED,
+				Message:  fmt.Sprintf("reply too large, send the %s header to receive it in chunks: %s", NATS_HDR_ACCEPT_CHUNKS, err),
+				Duration: time.Since(r.start).Milliseconds(),
+			}
+		}
+		if resp, cerr := newCodecMsg(r.codec, r.Msg.Reply, "", tooLarge); cerr == nil {
+			_ = publishMsg(r.Conn, resp, r.encoding, false)
+		}
+	}
+	return err
+}
+
+// Responded reports whether a reply has already been sent
+func (r *RpcRequest) Responded() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.responded
+}
+
+// Ack acknowledges a durable (JetStream) message before the handler completes, so that it
+// is not redelivered if the handler restarts the agent or the system. Only the first call
+// has an effect; it is a no-op for core NATS messages.
+func (r *RpcRequest) Ack() error {
+	r.mu.Lock()
+	ack := r.ack
+	r.ack = nil
+	r.mu.Unlock()
+
+	if ack == nil {
+		return nil
+	}
+	return ack()
+}
+
+// TypedHandler wraps a handler which expects the whole message decoded into T
+func TypedHandler[T any](h func(req *RpcRequest, p *T) (any, error)) RpcHandler {
+	return func(req *RpcRequest) (any, error) {
+		p := new(T)
+		if err := req.Decode(p); err != nil {
+			return nil, err
+		}
+		return h(req, p)
+	}
+}
+
+// RpcRegistry maps RPC function names (NATS_CMD_*) to their handlers
+type RpcRegistry struct {
+	Logger *logrus.Logger
+	// LegacyReplies sends bare results and error strings instead of shared.RpcResponse, for older servers
+	LegacyReplies bool
+	// Context is passed to the requests; it defaults to context.Background()
+	Context context.Context
+	// Compression is the content encoding of large replies to requests without an Accept-Encoding header
+	Compression string
+	// MaxConcurrent is the number of handlers running at once, see SetConcurrency and Limit
+	MaxConcurrent int
+	// QueueTimeout is how long a request waits for a handler to complete before being rejected as busy
+	QueueTimeout time.Duration
+
+	mu       sync.RWMutex
+	handlers map[string]RpcHandler
+	inflight sync.WaitGroup
+	limiter  rpcLimiter
+}
+
+func NewRpcRegistry(logger *logrus.Logger) *RpcRegistry {
+	return &RpcRegistry{
+		Logger:        logger,
+		Context:       context.Background(),
+		MaxConcurrent: RPC_MAX_CONCURRENT,
+		QueueTimeout:  RPC_QUEUE_TIMEOUT,
+		handlers:      make(map[string]RpcHandler),
+	}
+}
+
+// Register adds a handler for the given function name
+func (r *RpcRegistry) Register(fn string, h RpcHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.handlers[fn]; ok {
+		panic(fmt.Sprintf("RPC handler already registered: %s", fn))
+	}
+	r.handlers[fn] = h
+}
+
+// Handler returns the handler registered for fn, if any
+func (r *RpcRegistry) Handler(fn string) (RpcHandler, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	h, ok := r.handlers[fn]
+	return h, ok
+}
+
+// Functions returns the sorted list of registered function names
+func (r *RpcRegistry) Functions() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ret := make([]string, 0, len(r.handlers))
+	for fn := range r.handlers {
+		ret = append(ret, fn)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Dispatch decodes an incoming message and runs its handler in a new goroutine, once a worker
+// is available. Requests still waiting after the queue timeout are rejected as busy.
+func (r *RpcRegistry) Dispatch(nc *nats.Conn, msg *nats.Msg) {
+	req, h, err := r.prepare(nc, msg)
+	if err != nil {
+		r.reject(req, err)
+		return
+	}
+	r.inflight.Add(1)
+	go func() {
+		defer r.inflight.Done()
+		release, err := r.acquire(req.Func)
+		if err != nil {
+			r.reject(req, err)
+			return
+		}
+		defer release()
+		r.run(req, h)
+	}()
+}
+
+// Wait waits for the running handlers, returning false if some are still running after d
+func (r *RpcRegistry) Wait(d time.Duration) bool {
+	return waitTimeout(&r.inflight, d)
+}
+
+// Handle decodes an incoming message and runs its handler, returning once it has completed.
+// ack is called when the handler completes, unless the handler acknowledged the message itself.
+// An error is returned, and ack is not called, if the message cannot be handled at all.
+// Busy errors (see IsBusy) are not replied to, so that the message can be delivered again later.
+func (r *RpcRegistry) Handle(nc *nats.Conn, msg *nats.Msg, ack func() error) error {
+	req, h, err := r.prepare(nc, msg)
+	if err != nil {
+		r.reject(req, err)
+		return err
+	}
+	r.inflight.Add(1)
+	defer r.inflight.Done()
+	release, err := r.acquire(req.Func)
+	if err != nil {
+		r.Logger.Debugln(err)
+		return err
+	}
+	defer release()
+	req.ack = ack
+	r.run(req, h)
+	return nil
+}
+
+// Reject replies to a message with an error, without running its handler
+func (r *RpcRegistry) Reject(nc *nats.Conn, msg *nats.Msg, err error) {
+	req, _, _ := r.prepare(nc, msg)
+	r.reject(req, err)
+}
+
+// prepare decodes the message header and looks up its handler.
+// The request is returned along with the error, so that it can still be replied to.
+func (r *RpcRegistry) prepare(nc *nats.Conn, msg *nats.Msg) (*RpcRequest, RpcHandler, error) {
+	req := &RpcRequest{
+		Conn:   nc,
+		Msg:    msg,
+		Logger: r.Logger,
+		ctx:    r.Context,
+		codec:  MsgpackCodec,
+		start:  time.Now(),
+		legacy: r.LegacyReplies,
+	}
+
+	c, err := codecForMsg(msg)
+	if err != nil {
+		return req, nil, NewRpcError(shared.RPC_ERR_INVALID, "invalid RPC request: %s", err)
+	}
+	req.codec = c
+
+	req.encoding = r.Compression
+	if msg.Header != nil {
+		if v := msg.Header.Get(NATS_HDR_ACCEPT_ENCODING); len(v) > 0 {
+			req.encoding = acceptEncoding(v)
+		}
+		req.chunked = len(msg.Header.Get(NATS_HDR_ACCEPT_CHUNKS)) > 0
+	}
+	if err := decompressMsg(msg); err != nil {
+		return req, nil, NewRpcError(shared.RPC_ERR_INVALID, "invalid RPC request: %s", err)
+	}
+
+	if err := req.Decode(&req.RpcPayload); err != nil {
+		return req, nil, NewRpcError(shared.RPC_ERR_INVALID, "invalid RPC request: %s", err)
+	}
+
+	h, ok := r.Handler(req.Func)
+	if !ok {
+		return req, nil, NewRpcError(shared.RPC_ERR_UNSUPPORTED, "RPC function not supported: %s", req.Func)
+	}
+	return req, h, nil
+}
+
+// reject replies to a request which cannot be handled
+func (r *RpcRegistry) reject(req *RpcRequest, err error) {
+	r.Logger.Debugln(err)
+	if err := req.RespondError(err); err != nil && err != nats.ErrMsgNoReply {
+		r.Logger.Errorln("RPC", req.Func, "unable to respond:", err)
+	}
+}
+
+// run executes a handler, recovering from panics and sending its reply
+func (r *RpcRegistry) run(req *RpcRequest, h RpcHandler) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			r.Logger.Errorf("RPC %s panicked: %v\n%s", req.Func, rec, debug.Stack())
+			_ = req.RespondError(NewRpcError(shared.RPC_ERR_INTERNAL, "%v", rec))
+		}
+		if err := req.Ack(); err != nil {
+			r.Logger.Errorln("RPC", req.Func, "unable to ack:", err)
+		}
+	}()
+
+	r.Logger.Debugln("RPC:", req.Func)
+	ret, err := h(req)
+	switch {
+	case err != nil:
+		r.Logger.Debugln("RPC", req.Func, "error:", err)
+		err = req.RespondError(err)
+	case ret != nil:
+		r.Logger.Debugln(ret)
+		err = req.Respond(ret)
+	}
+	if err != nil {
+		r.Logger.Errorln("RPC", req.Func, "unable to respond:", err)
+	}
+}
@@ -0,0 +1,238 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Secret sealer backends
+const (
+	SEALER_PLAIN     = "plain"
+	SEALER_MACHINEID = "machineid"
+	SEALER_KEYRING   = "keyring"
+
+	// sealedPrefix marks a sealed value as "sealed:<backend>:<base64 ciphertext>"
+	sealedPrefix = "sealed:"
+
+	sealingKeySize = 32
+)
+
+// Well-known locations of the machine id
+var machineIDPaths = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+var ErrSealingKeyNotFound = errors.New("sealing key not found")
+
+// SecretSealer protects secrets such as the agent Token before they are persisted.
+// On Windows the registry store uses DPAPI instead.
+type SecretSealer interface {
+	// Name identifies the backend in sealed values
+	Name() string
+	Seal(plaintext string) (string, error)
+	// Unseal returns values that were never sealed unchanged
+	Unseal(sealed string) (string, error)
+}
+
+// NewSecretSealer returns the sealer backend by name; keyFile is used by the machine id and
+// keyring backends
+func NewSecretSealer(name, keyFile string) (SecretSealer, error) {
+	switch name {
+	case SEALER_PLAIN:
+		return PlainSealer{}, nil
+	case SEALER_MACHINEID, "":
+		return NewMachineKeySealer(keyFile), nil
+	case SEALER_KEYRING:
+		return newKeyringSealer(keyFile)
+	}
+	return nil, fmt.Errorf("unknown secret sealer %q", name)
+}
+
+// IsSealed reports whether a value was sealed by any backend
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix)
+}
+
+// PlainSealer stores secrets as they are. Only meant for tests.
+type PlainSealer struct{}
+
+func (PlainSealer) Name() string { return SEALER_PLAIN }
+
+func (PlainSealer) Seal(plaintext string) (string, error) { return plaintext, nil }
+
+func (PlainSealer) Unseal(sealed string) (string, error) {
+	if IsSealed(sealed) {
+		return "", fmt.Errorf("value is sealed and cannot be read by the %s sealer", SEALER_PLAIN)
+	}
+	return sealed, nil
+}
+
+// MachineKeySealer encrypts secrets with AES-GCM using a key derived from the machine id
+// and a random key file readable only by root. Copying the configuration to another machine,
+// or reading it without the key file, does not reveal the secrets.
+type MachineKeySealer struct {
+	KeyFile string
+}
+
+func NewMachineKeySealer(keyFile string) *MachineKeySealer {
+	return &MachineKeySealer{KeyFile: keyFile}
+}
+
+func (s *MachineKeySealer) Name() string { return SEALER_MACHINEID }
+
+func (s *MachineKeySealer) Seal(plaintext string) (string, error) {
+	key, err := s.key(true)
+	if err != nil {
+		return "", err
+	}
+	return sealWithKey(s.Name(), key, plaintext)
+}
+
+func (s *MachineKeySealer) Unseal(sealed string) (string, error) {
+	if !IsSealed(sealed) {
+		return sealed, nil
+	}
+	key, err := s.key(false)
+	if err != nil {
+		return "", err
+	}
+	return unsealWithKey(s.Name(), key, sealed)
+}
+
+// key derives the sealing key, creating the key file if requested
+func (s *MachineKeySealer) key(create bool) ([]byte, error) {
+	machineID, err := readMachineID()
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := readKeyFile(s.KeyFile)
+	if errors.Is(err, fs.ErrNotExist) && create {
+		secret, err = createKeyFile(s.KeyFile)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrSealingKeyNotFound, s.KeyFile)
+	} else if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(machineID)
+	return mac.Sum(nil), nil
+}
+
+// readKeyFile reads a key file, which must be readable only by its owner
+func readKeyFile(path string) ([]byte, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s must not be accessible by group or others (mode %#o)", path, fi.Mode().Perm())
+	}
+
+	secret, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) != sealingKeySize {
+		return nil, fmt.Errorf("%s: invalid key length %d", path, len(secret))
+	}
+	return secret, nil
+}
+
+// createKeyFile writes a new random key to a file readable only by its owner
+func createKeyFile(path string) ([]byte, error) {
+	secret := make([]byte, sealingKeySize)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return nil, err
+	}
+	if err := writeKeyFile(path, secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+func writeKeyFile(path string, secret []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, secret, 0400)
+}
+
+func readMachineID() ([]byte, error) {
+	for _, p := range machineIDPaths {
+		id, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		id = bytes.TrimSpace(id)
+		if len(id) > 0 {
+			return id, nil
+		}
+	}
+	return nil, fmt.Errorf("machine id not found in %s", strings.Join(machineIDPaths, ", "))
+}
+
+// sealWithKey encrypts plaintext with AES-256-GCM; the backend name is authenticated as additional data
+func sealWithKey(backend string, key []byte, plaintext string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	ct := gcm.Seal(nonce, nonce, []byte(plaintext), []byte(backend))
+	return sealedPrefix + backend + ":" + base64.StdEncoding.EncodeToString(ct), nil
+}
+
+func unsealWithKey(backend string, key []byte, sealed string) (string, error) {
+	name, encoded, ok := strings.Cut(strings.TrimPrefix(sealed, sealedPrefix), ":")
+	if !ok {
+		return "", errors.New("malformed sealed value")
+	}
+	if name != backend {
+		return "", fmt.Errorf("value was sealed by the %s sealer, not %s", name, backend)
+	}
+
+	ct, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("malformed sealed value: %w", err)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(ct) < gcm.NonceSize() {
+		return "", errors.New("malformed sealed value")
+	}
+
+	pt, err := gcm.Open(nil, ct[:gcm.NonceSize()], ct[gcm.NonceSize():], []byte(backend))
+	if err != nil {
+		return "", fmt.Errorf("unable to unseal value (wrong key?): %w", err)
+	}
+	return string(pt), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
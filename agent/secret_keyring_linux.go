@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	keyringKeyType = "user"
+	keyringKeyDesc = "rmm-agent:sealing-key"
+
+	// possessor: all; owner: view, read, search
+	keyringKeyPerm = 0x3f000000 | 0x00010000 | 0x00020000 | 0x00080000
+)
+
+// KeyringSealer keeps the sealing key in the kernel keyring of the agent user, and a copy in a
+// key file readable only by root, from which the keyring is restored after a reboot.
+type KeyringSealer struct {
+	KeyFile string
+}
+
+func newKeyringSealer(keyFile string) (SecretSealer, error) {
+	return &KeyringSealer{KeyFile: keyFile}, nil
+}
+
+func (*KeyringSealer) Name() string { return SEALER_KEYRING }
+
+func (s *KeyringSealer) Seal(plaintext string) (string, error) {
+	key, err := s.key(true)
+	if err != nil {
+		return "", err
+	}
+	return sealWithKey(s.Name(), key, plaintext)
+}
+
+func (s *KeyringSealer) Unseal(sealed string) (string, error) {
+	if !IsSealed(sealed) {
+		return sealed, nil
+	}
+	key, err := s.key(false)
+	if err != nil {
+		return "", err
+	}
+	return unsealWithKey(s.Name(), key, sealed)
+}
+
+// key reads the sealing key from the user keyring, restoring it from the key file if missing,
+// e.g. after a reboot, and creating both if requested
+func (s *KeyringSealer) key(create bool) ([]byte, error) {
+	ring, err := unix.KeyctlGetKeyringID(unix.KEY_SPEC_USER_KEYRING, true)
+	if err != nil {
+		return nil, fmt.Errorf("unable to access the kernel keyring: %w", err)
+	}
+
+	id, err := unix.KeyctlSearch(ring, keyringKeyType, keyringKeyDesc, 0)
+	if errors.Is(err, unix.ENOKEY) {
+		key, err := readKeyFile(s.KeyFile)
+		if errors.Is(err, fs.ErrNotExist) {
+			if !create {
+				return nil, fmt.Errorf("%w in the kernel keyring or %s", ErrSealingKeyNotFound, s.KeyFile)
+			}
+			if key, err = createKeyFile(s.KeyFile); err != nil {
+				return nil, err
+			}
+		} else if err != nil {
+			return nil, err
+		}
+		return key, addKeyringKey(ring, key)
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to search the kernel keyring: %w", err)
+	}
+
+	key := make([]byte, sealingKeySize)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, key, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the sealing key: %w", err)
+	}
+	if n != sealingKeySize {
+		return nil, fmt.Errorf("invalid sealing key length %d", n)
+	}
+	// keys added before the key file was kept
+	if _, err := os.Stat(s.KeyFile); errors.Is(err, fs.ErrNotExist) {
+		if err := writeKeyFile(s.KeyFile, key); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+func addKeyringKey(ring int, key []byte) error {
+	id, err := unix.AddKey(keyringKeyType, keyringKeyDesc, key, ring)
+	if err != nil {
+		return fmt.Errorf("unable to add the sealing key to the kernel keyring: %w", err)
+	}
+	// allow later reads by the same user from other sessions, e.g. after a service restart
+	if err := unix.KeyctlSetperm(id, keyringKeyPerm); err != nil {
+		return fmt.Errorf("unable to set the sealing key permissions: %w", err)
+	}
+	return nil
+}
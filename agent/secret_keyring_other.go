@@ -0,0 +1,12 @@
+//go:build !linux
+
+package agent
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func newKeyringSealer(keyFile string) (SecretSealer, error) {
+	return nil, fmt.Errorf("the %s sealer is not supported on %s", SEALER_KEYRING, runtime.GOOS)
+}
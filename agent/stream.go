@@ -0,0 +1,199 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jetrmm/rmm-agent/shared"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+// Script output streaming
+const (
+	STREAM_CHUNK_SIZE     = 32 * 1024              // Output is published once this much is buffered
+	STREAM_FLUSH_INTERVAL = 250 * time.Millisecond // or after this delay
+)
+
+type outputContextKey struct{}
+
+// OutputStream publishes the output of a script in ordered chunks while it runs, followed by
+// a final message with the exit code, see shared.ScriptOutput
+type OutputStream struct {
+	conn    *nats.Conn
+	subject string
+	jobID   string
+	codec   Codec
+	logger  *logrus.Logger
+	start   time.Time
+
+	mu      sync.Mutex
+	seq     int
+	pending *shared.ScriptOutput
+	partial map[string][]byte // Incomplete UTF-8 sequence at the end of each stream's output
+	timer   *time.Timer
+	closed  bool
+}
+
+// NewOutputStream returns a stream to the subject requested with the "stream" payload key,
+// or nil if the request does not stream its output
+func NewOutputStream(req *RpcRequest, job *Job) *OutputStream {
+	subject := req.Data["stream"]
+	if len(subject) == 0 {
+		return nil
+	}
+	return &OutputStream{
+		conn:    req.Conn,
+		subject: subject,
+		jobID:   job.ID,
+		codec:   req.codec,
+		logger:  req.Logger,
+		start:   time.Now(),
+	}
+}
+
+// Context returns a context with which RunScriptContext writes the script output to the stream
+func (s *OutputStream) Context(ctx context.Context) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, outputContextKey{}, s)
+}
+
+// Close publishes the remaining output and the final message
+func (s *OutputStream) Close(retcode int, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	// the output ended within a multi-byte character
+	for _, stream := range []string{shared.STREAM_STDOUT, shared.STREAM_STDERR} {
+		if len(s.partial[stream]) > 0 {
+			s.appendLocked(stream, s.partial[stream])
+		}
+	}
+	s.flushLocked()
+	s.closed = true
+
+	final := &shared.ScriptOutput{
+		JobID:    s.jobID,
+		Done:     true,
+		Retcode:  retcode,
+		ExecTime: time.Since(s.start).Seconds(),
+	}
+	if err != nil {
+		final.Error = err.Error()
+	}
+	s.publishLocked(final)
+}
+
+// write adds output of the given stream (stdout, stderr), keeping the chunks in order. An
+// incomplete UTF-8 sequence at the end of p is held back until the rest of it is written, so
+// that a character is not split across chunks.
+func (s *OutputStream) write(stream string, p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+
+	if held := s.partial[stream]; len(held) > 0 {
+		p = append(held, p...)
+		delete(s.partial, stream)
+	}
+	if n := incompleteRune(p); n > 0 {
+		if s.partial == nil {
+			s.partial = make(map[string][]byte)
+		}
+		s.partial[stream] = append([]byte(nil), p[len(p)-n:]...)
+		p = p[:len(p)-n]
+	}
+	if len(p) > 0 {
+		s.appendLocked(stream, p)
+	}
+}
+
+func (s *OutputStream) appendLocked(stream string, p []byte) {
+	if s.pending != nil && s.pending.Stream != stream {
+		s.flushLocked()
+	}
+	if s.pending == nil {
+		s.pending = &shared.ScriptOutput{JobID: s.jobID, Stream: stream}
+	}
+	s.pending.Data += string(p)
+
+	if len(s.pending.Data) >= STREAM_CHUNK_SIZE {
+		s.flushLocked()
+	} else if s.timer == nil {
+		s.timer = time.AfterFunc(STREAM_FLUSH_INTERVAL, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.flushLocked()
+		})
+	}
+}
+
+// incompleteRune returns the length of the incomplete UTF-8 sequence at the end of p, if any
+func incompleteRune(p []byte) int {
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if utf8.FullRune(p[i:]) {
+				return 0
+			}
+			return len(p) - i
+		}
+	}
+	return 0
+}
+
+func (s *OutputStream) flushLocked() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if s.pending == nil || s.closed {
+		return
+	}
+	s.publishLocked(s.pending)
+	s.pending = nil
+}
+
+func (s *OutputStream) publishLocked(out *shared.ScriptOutput) {
+	s.seq++
+	out.Seq = s.seq
+	msg, err := newCodecMsg(s.codec, s.subject, "", out)
+	if err == nil {
+		err = publishMsg(s.conn, msg, "", false)
+	}
+	if err != nil {
+		s.logger.Debugln("Output stream:", err)
+	}
+}
+
+type streamWriter struct {
+	s      *OutputStream
+	stream string
+}
+
+func (w streamWriter) Write(p []byte) (int, error) {
+	w.s.write(w.stream, p)
+	return len(p), nil
+}
+
+// OutputWriters returns the writers of a script's stdout and stderr: the given buffers, and
+// the output stream of ctx if the request streams its output
+func OutputWriters(ctx context.Context, stdout, stderr io.Writer) (io.Writer, io.Writer) {
+	s, ok := ctx.Value(outputContextKey{}).(*OutputStream)
+	if !ok {
+		return stdout, stderr
+	}
+	return io.MultiWriter(stdout, streamWriter{s, shared.STREAM_STDOUT}),
+		io.MultiWriter(stderr, streamWriter{s, shared.STREAM_STDERR})
+}
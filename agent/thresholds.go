@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+// checkState is the reported status of a check with thresholds, and its consecutive results
+type checkState struct {
+	status string
+	fails  int
+	passes int
+}
+
+// HasThresholds reports whether the status of a check is evaluated by the agent
+func HasThresholds(c shared.Check) bool {
+	return c.WarningThreshold != 0 || c.ErrorThreshold != 0
+}
+
+// CheckLevel returns the status of a value against the thresholds of a check, which it reaches
+// when equal. Higher values are worse, unless lowerIsWorse, e.g. for free disk space.
+func CheckLevel(c shared.Check, value float64, lowerIsWorse bool) string {
+	return thresholdLevel(c, func(threshold float64) bool {
+		if lowerIsWorse {
+			return value <= threshold
+		}
+		return value >= threshold
+	})
+}
+
+// CountLevel returns the status of a count against the thresholds of a check, which it must
+// exceed, e.g. a threshold of 5 allows 5 matching lines
+func CountLevel(c shared.Check, count int) string {
+	return thresholdLevel(c, func(threshold float64) bool {
+		return float64(count) > threshold
+	})
+}
+
+// thresholdLevel returns failing or warning if the error or warning threshold of a check, when
+// set, is exceeded, passing otherwise
+func thresholdLevel(c shared.Check, exceeds func(threshold float64) bool) string {
+	switch {
+	case c.ErrorThreshold != 0 && exceeds(c.ErrorThreshold):
+		return shared.CHECK_STATUS_FAILING
+	case c.WarningThreshold != 0 && exceeds(c.WarningThreshold):
+		return shared.CHECK_STATUS_WARNING
+	}
+	return shared.CHECK_STATUS_PASSING
+}
+
+// WorstLevel returns the worst of the given check levels, passing if there are none
+func WorstLevel(levels ...string) string {
+	ret := shared.CHECK_STATUS_PASSING
+	for _, l := range levels {
+		if l == shared.CHECK_STATUS_FAILING {
+			return l
+		} else if l == shared.CHECK_STATUS_WARNING {
+			ret = l
+		}
+	}
+	return ret
+}
+
+// Evaluate returns the status to report for a check given the level of its last run, see
+// CheckLevel and Status, or "" if the check has no thresholds and the server evaluates it.
+func (s *CheckScheduler) Evaluate(c shared.Check, level string) string {
+	if !HasThresholds(c) {
+		return ""
+	}
+	return s.Status(c, level)
+}
+
+// Status returns the status to report for a check evaluated by the agent, given the level of its
+// last run. A passing check only alerts after FailsBeforeAlert consecutive failed runs, and an
+// alerting check only clears after PassesBeforeClear consecutive passed runs, so that a value
+// hovering around a threshold does not flap. Until then, the previous status is reported.
+func (s *CheckScheduler) Status(c shared.Check, level string) string {
+	if s == nil {
+		return level
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.states[c.CheckPK]
+	if !ok {
+		// resume from the status known to the server
+		st = &checkState{status: c.Status}
+		if st.status != shared.CHECK_STATUS_WARNING && st.status != shared.CHECK_STATUS_FAILING {
+			st.status = shared.CHECK_STATUS_PASSING
+		}
+		s.states[c.CheckPK] = st
+	}
+
+	if level == shared.CHECK_STATUS_PASSING {
+		st.fails = 0
+		st.passes++
+		if st.passes >= max(c.PassesBeforeClear, 1) {
+			st.status = level
+		}
+	} else {
+		st.passes = 0
+		st.fails++
+		// once alerting, the status follows the level, e.g. from warning to failing
+		if st.status != shared.CHECK_STATUS_PASSING || st.fails >= max(c.FailsBeforeAlert, 1) {
+			st.status = level
+		}
+	}
+	return st.status
+}
@@ -0,0 +1,138 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jetrmm/rmm-agent/shared"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	passing = shared.CHECK_STATUS_PASSING
+	warning = shared.CHECK_STATUS_WARNING
+	failing = shared.CHECK_STATUS_FAILING
+)
+
+func TestCheckLevel(t *testing.T) {
+	tests := []struct {
+		name         string
+		warn, err    float64
+		value        float64
+		lowerIsWorse bool
+		want         string
+	}{
+		{"no thresholds", 0, 0, 100, false, passing},
+		{"below warning", 80, 90, 79.9, false, passing},
+		{"at warning", 80, 90, 80, false, warning},
+		{"at error", 80, 90, 90, false, failing},
+		{"error only", 0, 90, 85, false, passing},
+		{"above error only", 0, 90, 95, false, failing},
+		{"free above warning", 20, 10, 25, true, passing},
+		{"free at warning", 20, 10, 20, true, warning},
+		{"free below error", 20, 10, 5, true, failing},
+		{"free warning only", 20, 0, 0, true, warning},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := shared.Check{WarningThreshold: tt.warn, ErrorThreshold: tt.err}
+			if got := CheckLevel(c, tt.value, tt.lowerIsWorse); got != tt.want {
+				t.Errorf("CheckLevel(%v) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountLevel(t *testing.T) {
+	c := shared.Check{WarningThreshold: 2, ErrorThreshold: 5}
+	for count, want := range []string{passing, passing, passing, warning, warning, warning, failing} {
+		if got := CountLevel(c, count); got != want {
+			t.Errorf("CountLevel(%d) = %s, want %s", count, got, want)
+		}
+	}
+	if got := CountLevel(shared.Check{}, 100); got != passing {
+		t.Errorf("CountLevel without thresholds = %s, want %s", got, passing)
+	}
+}
+
+func TestWorstLevel(t *testing.T) {
+	tests := []struct {
+		levels []string
+		want   string
+	}{
+		{nil, passing},
+		{[]string{passing, passing}, passing},
+		{[]string{passing, warning}, warning},
+		{[]string{warning, failing, passing}, failing},
+	}
+	for _, tt := range tests {
+		if got := WorstLevel(tt.levels...); got != tt.want {
+			t.Errorf("WorstLevel(%v) = %s, want %s", tt.levels, got, tt.want)
+		}
+	}
+}
+
+func TestCheckSchedulerStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		check  shared.Check
+		levels []string
+		want   []string
+	}{
+		{
+			name:   "alerts at once by default",
+			levels: []string{passing, failing, passing},
+			want:   []string{passing, failing, passing},
+		},
+		{
+			name:   "alerts after FailsBeforeAlert",
+			check:  shared.Check{FailsBeforeAlert: 3},
+			levels: []string{failing, failing, passing, failing, failing, failing},
+			want:   []string{passing, passing, passing, passing, passing, failing},
+		},
+		{
+			name:   "clears after PassesBeforeClear",
+			check:  shared.Check{PassesBeforeClear: 2},
+			levels: []string{failing, passing, failing, passing, passing},
+			want:   []string{failing, failing, failing, failing, passing},
+		},
+		{
+			name:   "follows the level once alerting",
+			check:  shared.Check{FailsBeforeAlert: 2},
+			levels: []string{warning, warning, failing, warning},
+			want:   []string{passing, warning, failing, warning},
+		},
+		{
+			name:   "resumes from the server status",
+			check:  shared.Check{Status: failing, PassesBeforeClear: 2},
+			levels: []string{passing, passing},
+			want:   []string{failing, passing},
+		},
+		{
+			name:   "ignores an unknown server status",
+			check:  shared.Check{Status: "pending", FailsBeforeAlert: 2},
+			levels: []string{failing},
+			want:   []string{passing},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewCheckScheduler(context.Background(), logrus.New(), nil)
+			for i, level := range tt.levels {
+				if got := s.Status(tt.check, level); got != tt.want[i] {
+					t.Errorf("run %d, level %s: status %s, want %s", i+1, level, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCheckSchedulerEvaluate(t *testing.T) {
+	s := NewCheckScheduler(context.Background(), logrus.New(), nil)
+	if got := s.Evaluate(shared.Check{CheckPK: 1}, failing); got != "" {
+		t.Errorf("without thresholds: status %q, want none", got)
+	}
+	if got := s.Evaluate(shared.Check{CheckPK: 2, ErrorThreshold: 90}, failing); got != failing {
+		t.Errorf("with thresholds: status %q, want %s", got, failing)
+	}
+}
@@ -0,0 +1,173 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/nats-io/nats.go"
+	"github.com/oklog/ulid/v2"
+)
+
+// Compression and chunking of large payloads
+const (
+	NATS_HDR_CONTENT_ENCODING = "Content-Encoding"
+	NATS_HDR_ACCEPT_ENCODING  = "Accept-Encoding" // Encodings the server accepts in replies, e.g. "zstd, gzip"
+	NATS_HDR_CHUNK_ID         = "Rmm-Chunk-Id"    // Shared by the chunks of a payload
+	NATS_HDR_CHUNK_INDEX      = "Rmm-Chunk-Index" // From 0
+	NATS_HDR_CHUNK_COUNT      = "Rmm-Chunk-Count"
+	NATS_HDR_ACCEPT_CHUNKS    = "Rmm-Accept-Chunks" // Set by requesters which join chunked replies
+
+	ENCODING_ZSTD = "zstd"
+	ENCODING_GZIP = "gzip"
+
+	COMPRESS_MIN_SIZE    = 16 * 1024   // Smaller payloads are sent uncompressed
+	CHUNK_HEADER_ROOM    = 1024        // Room left below max_payload for the headers of each chunk
+	NATS_MAX_PAYLOAD_DEF = 1024 * 1024 // Used while the server's max_payload is unknown
+	DECOMPRESS_MAX_SIZE  = 64 << 20    // Larger decoded payloads are rejected
+)
+
+// Encodings are the supported content encodings, in order of preference
+var Encodings = []string{ENCODING_ZSTD, ENCODING_GZIP}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(DECOMPRESS_MAX_SIZE))
+)
+
+// ErrPayloadTooLarge is returned when a message exceeds the server's max_payload and is not
+// to be split into chunks
+var ErrPayloadTooLarge = errors.New("payload exceeds the server's max_payload")
+
+// checkEncoding returns an error if the content encoding is not supported; empty means none
+func checkEncoding(encoding string) error {
+	switch encoding {
+	case "", ENCODING_ZSTD, ENCODING_GZIP:
+		return nil
+	}
+	return fmt.Errorf("unsupported content encoding %q", encoding)
+}
+
+// acceptEncoding returns the preferred supported encoding of an Accept-Encoding header, if any
+func acceptEncoding(header string) string {
+	accepted := make(map[string]bool)
+	for _, e := range strings.Split(header, ",") {
+		e, _, _ = strings.Cut(e, ";")
+		accepted[strings.ToLower(strings.TrimSpace(e))] = true
+	}
+	for _, e := range Encodings {
+		if accepted[e] {
+			return e
+		}
+	}
+	return ""
+}
+
+// compress encodes data with a content encoding
+func compress(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case ENCODING_ZSTD:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case ENCODING_GZIP:
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+	return nil, checkEncoding(encoding)
+}
+
+// decompress decodes data of a content encoding, up to DECOMPRESS_MAX_SIZE
+func decompress(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case "":
+		return data, nil
+	case ENCODING_ZSTD:
+		return zstdDecoder.DecodeAll(data, nil)
+	case ENCODING_GZIP:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		ret, err := io.ReadAll(io.LimitReader(r, DECOMPRESS_MAX_SIZE+1))
+		if err == nil && len(ret) > DECOMPRESS_MAX_SIZE {
+			err = fmt.Errorf("decompressed payload exceeds %d bytes", DECOMPRESS_MAX_SIZE)
+		}
+		return ret, err
+	}
+	return nil, checkEncoding(encoding)
+}
+
+// decompressMsg replaces the data of a message sent with a Content-Encoding header by its decoded content
+func decompressMsg(msg *nats.Msg) error {
+	if msg.Header == nil {
+		return nil
+	}
+	encoding := msg.Header.Get(NATS_HDR_CONTENT_ENCODING)
+	if len(encoding) == 0 {
+		return nil
+	}
+	data, err := decompress(encoding, msg.Data)
+	if err != nil {
+		return err
+	}
+	msg.Data = data
+	msg.Header.Del(NATS_HDR_CONTENT_ENCODING)
+	return nil
+}
+
+// publishMsg publishes a message, compressed with encoding if it is larger than COMPRESS_MIN_SIZE.
+// If it still exceeds the server's max_payload, it is split into chunks if chunked is set, and
+// ErrPayloadTooLarge is returned otherwise. The receiver joins the chunks of the same Rmm-Chunk-Id
+// in Rmm-Chunk-Index order, then decodes the Content-Encoding.
+func publishMsg(nc *nats.Conn, msg *nats.Msg, encoding string, chunked bool) error {
+	if len(encoding) > 0 && len(msg.Data) >= COMPRESS_MIN_SIZE {
+		data, err := compress(encoding, msg.Data)
+		if err != nil {
+			return err
+		}
+		msg.Data = data
+		msg.Header.Set(NATS_HDR_CONTENT_ENCODING, encoding)
+	}
+
+	max := int(nc.MaxPayload())
+	if max <= 0 {
+		max = NATS_MAX_PAYLOAD_DEF
+	}
+	max -= CHUNK_HEADER_ROOM
+	if len(msg.Data) <= max {
+		return nc.PublishMsg(msg)
+	}
+	if !chunked {
+		return fmt.Errorf("%w: %d bytes", ErrPayloadTooLarge, len(msg.Data))
+	}
+
+	id := ulid.Make().String()
+	count := (len(msg.Data) + max - 1) / max
+	for i := 0; i < count; i++ {
+		chunk := nats.NewMsg(msg.Subject)
+		chunk.Reply = msg.Reply
+		for k, v := range msg.Header {
+			chunk.Header[k] = v
+		}
+		chunk.Header.Set(NATS_HDR_CHUNK_ID, id)
+		chunk.Header.Set(NATS_HDR_CHUNK_INDEX, strconv.Itoa(i))
+		chunk.Header.Set(NATS_HDR_CHUNK_COUNT, strconv.Itoa(count))
+		chunk.Data = msg.Data[i*max : min((i+1)*max, len(msg.Data))]
+		if err := nc.PublishMsg(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAcceptEncoding(t *testing.T) {
+	tests := []struct {
+		header, want string
+	}{
+		{"", ""},
+		{"zstd", ENCODING_ZSTD},
+		{"gzip", ENCODING_GZIP},
+		{"gzip, zstd", ENCODING_ZSTD},
+		{" GZIP ;q=0.5 , br", ENCODING_GZIP},
+		{"br, deflate", ""},
+		{"identity", ""},
+	}
+	for _, tt := range tests {
+		if got := acceptEncoding(tt.header); got != tt.want {
+			t.Errorf("acceptEncoding(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	data := bytes.Repeat([]byte("check result "), 4096)
+	for _, encoding := range Encodings {
+		compressed, err := compress(encoding, data)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		if len(compressed) >= len(data) {
+			t.Errorf("%s: compressed to %d bytes, from %d", encoding, len(compressed), len(data))
+		}
+		got, err := decompress(encoding, compressed)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: decompressed %d bytes, %v, want %d", encoding, len(got), err, len(data))
+		}
+	}
+	if got, err := decompress("", data); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("no encoding: got %d bytes, %v, want %d", len(got), err, len(data))
+	}
+
+	if _, err := compress("br", data); err == nil {
+		t.Error("br: no error")
+	}
+	if _, err := decompress("br", data); err == nil {
+		t.Error("br: no error")
+	}
+}
+
+func TestDecompressMaxSize(t *testing.T) {
+	data := make([]byte, DECOMPRESS_MAX_SIZE+1)
+	for _, encoding := range Encodings {
+		compressed, err := compress(encoding, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := decompress(encoding, compressed); err == nil {
+			t.Errorf("%s: no error above %d bytes", encoding, DECOMPRESS_MAX_SIZE)
+		}
+	}
+}
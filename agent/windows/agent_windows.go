@@ -28,7 +28,6 @@ import (
 	"github.com/shirou/gopsutil/v3/disk"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/windows"
-	"golang.org/x/sys/windows/registry"
 )
 
 var (
@@ -40,8 +39,6 @@ const (
 	INNO_SETUP_DIR     = "rmmagent"
 	INNO_SETUP_LOGFILE = "rmmagent.txt"
 	AGENT_MODE_COMMAND = "command"
-
-	API_URL_SOFTWARE = "/api/v3/software/"
 )
 
 func init() {
@@ -53,114 +50,33 @@ type windowsAgent struct {
 }
 
 func NewAgent(logger *logrus.Logger, version string, isAdmin bool) agent.IAgent {
-	regKeys := WinRegKeys{
-		baseUrl:  "",
-		agentId:  "",
-		apiUrl:   "",
-		token:    "",
-		agentPK:  "",
-		pk:       0,
-		rootCert: "",
-	}
-
-	headers := make(map[string]string)
-	restyC := resty.New()
-
-	if isAdmin {
-		regKeys, err := getRegKeys(logger)
-		if err != nil {
-			fmt.Println("Unable to retrieve registry keys (agent not installed?)", err)
-			logger.Debugln("Unable to retrieve registry keys (agent not installed?)")
-		} else {
-			if len(regKeys.token) > 0 {
-				headers["Content-Type"] = "application/json"
-				headers["Authorization"] = fmt.Sprintf("Token %s", regKeys.token)
-			}
-			restyC.SetBaseURL(regKeys.baseUrl)
-			restyC.SetCloseConnection(true)
-			restyC.SetHeaders(headers)
-			restyC.SetTimeout(15 * time.Second)
-			restyC.SetDebug(logger.IsLevelEnabled(logrus.DebugLevel))
-			if len(regKeys.rootCert) > 0 {
-				restyC.SetRootCertificate(regKeys.rootCert)
-			}
-		}
-	}
-
-	return &windowsAgent{
+	wa := &windowsAgent{
 		Agent: agent.Agent{
-			AgentConfig: &agent.AgentConfig{
-				AgentID: regKeys.agentId,
-				BaseURL: regKeys.baseUrl,
-				ApiURL:  regKeys.apiUrl,
-				ApiPort: agent.NATS_DEFAULT_PORT,
-				Token:   regKeys.token,
-				AgentPK: regKeys.pk,
-				Cert:    regKeys.rootCert,
-				Version: version,
-				Debug:   logger.IsLevelEnabled(logrus.DebugLevel),
-				Headers: headers,
-			},
-			Logger:  logger,
-			RClient: restyC,
+			Logger: logger,
 		},
 	}
-}
+	wa.IAgent = wa
 
-// New Initializes a new windowsAgent with logger
-func (a *windowsAgent) New(logger *logrus.Logger, version string, isAdmin bool) *windowsAgent {
-	regKeys := WinRegKeys{
-		baseUrl:  "",
-		agentId:  "",
-		apiUrl:   "",
-		token:    "",
-		agentPK:  "",
-		pk:       0,
-		rootCert: "",
+	store := agent.NewEnvConfigStore(&registryConfigStore{})
+	if !isAdmin {
+		store = agent.NewEnvConfigStore(nil)
+	}
+	if err := wa.LoadConfig(store, version); err != nil {
+		fmt.Println("Unable to retrieve registry keys (agent not installed?)", err)
+		logger.Debugln("Unable to retrieve registry keys (agent not installed?)")
 	}
 
-	headers := make(map[string]string)
-	restyC := resty.New()
-
+	wa.registerRpcHandlers()
+	wa.registerChecks()
 	if isAdmin {
-		regKeys, err := getRegKeys(logger)
-		if err != nil {
-			fmt.Println("Unable to retrieve registry keys (agent not installed?)", err)
-			logger.Debugln("Unable to retrieve registry keys (agent not installed?)")
-		} else {
-			if len(regKeys.token) > 0 {
-				headers["Content-Type"] = "application/json"
-				headers["Authorization"] = fmt.Sprintf("Token %s", regKeys.token)
-			}
-			restyC.SetBaseURL(regKeys.baseUrl)
-			restyC.SetCloseConnection(true)
-			restyC.SetHeaders(headers)
-			restyC.SetTimeout(15 * time.Second)
-			restyC.SetDebug(logger.IsLevelEnabled(logrus.DebugLevel))
-			if len(regKeys.rootCert) > 0 {
-				restyC.SetRootCertificate(regKeys.rootCert)
-			}
-		}
+		wa.SetupDataDir(filepath.Join(os.Getenv("ProgramData"), AGENT_FOLDER))
 	}
+	return wa
+}
 
-	return &windowsAgent{
-		Agent: agent.Agent{
-			AgentConfig: &agent.AgentConfig{
-				AgentID: regKeys.agentId,
-				BaseURL: regKeys.baseUrl,
-				ApiURL:  regKeys.apiUrl,
-				ApiPort: agent.NATS_DEFAULT_PORT,
-				Token:   regKeys.token,
-				AgentPK: regKeys.pk,
-				Cert:    regKeys.rootCert,
-				Version: version,
-				Debug:   logger.IsLevelEnabled(logrus.DebugLevel),
-				Headers: headers,
-			},
-			Logger:  logger,
-			RClient: restyC,
-		},
-	}
+// New Initializes a new windowsAgent with logger
+func (a *windowsAgent) New(logger *logrus.Logger, version string, isAdmin bool) *windowsAgent {
+	return NewAgent(logger, version, isAdmin).(*windowsAgent)
 }
 
 // OSInfo returns formatted OS names
@@ -341,7 +257,13 @@ func InterpretCommand(interpreter string, args []string, command string, timeout
 
 // runExe runs a binary without a shell
 func runExe(exe string, args []string, timeout int, detached bool) (output [2]string, e error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	return runExeContext(context.Background(), exe, args, timeout, detached)
+}
+
+// runExeContext runs exe until it exits, times out or ctx is done; with the context of a job,
+// the process is killed along with its children if the job is cancelled
+func runExeContext(parent context.Context, exe string, args []string, timeout int, detached bool) (output [2]string, e error) {
+	ctx, cancel := context.WithTimeout(parent, time.Duration(timeout)*time.Second)
 	defer cancel()
 
 	var outb, errb bytes.Buffer
@@ -353,13 +275,18 @@ func runExe(exe string, args []string, timeout int, detached bool) (output [2]st
 	}
 	cmd.Stdout = &outb
 	cmd.Stderr = &errb
-	err := cmd.Run()
-	if err != nil {
-		return [2]string{"", ""}, fmt.Errorf("%s: %s", err, errb.String())
+	err := cmd.Start()
+	if err == nil {
+		remove := agent.AddJobProcess(parent, int32(cmd.Process.Pid))
+		err = cmd.Wait()
+		remove()
 	}
-
+	// a killed command fails too, so the timeout is checked first
 	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
-		return [2]string{"", ""}, ctx.Err()
+		return [2]string{"", ""}, fmt.Errorf("%s timed out after %d seconds: %w", exe, timeout, ctx.Err())
+	}
+	if err != nil {
+		return [2]string{"", ""}, fmt.Errorf("%s: %s", err, errb.String())
 	}
 
 	return [2]string{outb.String(), errb.String()}, nil
@@ -469,14 +396,14 @@ func (a *windowsAgent) SendSoftware() {
 		"software": sw,
 	}
 
-	_, err := a.RClient.R().SetBody(payload).Post(API_URL_SOFTWARE)
+	_, err := a.RClient.R().SetBody(payload).Post(agent.API_URL_SOFTWARE)
 	if err != nil {
 		a.Logger.Debugln(err)
 	}
 }
 
 func (a *windowsAgent) UninstallCleanup() {
-	err := registry.DeleteKey(registry.LOCAL_MACHINE, REG_RMM_PATH)
+	err := a.Store.Delete()
 	if err != nil {
 		return
 	}
@@ -0,0 +1,163 @@
+package windows
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/jetrmm/go-dpapi"
+	"github.com/jetrmm/rmm-agent/agent"
+	"golang.org/x/sys/windows/registry"
+)
+
+// registryConfigStore keeps the agent configuration under HKLM\SOFTWARE\RMMAgent.
+// The Token and NKey seed are protected with DPAPI (machine-local).
+type registryConfigStore struct{}
+
+func (s *registryConfigStore) Load() (*agent.AgentConfig, error) {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, REG_RMM_PATH, registry.READ)
+	if errors.Is(err, registry.ErrNotExist) {
+		return nil, agent.ErrConfigNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	defer key.Close()
+
+	values := make(map[string]string)
+	for _, name := range []string{REG_RMM_BASEURL, REG_RMM_AGENTID, REG_RMM_APIURL, REG_RMM_TOKEN, REG_RMM_AGENTPK} {
+		v, _, err := key.GetStringValue(name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get %s: %w", name, err)
+		}
+		values[name] = v
+	}
+
+	token, err := dpapi.Decrypt(values[REG_RMM_TOKEN])
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt Token: %w", err)
+	}
+
+	pk, _ := strconv.Atoi(values[REG_RMM_AGENTPK])
+	rootCert, _, _ := key.GetStringValue(REG_RMM_CERT)
+	credsFile, _, _ := key.GetStringValue(REG_RMM_CREDS)
+	jetStream, _, _ := key.GetStringValue(REG_RMM_JS)
+	legacy, _, _ := key.GetStringValue(REG_RMM_LEGACY)
+	rpcMax, _, _ := key.GetStringValue(REG_RMM_RPCMAX)
+	rpcWait, _, _ := key.GetStringValue(REG_RMM_RPCWAIT)
+	rpcLimits, _, _ := key.GetStringValue(REG_RMM_RPCLIM)
+	compression, _, _ := key.GetStringValue(REG_RMM_COMPRES)
+	codec, _, _ := key.GetStringValue(REG_RMM_CODEC)
+	apiPort, _, _ := key.GetStringValue(REG_RMM_APIPORT)
+
+	var nkeySeed string
+	if v, _, err := key.GetStringValue(REG_RMM_NKEY); err == nil && len(v) > 0 {
+		if nkeySeed, err = dpapi.Decrypt(v); err != nil {
+			return nil, fmt.Errorf("unable to decrypt NKey seed: %w", err)
+		}
+	}
+
+	limits, err := agent.ParseRpcLimits(rpcLimits)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", REG_RMM_RPCLIM, err)
+	}
+	maxConc, _ := strconv.Atoi(rpcMax)
+	queueTime, _ := strconv.Atoi(rpcWait)
+	port, _ := strconv.Atoi(apiPort)
+	if port == 0 {
+		// installed before the port was configurable
+		port = agent.NATS_DEFAULT_PORT
+	}
+
+	return &agent.AgentConfig{
+		Schema:        agent.CONFIG_SCHEMA_VERSION,
+		AgentID:       values[REG_RMM_AGENTID],
+		AgentPK:       pk,
+		BaseURL:       values[REG_RMM_BASEURL],
+		ApiURL:        values[REG_RMM_APIURL],
+		ApiPort:       port,
+		Token:         token,
+		Cert:          rootCert,
+		NKeySeed:      nkeySeed,
+		CredsFile:     credsFile,
+		JetStream:     jetStream == "1",
+		LegacyReplies: legacy == "1",
+		RpcMaxConc:    maxConc,
+		RpcQueueTime:  queueTime,
+		RpcLimits:     limits,
+		Codec:         codec,
+		Compression:   compression,
+	}, nil
+}
+
+func (s *registryConfigStore) Save(cfg *agent.AgentConfig) error {
+	key, _, err := registry.CreateKey(registry.LOCAL_MACHINE, REG_RMM_PATH, registry.ALL_ACCESS)
+	if err != nil {
+		return fmt.Errorf("error creating registry key: %w", err)
+	}
+	defer key.Close()
+
+	token, err := dpapi.EncryptMachineLocal(cfg.Token)
+	if err != nil {
+		return fmt.Errorf("unable to encrypt Token: %w", err)
+	}
+
+	values := map[string]string{
+		REG_RMM_BASEURL: cfg.BaseURL,
+		REG_RMM_AGENTID: cfg.AgentID,
+		REG_RMM_APIURL:  cfg.ApiURL,
+		REG_RMM_TOKEN:   token,
+		REG_RMM_AGENTPK: strconv.Itoa(cfg.AgentPK),
+	}
+	if len(cfg.Cert) > 0 {
+		values[REG_RMM_CERT] = cfg.Cert
+	}
+	if len(cfg.CredsFile) > 0 {
+		values[REG_RMM_CREDS] = cfg.CredsFile
+	}
+	if cfg.JetStream {
+		values[REG_RMM_JS] = "1"
+	}
+	if cfg.LegacyReplies {
+		values[REG_RMM_LEGACY] = "1"
+	}
+	if cfg.RpcMaxConc > 0 {
+		values[REG_RMM_RPCMAX] = strconv.Itoa(cfg.RpcMaxConc)
+	}
+	if cfg.RpcQueueTime > 0 {
+		values[REG_RMM_RPCWAIT] = strconv.Itoa(cfg.RpcQueueTime)
+	}
+	if len(cfg.RpcLimits) > 0 {
+		values[REG_RMM_RPCLIM] = agent.FormatRpcLimits(cfg.RpcLimits)
+	}
+	if cfg.ApiPort > 0 {
+		values[REG_RMM_APIPORT] = strconv.Itoa(cfg.ApiPort)
+	}
+	if len(cfg.Codec) > 0 {
+		values[REG_RMM_CODEC] = cfg.Codec
+	}
+	if len(cfg.Compression) > 0 {
+		values[REG_RMM_COMPRES] = cfg.Compression
+	}
+	if len(cfg.NKeySeed) > 0 {
+		seed, err := dpapi.EncryptMachineLocal(cfg.NKeySeed)
+		if err != nil {
+			return fmt.Errorf("unable to encrypt NKey seed: %w", err)
+		}
+		values[REG_RMM_NKEY] = seed
+	}
+
+	for name, v := range values {
+		if err := key.SetStringValue(name, v); err != nil {
+			return fmt.Errorf("error creating %s registry key: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (s *registryConfigStore) Delete() error {
+	err := registry.DeleteKey(registry.LOCAL_MACHINE, REG_RMM_PATH)
+	if errors.Is(err, registry.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -15,8 +15,18 @@ const (
 	REG_RMM_AGENTID = "AgentID"
 	REG_RMM_AGENTPK = "AgentPK"
 	REG_RMM_APIURL  = "ApiURL"
+	REG_RMM_APIPORT = "ApiPort"
 	REG_RMM_TOKEN   = "Token"
 	REG_RMM_CERT    = "RootCert"
+	REG_RMM_NKEY    = "NKeySeed"
+	REG_RMM_CREDS   = "CredsFile"
+	REG_RMM_JS      = "JetStream"
+	REG_RMM_LEGACY  = "LegacyReplies"
+	REG_RMM_RPCMAX  = "RpcMaxConcurrent"
+	REG_RMM_RPCWAIT = "RpcQueueTimeout"
+	REG_RMM_RPCLIM  = "RpcLimits"
+	REG_RMM_COMPRES = "Compression"
+	REG_RMM_CODEC   = "Codec"
 
 	AGENT_FOLDER      = "RMMAgent"
 	RMM_SEARCH_PREFIX = "acmermm*"
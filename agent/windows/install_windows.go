@@ -2,16 +2,12 @@ package windows
 
 import (
 	"fmt"
-	"github.com/jetrmm/go-dpapi"
 	"github.com/jetrmm/rmm-agent/agent"
 	"github.com/kardianos/service"
-	"github.com/sirupsen/logrus"
-	"log"
 	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
-	"strconv"
 	"strings"
 	"time"
 
@@ -21,16 +17,6 @@ import (
 	"golang.org/x/sys/windows/registry"
 )
 
-type WinRegKeys struct {
-	baseUrl  string
-	agentId  string
-	apiUrl   string
-	token    string
-	agentPK  string
-	pk       int // int(agentPK)
-	rootCert string
-}
-
 func (a *windowsAgent) Install(i *agent.InstallInfo, agentID string) {
 	a.checkExistingAndRemove(i.Silent)
 
@@ -65,10 +51,13 @@ func (a *windowsAgent) Install(i *agent.InstallInfo, agentID string) {
 	a.Logger.Debugln("Agent API Endpoint:", i.ApiURL)
 
 	// todo: port 443 and/or 4222
-	terr := agent.TestTCP(fmt.Sprintf("%s:4222", i.ApiURL))
+	if i.NatsPort == 0 {
+		i.NatsPort = agent.NATS_DEFAULT_PORT
+	}
+	terr := agent.TestTCP(fmt.Sprintf("%s:%d", i.ApiURL, i.NatsPort))
 	if terr != nil {
-		a.installerMsg(fmt.Sprintf("ERROR: Either port %s TCP is not open on your RMM server, or the NATS service is not running.\n\n%s",
-			agent.NATS_DEFAULT_PORT, terr.Error()), "error", i.Silent)
+		a.installerMsg(fmt.Sprintf("ERROR: Either port %d TCP is not open on your RMM server, or the NATS service is not running.\n\n%s",
+			i.NatsPort, terr.Error()), "error", i.Silent)
 	}
 
 	baseURL := parsedUrl.Scheme + "://" + parsedUrl.Host
@@ -111,6 +100,10 @@ func (a *windowsAgent) Install(i *agent.InstallInfo, agentID string) {
 		rClient.SetRootCertificate(i.RootCert)
 	}
 
+	if len(i.CredsFile) > 0 && !agent.FileExists(i.CredsFile) {
+		a.installerMsg(fmt.Sprintf("%s does not exist", i.CredsFile), "error", i.Silent)
+	}
+
 	a.Logger.Infoln("Adding agent to the dashboard")
 
 	type NewAgentResp struct {
@@ -127,6 +120,17 @@ func (a *windowsAgent) Install(i *agent.InstallInfo, agentID string) {
 		// -sg: "monitoring_type": i.AgentType,
 	}
 
+	// authenticate with NATS using a per-agent NKey unless JWT credentials were provided
+	var nkeySeed string
+	if len(i.CredsFile) == 0 {
+		seed, pub, err := agent.GenerateNKey()
+		if err != nil {
+			a.installerMsg(fmt.Sprintf("Unable to generate the agent NKey: %s", err), "error", i.Silent)
+		}
+		nkeySeed = seed
+		agentPayload["nkey"] = pub
+	}
+
 	r, err := rClient.R().SetBody(agentPayload).SetResult(&NewAgentResp{}).Post(fmt.Sprintf("%s/api/v3/newagent/", baseURL))
 	if err != nil {
 		a.installerMsg(err.Error(), "error", i.Silent)
@@ -141,12 +145,25 @@ func (a *windowsAgent) Install(i *agent.InstallInfo, agentID string) {
 	// a.Logger.Debugln("Agent Token:", authToken)
 	a.Logger.Debugln("Agent PK:", agentPK)
 
-	createRegKeys(baseURL, a.AgentID, i.ApiURL, authToken, strconv.Itoa(agentPK), i.RootCert)
+	err = a.Store.Save(&agent.AgentConfig{
+		AgentID:   a.AgentID,
+		AgentPK:   agentPK,
+		BaseURL:   baseURL,
+		ApiURL:    i.ApiURL,
+		ApiPort:   i.NatsPort,
+		Token:     authToken,
+		Cert:      i.RootCert,
+		NKeySeed:  nkeySeed,
+		CredsFile: i.CredsFile,
+	})
+	if err != nil {
+		a.installerMsg(err.Error(), "error", i.Silent)
+	}
 
 	// Refresh our agent with new values
-	a = a.New(a.Logger, a.Version, true)
-	// todo:
-	// a = NewAgent(a.Logger, a.Version)
+	if err := a.LoadConfig(a.Store, a.Version); err != nil {
+		a.installerMsg(err.Error(), "error", i.Silent)
+	}
 
 	// Set new headers. No longer knox auth; use agent auth
 	rClient.SetHeaders(a.Headers)
@@ -156,14 +173,16 @@ func (a *windowsAgent) Install(i *agent.InstallInfo, agentID string) {
 	a.SysInfo()
 
 	// Check in once via NATS
-	opts := a.SetupNatsOptions()
 	server := fmt.Sprintf("tls://%s:%d", a.ApiURL, a.ApiPort)
-
-	nc, err := nats.Connect(server, opts...)
+	var nc *nats.Conn
+	opts, err := a.SetupNatsOptions()
+	if err == nil {
+		nc, err = nats.Connect(server, opts...)
+	}
 	if err != nil {
 		a.Logger.Errorln(err)
 	} else {
-		startup := []string{CHECKIN_MODE_HELLO, CHECKIN_MODE_OSINFO, CHECKIN_MODE_WINSERVICES, CHECKIN_MODE_DISKS, CHECKIN_MODE_PUBLICIP, CHECKIN_MODE_SOFTWARE, CHECKIN_MODE_LOGGEDONUSER}
+		startup := []string{agent.CHECKIN_MODE_HELLO, agent.CHECKIN_MODE_OSINFO, agent.CHECKIN_MODE_WINSERVICES, agent.CHECKIN_MODE_DISKS, agent.CHECKIN_MODE_PUBLICIP, agent.CHECKIN_MODE_SOFTWARE, agent.CHECKIN_MODE_LOGGEDONUSER}
 		for _, mode := range startup {
 			a.CheckIn(nc, mode)
 			time.Sleep(200 * time.Millisecond)
@@ -174,10 +193,11 @@ func (a *windowsAgent) Install(i *agent.InstallInfo, agentID string) {
 	a.Logger.Debugln("Creating temporary directory")
 	a.CreateAgentTempDir()
 
-	a.Logger.Infoln("Installing service...")
-	serr := a.InstallService()
-	if serr != nil {
-		return
+	if !i.NoService {
+		a.Logger.Infoln("Installing service...")
+		if err := a.InstallService(); err != nil {
+			return
+		}
 	}
 
 	a.installerMsg("Installation was successful!\nPlease allow a few minutes for the agent to show up in the RMM server", "info", i.Silent)
@@ -222,102 +242,6 @@ func (a *windowsAgent) checkExistingAndRemove(silent bool) {
 	}
 }
 
-func createRegKeys(baseUrl, agentId, apiUrl, token, agentPK, rootCert string) {
-	key, _, err := registry.CreateKey(registry.LOCAL_MACHINE, REG_RMM_PATH, registry.ALL_ACCESS)
-	if err != nil {
-		log.Fatalln("Error creating registry key:", err)
-	}
-	defer key.Close()
-
-	err = key.SetStringValue(REG_RMM_BASEURL, baseUrl)
-	if err != nil {
-		log.Fatalln("Error creating BaseURL registry key:", err)
-	}
-
-	err = key.SetStringValue(REG_RMM_AGENTID, agentId)
-	if err != nil {
-		log.Fatalln("Error creating AgentID registry key:", err)
-	}
-
-	err = key.SetStringValue(REG_RMM_APIURL, apiUrl)
-	if err != nil {
-		log.Fatalln("Error creating ApiURL registry key:", err)
-	}
-
-	token, err = dpapi.EncryptMachineLocal(token)
-	if err != nil {
-		log.Fatalln("Unable to encrypt Token:", err)
-	}
-
-	err = key.SetStringValue(REG_RMM_TOKEN, token)
-	if err != nil {
-		log.Fatalln("Error creating Token registry key:", err)
-	}
-
-	err = key.SetStringValue(REG_RMM_AGENTPK, agentPK)
-	if err != nil {
-		log.Fatalln("Error creating AgentPK registry key:", err)
-	}
-
-	if len(rootCert) > 0 {
-		err = key.SetStringValue(REG_RMM_CERT, rootCert)
-		if err != nil {
-			log.Fatalln("Error creating RootCert registry key:", err)
-		}
-	}
-}
-
-func getRegKeys(logger *logrus.Logger) (*WinRegKeys, error) {
-	key, err := registry.OpenKey(registry.LOCAL_MACHINE, REG_RMM_PATH, registry.READ)
-	if err != nil {
-		return nil, err
-	}
-
-	baseUrl, _, err := key.GetStringValue(REG_RMM_BASEURL)
-	if err != nil {
-		logger.Fatalln("Unable to get BaseURL:", err)
-	}
-
-	agentId, _, err := key.GetStringValue(REG_RMM_AGENTID)
-	if err != nil {
-		logger.Fatalln("Unable to get AgentID:", err)
-	}
-
-	apiUrl, _, err := key.GetStringValue(REG_RMM_APIURL)
-	if err != nil {
-		logger.Fatalln("Unable to get ApiURL:", err)
-	}
-
-	token, _, err := key.GetStringValue(REG_RMM_TOKEN)
-	if err != nil {
-		logger.Fatalln("Unable to get Token:", err)
-	}
-
-	token, err = dpapi.Decrypt(token)
-	if err != nil {
-		logger.Fatalln("Unable to decrypt Token:", err)
-	}
-
-	agentPK, _, err := key.GetStringValue(REG_RMM_AGENTPK)
-	if err != nil {
-		logger.Fatalln("Unable to get AgentPK:", err)
-	}
-
-	pk, _ := strconv.Atoi(agentPK)
-
-	rootCert, _, _ := key.GetStringValue(REG_RMM_CERT)
-
-	return &WinRegKeys{
-		baseUrl:  baseUrl,
-		agentId:  agentId,
-		apiUrl:   apiUrl,
-		token:    token,
-		agentPK:  agentPK,
-		pk:       pk,
-		rootCert: rootCert,
-	}, nil
-}
-
 func (a *windowsAgent) installerMsg(msg, alert string, silent bool) {
 	window := w32.GetForegroundWindow()
 	if !silent && window != 0 {
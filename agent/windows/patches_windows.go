@@ -1,6 +1,7 @@
 package windows
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -34,7 +35,8 @@ func (a *windowsAgent) GetWinUpdates() {
 	}
 }
 
-func (a *windowsAgent) InstallUpdates(guids []string) {
+// InstallUpdates installs the given updates, stopping before the next one if ctx is cancelled
+func (a *windowsAgent) InstallUpdates(ctx context.Context, guids []string) {
 	session, err := NewUpdateSession()
 	if err != nil {
 		a.Logger.Errorln(err)
@@ -43,6 +45,11 @@ func (a *windowsAgent) InstallUpdates(guids []string) {
 	defer session.Close()
 
 	for _, id := range guids {
+		if ctx.Err() != nil {
+			a.Logger.Infoln("Windows Updates installation cancelled")
+			break
+		}
+
 		var result rmm.WinUpdateInstallResult
 		result.AgentID = a.AgentID
 		result.UpdateID = id
@@ -1,6 +1,7 @@
 package windows
 
 import (
+	"context"
 	"time"
 
 	"github.com/go-resty/resty/v2"
@@ -23,10 +24,15 @@ func (a *windowsAgent) RemovePkgMgr(pkgMgr string) {
 
 }
 
+// PkgManagers returns the package managers supported by InstallPackage; Chocolatey is installed on demand
+func (a *windowsAgent) PkgManagers() []string {
+	return []string{"choco"}
+}
+
 func (a *windowsAgent) InstallPackage(pkgMgr string, pkgName string) (string, error) {
 	switch pkgMgr {
 	case "choco":
-		return a.installWithChoco(pkgName)
+		return a.installWithChoco(a.Context(), pkgName)
 	case "scoop":
 	case "winget":
 	}
@@ -37,7 +43,7 @@ func (a *windowsAgent) InstallPackage(pkgMgr string, pkgName string) (string, er
 func (a *windowsAgent) RemovePackage(pkgMgr string, pkgName string) (string, error) {
 	switch pkgMgr {
 	case "choco":
-		return a.installWithChoco(pkgName)
+		return a.installWithChoco(a.Context(), pkgName)
 	case "scoop":
 	case "winget":
 	}
@@ -48,7 +54,7 @@ func (a *windowsAgent) RemovePackage(pkgMgr string, pkgName string) (string, err
 func (a *windowsAgent) UpdatePackage(pkgMgr string, pkgName string) (string, error) {
 	switch pkgMgr {
 	case "choco":
-		return a.installWithChoco(pkgName)
+		return a.installWithChoco(a.Context(), pkgName)
 	case "scoop":
 	case "winget":
 	}
@@ -96,8 +102,8 @@ func (a *windowsAgent) installChoco() {
 }
 
 // installWithChoco install an application with Chocolatey
-func (a *windowsAgent) installWithChoco(name string) (string, error) {
-	out, err := runExe("choco.exe", []string{"install", name, "--yes", "--force", "--force-dependencies"}, 1200, false)
+func (a *windowsAgent) installWithChoco(ctx context.Context, name string) (string, error) {
+	out, err := runExeContext(ctx, "choco.exe", []string{"install", name, "--yes", "--force", "--force-dependencies"}, 1200, false)
 	if err != nil {
 		a.Logger.Errorln(err)
 		return err.Error(), err
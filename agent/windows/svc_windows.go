@@ -1,8 +1,9 @@
 package windows
 
 import (
-	"github.com/ugorji/go/codec"
+	"github.com/jetrmm/rmm-agent/agent"
 	"math/rand"
+	"net/http"
 	"sync"
 	"time"
 
@@ -11,32 +12,17 @@ import (
 	"github.com/nats-io/nats.go"
 )
 
-const (
-	API_URL_CHECKIN = "/api/v3/checkin/"
-
-	CHECKIN_MODE_DISKS        = "disks"
-	CHECKIN_MODE_HELLO        = "hello"
-	CHECKIN_MODE_LOGGEDONUSER = "loggedonuser"
-	CHECKIN_MODE_OSINFO       = "osinfo"
-	CHECKIN_MODE_PUBLICIP     = "publicip"
-	CHECKIN_MODE_SOFTWARE     = "software"
-	CHECKIN_MODE_STARTUP      = "startup"
-	CHECKIN_MODE_WINSERVICES  = "winservices"
-
-	// todo: move these:
-	NATS_MODE_DISKS       = "agent-disks"
-	NATS_MODE_HELLO       = "agent-hello"
-	NATS_MODE_OSINFO      = "agent-agentinfo"
-	NATS_MODE_PUBLICIP    = "agent-publicip"
-	NATS_MODE_WINSERVICES = "agent-winsvc"
-	NATS_MODE_SYSINFO     = "agent-sysinfo" // was "agent-wmi"
-)
-
 func (a *windowsAgent) RunAgentService(nc *nats.Conn) {
 	var wg sync.WaitGroup
-	wg.Add(1)
-	go a.WinAgentSvc(nc)
-	go a.CheckRunner()
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		a.WinAgentSvc(nc)
+	}()
+	go func() {
+		defer wg.Done()
+		a.CheckRunner()
+	}()
 	wg.Wait()
 }
 
@@ -45,49 +31,68 @@ func (a *windowsAgent) WinAgentSvc(nc *nats.Conn) {
 
 	a.CreateAgentTempDir()
 
+	ctx := a.Context()
 	sleepDelay := randRange(14, 22)
 	a.Logger.Debugf("Sleeping for %v seconds", sleepDelay)
-	time.Sleep(time.Duration(sleepDelay) * time.Second)
+	if !agent.SleepContext(ctx, time.Duration(sleepDelay)*time.Second) {
+		return
+	}
 
 	// a.RunMigrations()
 
-	startup := []string{CHECKIN_MODE_HELLO, CHECKIN_MODE_OSINFO, CHECKIN_MODE_WINSERVICES, CHECKIN_MODE_DISKS, CHECKIN_MODE_PUBLICIP, CHECKIN_MODE_SOFTWARE, CHECKIN_MODE_LOGGEDONUSER}
+	startup := []string{agent.CHECKIN_MODE_HELLO, agent.CHECKIN_MODE_OSINFO, agent.CHECKIN_MODE_WINSERVICES, agent.CHECKIN_MODE_DISKS, agent.CHECKIN_MODE_PUBLICIP, agent.CHECKIN_MODE_SOFTWARE, agent.CHECKIN_MODE_LOGGEDONUSER}
 	for _, s := range startup {
 		a.CheckIn(nc, s)
-		time.Sleep(time.Duration(randRange(300, 900)) * time.Millisecond)
+		if !agent.SleepContext(ctx, time.Duration(randRange(300, 900))*time.Millisecond) {
+			return
+		}
 	}
 
-	time.Sleep(1 * time.Second)
+	if !agent.SleepContext(ctx, 1*time.Second) {
+		return
+	}
 	a.CheckForRecovery()
 
-	time.Sleep(time.Duration(randRange(2, 7)) * time.Second)
-	a.CheckIn(nc, CHECKIN_MODE_STARTUP)
+	if !agent.SleepContext(ctx, time.Duration(randRange(2, 7))*time.Second) {
+		return
+	}
+	a.CheckIn(nc, agent.CHECKIN_MODE_STARTUP)
 
 	checkInTicker := time.NewTicker(time.Duration(randRange(40, 110)) * time.Second)
+	defer checkInTicker.Stop()
 	checkInOSTicker := time.NewTicker(time.Duration(randRange(250, 450)) * time.Second)
+	defer checkInOSTicker.Stop()
 	checkInWinSvcTicker := time.NewTicker(time.Duration(randRange(700, 1000)) * time.Second)
+	defer checkInWinSvcTicker.Stop()
 	checkInPubIPTicker := time.NewTicker(time.Duration(randRange(300, 500)) * time.Second)
+	defer checkInPubIPTicker.Stop()
 	checkInDisksTicker := time.NewTicker(time.Duration(randRange(200, 600)) * time.Second)
+	defer checkInDisksTicker.Stop()
 	checkInLoggedUserTicker := time.NewTicker(time.Duration(randRange(850, 1400)) * time.Second)
+	defer checkInLoggedUserTicker.Stop()
 	checkInSWTicker := time.NewTicker(time.Duration(randRange(2400, 3000)) * time.Second)
+	defer checkInSWTicker.Stop()
 	recoveryTicker := time.NewTicker(time.Duration(randRange(180, 300)) * time.Second)
+	defer recoveryTicker.Stop()
 
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case <-checkInTicker.C:
-			a.CheckIn(nc, CHECKIN_MODE_HELLO)
+			a.CheckIn(nc, agent.CHECKIN_MODE_HELLO)
 		case <-checkInOSTicker.C:
-			a.CheckIn(nc, CHECKIN_MODE_OSINFO)
+			a.CheckIn(nc, agent.CHECKIN_MODE_OSINFO)
 		case <-checkInWinSvcTicker.C:
-			a.CheckIn(nc, CHECKIN_MODE_WINSERVICES)
+			a.CheckIn(nc, agent.CHECKIN_MODE_WINSERVICES)
 		case <-checkInPubIPTicker.C:
-			a.CheckIn(nc, CHECKIN_MODE_PUBLICIP)
+			a.CheckIn(nc, agent.CHECKIN_MODE_PUBLICIP)
 		case <-checkInDisksTicker.C:
-			a.CheckIn(nc, CHECKIN_MODE_DISKS)
+			a.CheckIn(nc, agent.CHECKIN_MODE_DISKS)
 		case <-checkInLoggedUserTicker.C:
-			a.CheckIn(nc, CHECKIN_MODE_LOGGEDONUSER)
+			a.CheckIn(nc, agent.CHECKIN_MODE_LOGGEDONUSER)
 		case <-checkInSWTicker.C:
-			a.CheckIn(nc, CHECKIN_MODE_SOFTWARE)
+			a.CheckIn(nc, agent.CHECKIN_MODE_SOFTWARE)
 		case <-recoveryTicker.C:
 			a.CheckForRecovery()
 		}
@@ -102,30 +107,34 @@ func (a *windowsAgent) CheckIn(nc *nats.Conn, mode string) {
 
 	// Outgoing payload to server
 	switch mode {
-	case CHECKIN_MODE_HELLO:
-		nMode = NATS_MODE_HELLO
-		payload = jrmm.AgentHeaderNats{
-			AgentId: a.AgentID,
-			Version: a.Version,
+	case agent.CHECKIN_MODE_HELLO:
+		nMode = agent.NATS_MODE_HELLO
+		payload = rmm.CheckInHello{
+			AgentId:           a.AgentID,
+			Version:           a.Version,
+			AgentCapabilities: a.Capabilities(),
 		}
 
-	case CHECKIN_MODE_STARTUP:
+	case agent.CHECKIN_MODE_STARTUP:
 		// server will then request 2 calls via nats:
 		//  'installchoco' and 'getwinupdates'
-		payload = rmm.AgentHeader{
-			Func:    "startup",
-			AgentId: a.AgentID,
-			Version: a.Version,
+		payload = rmm.CheckInStartup{
+			AgentHeader: rmm.AgentHeader{
+				Func:    "startup",
+				AgentId: a.AgentID,
+				Version: a.Version,
+			},
+			AgentCapabilities: a.Capabilities(),
 		}
 
-	case CHECKIN_MODE_OSINFO:
+	case agent.CHECKIN_MODE_OSINFO:
 		plat, osInfo := a.OSInfo()
 		reboot, err := a.SystemRebootRequired()
 		if err != nil {
 			reboot = false
 		}
 
-		nMode = NATS_MODE_OSINFO
+		nMode = agent.NATS_MODE_OSINFO
 		payload = jrmm.AgentInfoNats{
 			AgentId:       a.AgentID,
 			Username:      a.LoggedOnUser(),
@@ -137,28 +146,28 @@ func (a *windowsAgent) CheckIn(nc *nats.Conn, mode string) {
 			RebootPending: reboot,
 		}
 
-	case CHECKIN_MODE_WINSERVICES:
-		nMode = NATS_MODE_WINSERVICES
+	case agent.CHECKIN_MODE_WINSERVICES:
+		nMode = agent.NATS_MODE_WINSERVICES
 		payload = jrmm.WinSvcNats{
 			AgentId: a.AgentID,
 			WinSvcs: a.GetServicesNATS(),
 		}
 
-	case CHECKIN_MODE_PUBLICIP:
-		nMode = NATS_MODE_PUBLICIP
+	case agent.CHECKIN_MODE_PUBLICIP:
+		nMode = agent.NATS_MODE_PUBLICIP
 		payload = jrmm.PublicIPNats{
 			AgentId:  a.AgentID,
 			PublicIP: a.PublicIP(),
 		}
 
-	case CHECKIN_MODE_DISKS:
-		nMode = NATS_MODE_DISKS
+	case agent.CHECKIN_MODE_DISKS:
+		nMode = agent.NATS_MODE_DISKS
 		payload = jrmm.StorageNats{
 			AgentId: a.AgentID,
 			Drives:  a.GetStorage(),
 		}
 
-	case CHECKIN_MODE_LOGGEDONUSER:
+	case agent.CHECKIN_MODE_LOGGEDONUSER:
 		payload = rmm.CheckInLoggedUser{
 			AgentHeader: rmm.AgentHeader{
 				Func:    "loggedonuser",
@@ -168,7 +177,7 @@ func (a *windowsAgent) CheckIn(nc *nats.Conn, mode string) {
 			Username: a.LoggedOnUser(),
 		}
 
-	case CHECKIN_MODE_SOFTWARE:
+	case agent.CHECKIN_MODE_SOFTWARE:
 		payload = rmm.CheckInSW{
 			AgentHeader: rmm.AgentHeader{
 				Func:    "software",
@@ -188,12 +197,9 @@ func (a *windowsAgent) CheckIn(nc *nats.Conn, mode string) {
 		// if err != nil {
 		// 	a.Logger.Errorln(err)
 		// } else {
-		var response []byte
-		err := codec.NewEncoderBytes(&response, new(codec.MsgpackHandle)).Encode(payload)
-		if err != nil {
-			return
+		if err := a.PublishCheckIn(nc, nMode, payload); err != nil {
+			a.Logger.Debugln("Checkin:", err)
 		}
-		nc.PublishRequest(a.AgentID, nMode, response)
 		// was testing with: nc.Publish(a.AgentID, cPayload)
 		// }
 		// mh.RawToString = true
@@ -207,15 +213,15 @@ func (a *windowsAgent) CheckIn(nc *nats.Conn, mode string) {
 	} else {
 		// Send via JSON
 		// Deprecated endpoint
-		if mode == CHECKIN_MODE_HELLO {
-			// _, rerr = a.RClient.R().SetBody(payload).Patch(API_URL_CHECKIN)
-			// a.CheckIn(CHECKIN_MODE_HELLO)
+		if mode == agent.CHECKIN_MODE_HELLO {
+			// _, rerr = a.RClient.R().SetBody(payload).Patch(agent.API_URL_CHECKIN)
+			// a.CheckIn(agent.CHECKIN_MODE_HELLO)
 			// time.Sleep(200 * time.Millisecond)
-		} else if mode == CHECKIN_MODE_STARTUP {
-			_, rerr = a.RClient.R().SetBody(payload).Post(API_URL_CHECKIN)
+		} else if mode == agent.CHECKIN_MODE_STARTUP {
+			_, rerr = a.SendApi("checkin:"+mode, http.MethodPost, agent.API_URL_CHECKIN, payload, true)
 		} else {
 			// 'put' is deprecated as of 1.7.0
-			_, rerr = a.RClient.R().SetBody(payload).Put(API_URL_CHECKIN)
+			_, rerr = a.SendApi("checkin:"+mode, http.MethodPut, agent.API_URL_CHECKIN, payload, true)
 		}
 		if rerr != nil {
 			a.Logger.Debugln("Checkin:", rerr)
@@ -1,6 +1,6 @@
 package windows
 
-const API_URL_SYSINFO = "/api/v3/sysinfo/"
+import "github.com/jetrmm/rmm-agent/agent"
 
 // SysInfo Retrieves (and sends) system information
 func (a *windowsAgent) SysInfo() {
@@ -90,7 +90,7 @@ func (a *windowsAgent) SysInfo() {
 		"sysinfo":  wmiInfo,
 	}
 
-	_, rerr := a.RClient.R().SetBody(payload).Patch(API_URL_SYSINFO)
+	_, rerr := a.RClient.R().SetBody(payload).Patch(agent.API_URL_SYSINFO)
 	if rerr != nil {
 		a.Logger.Debugln(rerr)
 	}
@@ -2,8 +2,10 @@ package windows
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/jetrmm/rmm-agent/agent"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -50,8 +52,9 @@ func (a *windowsAgent) RunTask(id int) error {
 		ExecTime: time.Since(start).Seconds(),
 	}
 
-	_, perr := a.RClient.R().SetBody(payload).Patch(url)
-	if perr != nil {
+	// queued results are delivered once the server is reachable again
+	_, perr := a.SendApi(fmt.Sprintf("task:%d", id), http.MethodPatch, url, payload, false)
+	if perr != nil && !errors.Is(perr, agent.ErrQueued) {
 		a.Logger.Debugln(perr)
 		return perr
 	}
@@ -0,0 +1,524 @@
+package harness_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/agent"
+	"github.com/jetrmm/rmm-agent/agent/linux"
+	"github.com/jetrmm/rmm-agent/internal/harness"
+	"github.com/jetrmm/rmm-agent/shared"
+	"github.com/nats-io/nats.go"
+)
+
+func TestLinuxAgent(t *testing.T) {
+	h := harness.New(t)
+
+	t.Setenv("RMM_CONFIG_DIR", t.TempDir())
+	dataDir := t.TempDir()
+	t.Setenv("RMM_DATA_DIR", dataDir)
+	t.Setenv("RMM_SECRET_SEALER", agent.SEALER_PLAIN)
+	t.Setenv("RMM_RPC_LIMITS", agent.NATS_CMD_SCRIPT_RUN+"=1")
+	t.Setenv("RMM_RPC_QUEUE_TIMEOUT", "1")
+
+	agentID := "01HARNESS00000000000000000"
+	a := linux.NewAgent(h.Logger, "0.0.0-harness", true)
+
+	// install: registers the agent, authorizes its NKey and checks in once
+	a.Install(h.InstallInfo(), agentID)
+
+	registered, ok := h.API.Agent(agentID)
+	if !ok {
+		t.Fatal("agent not registered")
+	}
+	if len(registered.NKey) == 0 {
+		t.Error("agent registered without an NKey")
+	}
+	h.WaitRequests("PATCH", agent.API_URL_SYSINFO, 1, 5*time.Second)
+
+	var hello shared.CheckInHello
+	if err := h.WaitCheckIn(agentID, agent.NATS_MODE_HELLO, 10*time.Second).Decode(&hello); err != nil {
+		t.Fatal(err)
+	}
+	if hello.AgentId != agentID {
+		t.Errorf("hello from %q, want %q", hello.AgentId, agentID)
+	}
+	if hello.Protocol != agent.RPC_PROTOCOL_VERSION {
+		t.Errorf("hello protocol %d, want %d", hello.Protocol, agent.RPC_PROTOCOL_VERSION)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		a.RunService()
+		close(stopped)
+	}()
+
+	h.WaitRpc(agentID, 10*time.Second)
+
+	t.Run("unsupported", func(t *testing.T) {
+		resp, err := h.Request(agentID, shared.RpcPayload{Func: "nosuchfunc"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != shared.RPC_STATUS_ERROR || resp.Code != shared.RPC_ERR_UNSUPPORTED {
+			t.Errorf("got %s/%s, want %s/%s", resp.Status, resp.Code, shared.RPC_STATUS_ERROR, shared.RPC_ERR_UNSUPPORTED)
+		}
+	})
+
+	t.Run("checks", func(t *testing.T) {
+		h.API.SetTask(shared.AutomatedTask{
+			ID:         1,
+			TaskScript: shared.Script{Interpreter: "sh", Code: "echo remediated"},
+			Timeout:    10,
+			Enabled:    true,
+		})
+		h.API.SetChecks(3600, shared.Check{
+			CheckPK:       1,
+			CheckType:     agent.CHECK_TYPE_SCRIPT,
+			Script:        shared.Script{Interpreter: "sh", Code: "echo failing; exit 2"},
+			Timeout:       10,
+			AssignedTasks: []shared.AssignedTask{{TaskPK: 1, Enabled: true}},
+		})
+		h.API.SetCheckStatus("failing")
+
+		resp, err := h.Request(agentID, shared.RpcPayload{Func: agent.NATS_CMD_RUNCHECKS}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != shared.RPC_STATUS_OK {
+			t.Fatalf("runchecks: %s %s", resp.Code, resp.Message)
+		}
+
+		results := h.WaitRequests("PATCH", agent.API_URL_CHECKRUNNER, 1, 10*time.Second)
+		if got := results[0].Body["stdout"]; got != "failing\n" {
+			t.Errorf("check stdout %q", got)
+		}
+		if got := results[0].Body["retcode"]; got != float64(2) {
+			t.Errorf("check retcode %v, want 2", got)
+		}
+
+		// the failing check runs its assigned task
+		tasks := h.WaitRequests("PATCH", "/api/v3/1/"+agentID+"/taskrunner/", 1, 10*time.Second)
+		if got := tasks[0].Body["stdout"]; got != "remediated\n" {
+			t.Errorf("task stdout %q", got)
+		}
+	})
+
+	t.Run("scheduler", func(t *testing.T) {
+		// the check runner schedules all the checks, not only those /checkrunner/ returns as due
+		due := shared.Check{CheckPK: 20, CheckType: agent.CHECK_TYPE_SCRIPT, Script: shared.Script{Interpreter: "sh", Code: "echo due"}, RunInterval: 1}
+		other := shared.Check{CheckPK: 21, CheckType: agent.CHECK_TYPE_SCRIPT, Script: shared.Script{Interpreter: "sh", Code: "echo other"}, RunInterval: 1}
+		h.API.SetCheckStatus("passing")
+		h.API.SetChecks(1, due, other)
+		h.API.SetDueChecks(due)
+
+		h.Eventually(60*time.Second, "runs of the check not due", func() bool {
+			n := 0
+			for _, r := range h.API.Requests("PATCH", agent.API_URL_CHECKRUNNER) {
+				if r.Body["id"] == float64(other.CheckPK) {
+					n++
+				}
+			}
+			return n >= 3
+		})
+
+		// unschedule them: the results stop once the check runner refreshed the checks
+		h.API.SetChecks(3600)
+		last, since := -1, time.Now()
+		h.Eventually(15*time.Second, "checks unscheduled", func() bool {
+			if n := len(h.API.Requests("PATCH", agent.API_URL_CHECKRUNNER)); n != last {
+				last, since = n, time.Now()
+			}
+			return time.Since(since) > 3*time.Second
+		})
+	})
+
+	t.Run("runtask", func(t *testing.T) {
+		h.API.SetTask(shared.AutomatedTask{
+			ID:         2,
+			TaskScript: shared.Script{Interpreter: "sh", Code: "echo task $1"},
+			Args:       []string{"two"},
+			Timeout:    10,
+			Enabled:    true,
+		})
+
+		// tasks are run without a reply, their result is sent to the API
+		if err := h.Publish(agentID, shared.RpcPayload{Func: agent.NATS_CMD_TASK_RUN, TaskId: 2}); err != nil {
+			t.Fatal(err)
+		}
+
+		tasks := h.WaitRequests("PATCH", "/api/v3/2/"+agentID+"/taskrunner/", 1, 10*time.Second)
+		if got := tasks[0].Body["stdout"]; got != "task two\n" {
+			t.Errorf("task stdout %q", got)
+		}
+	})
+
+	t.Run("runscriptfull", func(t *testing.T) {
+		// replies with the job, whose result is the output and exit code
+		var ref shared.JobRef
+		resp, err := h.Request(agentID, shared.RpcPayload{
+			Func:    agent.NATS_CMD_SCRIPT_RUN_FULL,
+			Data:    map[string]string{"code": "echo hello; exit 3", "shell": "sh"},
+			Timeout: 10,
+		}, &ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != shared.RPC_STATUS_OK || len(ref.ID) == 0 {
+			t.Fatalf("runscriptfull: %s %s, job %q", resp.Code, resp.Message, ref.ID)
+		}
+
+		job := h.WaitJob(agentID, ref.ID, 10*time.Second)
+		result, _ := job.Result.(map[string]any)
+		if job.Status != shared.JOB_STATUS_COMPLETED || result["stdout"] != "hello\n" || result["retcode"] != 3.0 {
+			t.Errorf("job %s, result %v, want %q/%d", job.Status, job.Result, "hello\n", 3)
+		}
+	})
+
+	t.Run("jobs", func(t *testing.T) {
+		var ref shared.JobRef
+		resp, err := h.Request(agentID, shared.RpcPayload{
+			Func:    agent.NATS_CMD_SCRIPT_RUN,
+			Data:    map[string]string{"code": "sleep 60", "shell": "sh"},
+			Timeout: 120,
+		}, &ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != shared.RPC_STATUS_OK || len(ref.ID) == 0 {
+			t.Fatalf("runscript: %s %s, job %q", resp.Code, resp.Message, ref.ID)
+		}
+
+		var job shared.JobInfo
+		h.Eventually(5*time.Second, "script process", func() bool {
+			_, err := h.Request(agentID, shared.RpcPayload{Func: agent.NATS_CMD_JOB_STATUS, Data: map[string]string{"job_id": ref.ID}}, &job)
+			return err == nil && len(job.Pids) > 0
+		})
+		if job.Status != shared.JOB_STATUS_RUNNING {
+			t.Errorf("job %s, want %s", job.Status, shared.JOB_STATUS_RUNNING)
+		}
+
+		var jobs []shared.JobInfo
+		if _, err := h.Request(agentID, shared.RpcPayload{Func: agent.NATS_CMD_JOB_LIST}, &jobs); err != nil {
+			t.Fatal(err)
+		}
+		if len(jobs) == 0 || jobs[len(jobs)-1].ID != ref.ID {
+			t.Errorf("job %s not listed: %+v", ref.ID, jobs)
+		}
+
+		resp, err = h.Request(agentID, shared.RpcPayload{Func: agent.NATS_CMD_JOB_CANCEL, Data: map[string]string{"job_id": ref.ID}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != shared.RPC_STATUS_OK {
+			t.Fatalf("canceljob: %s %s", resp.Code, resp.Message)
+		}
+
+		h.Eventually(5*time.Second, "cancelled job", func() bool {
+			_, err := h.Request(agentID, shared.RpcPayload{Func: agent.NATS_CMD_JOB_STATUS, Data: map[string]string{"job_id": ref.ID}}, &job)
+			return err == nil && job.Status != shared.JOB_STATUS_RUNNING
+		})
+		if job.Status != shared.JOB_STATUS_CANCELLED {
+			t.Errorf("job %s, want %s", job.Status, shared.JOB_STATUS_CANCELLED)
+		}
+		if out, _ := job.Result.(string); !strings.Contains(out, "Script cancelled") {
+			t.Errorf("job output %q", out)
+		}
+
+		resp, err = h.Request(agentID, shared.RpcPayload{Func: agent.NATS_CMD_JOB_STATUS, Data: map[string]string{"job_id": "nosuchjob"}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Code != shared.RPC_ERR_NOT_FOUND {
+			t.Errorf("got %s, want %s", resp.Code, shared.RPC_ERR_NOT_FOUND)
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		subject := nats.NewInbox()
+		msgs := make(chan *nats.Msg, 64)
+		sub, err := h.Conn.ChanSubscribe(subject, msgs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Unsubscribe()
+
+		var ref shared.JobRef
+		_, err = h.Request(agentID, shared.RpcPayload{
+			Func:    agent.NATS_CMD_SCRIPT_RUN,
+			Data:    map[string]string{"code": "echo one; sleep 1; echo two >&2; exit 4", "shell": "sh", "stream": subject},
+			Timeout: 10,
+		}, &ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the first line is received while the script still runs
+		var chunks []shared.ScriptOutput
+		timeout := time.After(10 * time.Second)
+		for len(chunks) == 0 || !chunks[len(chunks)-1].Done {
+			select {
+			case msg := <-msgs:
+				var out shared.ScriptOutput
+				if err := json.Unmarshal(msg.Data, &out); err != nil {
+					t.Fatal(err)
+				}
+				if len(chunks) == 0 && out.Done {
+					t.Error("no output before the script completed")
+				}
+				chunks = append(chunks, out)
+			case <-timeout:
+				t.Fatalf("stream incomplete: %+v", chunks)
+			}
+		}
+
+		var stdout, stderr string
+		for i, out := range chunks {
+			if out.Seq != i+1 || out.JobID != ref.ID {
+				t.Errorf("chunk %d: seq %d, job %q", i, out.Seq, out.JobID)
+			}
+			switch out.Stream {
+			case shared.STREAM_STDOUT:
+				stdout += out.Data
+			case shared.STREAM_STDERR:
+				stderr += out.Data
+			}
+		}
+		if stdout != "one\n" || stderr != "two\n" {
+			t.Errorf("streamed %q/%q", stdout, stderr)
+		}
+		if final := chunks[len(chunks)-1]; final.Retcode != 4 {
+			t.Errorf("retcode %d, want 4", final.Retcode)
+		}
+	})
+
+	t.Run("transfer", func(t *testing.T) {
+		var result struct {
+			Result struct {
+				Stdout string `json:"stdout"`
+			} `json:"result"`
+		}
+		decode := func(msg *nats.Msg) {
+			t.Helper()
+			var resp shared.RpcResponse
+			if err := json.Unmarshal(msg.Data, &resp); err != nil {
+				t.Fatal(err)
+			}
+			data, _ := json.Marshal(resp.Data)
+			if err := json.Unmarshal(data, &result); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// runs a script, returning the request for the status of its job once completed
+		run := func(code string) shared.RpcPayload {
+			t.Helper()
+			var ref shared.JobRef
+			if _, err := h.Request(agentID, shared.RpcPayload{
+				Func:    agent.NATS_CMD_SCRIPT_RUN_FULL,
+				Data:    map[string]string{"code": code, "shell": "sh"},
+				Timeout: 10,
+			}, &ref); err != nil {
+				t.Fatal(err)
+			}
+			h.WaitJob(agentID, ref.ID, 10*time.Second)
+			return shared.RpcPayload{Func: agent.NATS_CMD_JOB_STATUS, Data: map[string]string{"job_id": ref.ID}}
+		}
+
+		// large replies are compressed with an encoding the server accepts
+		msg, err := h.RequestMsg(agentID, run("head -c 100000 /dev/zero | tr '\\0' a"), nats.Header{agent.NATS_HDR_ACCEPT_ENCODING: {"br, zstd"}}, 10*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := msg.Header.Get(agent.NATS_HDR_CONTENT_ENCODING); got != agent.ENCODING_ZSTD {
+			t.Errorf("reply encoding %q, want %q", got, agent.ENCODING_ZSTD)
+		}
+		decode(msg)
+		if result.Result.Stdout != strings.Repeat("a", 100000) {
+			t.Errorf("decompressed stdout of %d bytes", len(result.Result.Stdout))
+		}
+
+		// replies above max_payload are split into chunks
+		large := run("head -c 2000000 /dev/urandom | od -A n -v -t x1 | tr -d ' \\n' | head -c 3000000")
+		msg, err = h.RequestMsg(agentID, large, nil, 10*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count := msg.Header.Get(agent.NATS_HDR_CHUNK_COUNT); count != "3" && count != "4" {
+			t.Errorf("reply in %q chunks", count)
+		}
+		decode(msg)
+		if len(result.Result.Stdout) != 3000000 {
+			t.Errorf("joined stdout of %d bytes, want 3000000", len(result.Result.Stdout))
+		}
+
+		// unless the requester can't join them
+		req := nats.NewMsg(agentID)
+		req.Data, _ = agent.JsonCodec.Encode(large)
+		req.Header.Set(agent.NATS_HDR_CONTENT_TYPE, agent.JsonCodec.ContentType())
+		msg, err = h.Conn.RequestMsg(req, 10*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp shared.RpcResponse
+		if err := json.Unmarshal(msg.Data, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Header.Get(agent.NATS_HDR_CHUNK_ID) != "" || resp.Code != shared.RPC_ERR_FAILED {
+			t.Errorf("plain request got %+v, want a %s error", resp, shared.RPC_ERR_FAILED)
+		}
+	})
+
+	t.Run("outbox", func(t *testing.T) {
+		counter := filepath.Join(t.TempDir(), "counter")
+		h.API.SetCheckStatus("passing")
+		h.API.SetChecks(3600, shared.Check{
+			CheckPK:   2,
+			CheckType: agent.CHECK_TYPE_SCRIPT,
+			Script:    shared.Script{Interpreter: "sh", Code: "n=$(($(cat " + counter + " 2>/dev/null) + 1)); echo $n > " + counter + "; echo run $n"},
+			Timeout:   10,
+		})
+		// the first result is refused twice: once when sent, once when retried from the outbox
+		h.API.Fail(agent.API_URL_CHECKRUNNER, http.StatusServiceUnavailable, 2)
+		before := len(h.API.Requests("PATCH", agent.API_URL_CHECKRUNNER))
+
+		for i := 0; i < 2; i++ {
+			// runchecks is busy until the previous run returns
+			h.Eventually(10*time.Second, "runchecks", func() bool {
+				resp, err := h.Request(agentID, shared.RpcPayload{Func: agent.NATS_CMD_RUNCHECKS}, nil)
+				return err == nil && resp.Status == shared.RPC_STATUS_OK
+			})
+			h.Eventually(10*time.Second, "check run", func() bool {
+				data, _ := os.ReadFile(counter)
+				return strings.TrimSpace(string(data)) == strconv.Itoa(i+1)
+			})
+		}
+
+		// both results are delivered after the backoff, in order
+		results := h.WaitRequests("PATCH", agent.API_URL_CHECKRUNNER, before+2, 20*time.Second)[before:]
+		for i, r := range results {
+			if want := fmt.Sprintf("run %d\n", i+1); r.Body["stdout"] != want {
+				t.Errorf("result %d stdout %q, want %q", i, r.Body["stdout"], want)
+			}
+		}
+		h.Eventually(5*time.Second, "empty outbox", func() bool {
+			entries, err := os.ReadDir(filepath.Join(dataDir, agent.OUTBOX_DIR))
+			return err == nil && len(entries) == 0
+		})
+	})
+
+	// runCheck runs a single check and returns its result
+	runCheck := func(check shared.Check) map[string]any {
+		h.API.SetChecks(3600, check)
+		before := len(h.API.Requests("PATCH", agent.API_URL_CHECKRUNNER))
+		h.Eventually(10*time.Second, "runchecks", func() bool {
+			resp, err := h.Request(agentID, shared.RpcPayload{Func: agent.NATS_CMD_RUNCHECKS}, nil)
+			return err == nil && resp.Status == shared.RPC_STATUS_OK
+		})
+		results := h.WaitRequests("PATCH", agent.API_URL_CHECKRUNNER, before+1, 10*time.Second)
+		return results[before].Body
+	}
+
+	t.Run("thresholds", func(t *testing.T) {
+		runChecks := func(check shared.Check) string {
+			status, _ := runCheck(check)["status"].(string)
+			return status
+		}
+
+		// some memory is always used: the check fails, but only alerts on the second run
+		check := shared.Check{CheckPK: 3, CheckType: agent.CHECK_TYPE_MEMORY, ErrorThreshold: 0.01, FailsBeforeAlert: 2, PassesBeforeClear: 2}
+		for i, want := range []string{shared.CHECK_STATUS_PASSING, shared.CHECK_STATUS_FAILING, shared.CHECK_STATUS_FAILING} {
+			if got := runChecks(check); got != want {
+				t.Errorf("failing run %d: status %q, want %q", i+1, got, want)
+			}
+		}
+
+		// and clears on the second passed run
+		check.ErrorThreshold = 100.01
+		for i, want := range []string{shared.CHECK_STATUS_FAILING, shared.CHECK_STATUS_PASSING} {
+			if got := runChecks(check); got != want {
+				t.Errorf("passing run %d: status %q, want %q", i+1, got, want)
+			}
+		}
+	})
+
+	t.Run("dns", func(t *testing.T) {
+		dns := harness.NewDNSServer(t, map[string]string{"app.example.com": "192.0.2.10"})
+
+		check := shared.Check{CheckPK: 6, CheckType: agent.CHECK_TYPE_DNS, Host: "app.example.com", Resolver: dns.Addr, Expected: "192.0.2.10"}
+		result := runCheck(check)
+		if result["status"] != shared.CHECK_STATUS_PASSING {
+			t.Errorf("status %v, want %s: %v", result["status"], shared.CHECK_STATUS_PASSING, result["output"])
+		}
+		if records, _ := result["records"].([]any); len(records) != 1 || records[0] != "192.0.2.10" {
+			t.Errorf("records %v, want [192.0.2.10]", result["records"])
+		}
+		if _, ok := result["latency"].(float64); !ok {
+			t.Errorf("no latency: %v", result)
+		}
+
+		check.Expected = "192.0.2.11"
+		if result := runCheck(check); result["status"] != shared.CHECK_STATUS_FAILING {
+			t.Errorf("unexpected value: status %v, want %s", result["status"], shared.CHECK_STATUS_FAILING)
+		}
+
+		check.Host, check.Expected = "missing.example.com", ""
+		if result := runCheck(check); result["status"] != shared.CHECK_STATUS_FAILING {
+			t.Errorf("unknown name: status %v, want %s", result["status"], shared.CHECK_STATUS_FAILING)
+		}
+	})
+
+	t.Run("busy", func(t *testing.T) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			h.Request(agentID, shared.RpcPayload{
+				Func:    agent.NATS_CMD_SCRIPT_RUN,
+				Data:    map[string]string{"code": "sleep 2", "shell": "sh"},
+				Timeout: 10,
+			}, nil)
+		}()
+		time.Sleep(200 * time.Millisecond)
+
+		// a second script waits for the first one, up to the queue timeout
+		resp, err := h.Request(agentID, shared.RpcPayload{
+			Func:    agent.NATS_CMD_SCRIPT_RUN,
+			Data:    map[string]string{"code": "true", "shell": "sh"},
+			Timeout: 10,
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != shared.RPC_STATUS_ERROR || resp.Code != shared.RPC_ERR_BUSY {
+			t.Errorf("got %s/%s, want %s/%s", resp.Status, resp.Code, shared.RPC_STATUS_ERROR, shared.RPC_ERR_BUSY)
+		}
+		<-done
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		// a script still running after the grace period is killed
+		go h.Request(agentID, shared.RpcPayload{
+			Func:    agent.NATS_CMD_SCRIPT_RUN,
+			Data:    map[string]string{"code": "sleep 60", "shell": "sh"},
+			Timeout: 120,
+		}, nil)
+		time.Sleep(200 * time.Millisecond)
+
+		start := time.Now()
+		a.(interface{ Shutdown(time.Duration) }).Shutdown(time.Second)
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Fatal("RunService did not return after Shutdown")
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("shutdown took %s", d)
+		}
+	})
+}
@@ -0,0 +1,324 @@
+package harness
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jetrmm/rmm-agent/shared"
+)
+
+// Request is a request received by the fake API
+type Request struct {
+	Method string
+	Path   string
+	Body   map[string]any
+}
+
+// FakeAgent is an agent registered through /api/v3/newagent/
+type FakeAgent struct {
+	PK      int
+	AgentID string
+	Token   string
+	NKey    string
+}
+
+// FakeAPI stands in for the /api/v3 endpoints of the RMM server
+type FakeAPI struct {
+	*httptest.Server
+
+	// InstallerToken authorizes the installer endpoints
+	InstallerToken string
+	// OnNewAgent is called when an agent registers, before the reply is sent
+	OnNewAgent func(a *FakeAgent) error
+
+	mu          sync.Mutex
+	agents      map[string]*FakeAgent
+	checks      []shared.Check
+	due         []shared.Check
+	interval    int
+	checkStatus string
+	tasks       map[int]shared.AutomatedTask
+	requests    []Request
+	failures    map[string]failure
+}
+
+// failure makes the next requests to a path fail
+type failure struct {
+	status int
+	count  int
+}
+
+func newFakeAPI() *FakeAPI {
+	api := &FakeAPI{
+		InstallerToken: "installer-token",
+		agents:         make(map[string]*FakeAgent),
+		interval:       3600,
+		checkStatus:    "passing",
+		tasks:          make(map[int]shared.AutomatedTask),
+		failures:       make(map[string]failure),
+	}
+
+	var mux router
+	mux.handle("GET", "/api/v3/installer/", api.installer(nil))
+	mux.handle("POST", "/api/v3/installer/", api.installer(nil))
+	mux.handle("POST", "/api/v3/newagent/", api.installer(api.newAgent))
+	mux.handle("GET", "/api/v3/*/runchecks/", api.agent(api.getChecks))
+	mux.handle("GET", "/api/v3/*/checkrunner/", api.agent(api.getDueChecks))
+	mux.handle("PATCH", "/api/v3/checkrunner/", api.agent(api.checkResult))
+	mux.handle("GET", "/api/v3/*/*/taskrunner/", api.agent(api.getTask))
+	mux.handle("PATCH", "/api/v3/*/*/taskrunner/", api.agent(api.record))
+	mux.handle("POST", "/api/v3/checkin/", api.agent(api.record))
+	mux.handle("PUT", "/api/v3/checkin/", api.agent(api.record))
+	mux.handle("POST", "/api/v3/software/", api.agent(api.record))
+	mux.handle("PATCH", "/api/v3/sysinfo/", api.agent(api.record))
+
+	api.Server = httptest.NewUnstartedServer(api.failing(mux))
+	return api
+}
+
+// route is an endpoint of the fake API, a "*" segment of its path matches any segment
+type route struct {
+	method  string
+	path    []string
+	handler http.HandlerFunc
+}
+
+// router dispatches the requests to the first route matching their method and path
+type router []route
+
+func (rt *router) handle(method, path string, handler http.HandlerFunc) {
+	*rt = append(*rt, route{method: method, path: strings.Split(path, "/"), handler: handler})
+}
+
+func (rt router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(r.URL.Path, "/")
+	for _, route := range rt {
+		if route.method == r.Method && route.matches(path) {
+			route.handler(w, r)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func (r route) matches(path []string) bool {
+	if len(path) != len(r.path) {
+		return false
+	}
+	for i, segment := range r.path {
+		if segment != "*" && segment != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// SetChecks sets the checks returned to the agents, and their check interval in seconds
+func (api *FakeAPI) SetChecks(interval int, checks ...shared.Check) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.interval = interval
+	api.checks = checks
+	api.due = nil
+}
+
+// SetDueChecks sets the checks returned as due by /checkrunner/, instead of all of them
+func (api *FakeAPI) SetDueChecks(checks ...shared.Check) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.due = checks
+}
+
+// SetCheckStatus sets the status replied to check results, e.g. "failing" to run the assigned tasks
+func (api *FakeAPI) SetCheckStatus(status string) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.checkStatus = status
+}
+
+// SetTask adds or replaces an automated task
+func (api *FakeAPI) SetTask(task shared.AutomatedTask) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.tasks[task.ID] = task
+}
+
+// Fail replies with the given status to the next count requests to path, which are not recorded
+func (api *FakeAPI) Fail(path string, status, count int) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.failures[path] = failure{status: status, count: count}
+}
+
+// Agent returns a registered agent
+func (api *FakeAPI) Agent(agentID string) (*FakeAgent, bool) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	a, ok := api.agents[agentID]
+	return a, ok
+}
+
+// Requests returns the received requests matching the method and path; empty values match all
+func (api *FakeAPI) Requests(method, path string) []Request {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	ret := make([]Request, 0)
+	for _, r := range api.requests {
+		if (method == "" || r.Method == method) && (path == "" || r.Path == path) {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+// installer authorizes requests with the installer token
+func (api *FakeAPI) installer(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token "+api.InstallerToken {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		if next == nil {
+			api.record(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// agent authorizes requests with the token of a registered agent
+func (api *FakeAPI) agent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Token ")
+
+		api.mu.Lock()
+		found := false
+		for _, a := range api.agents {
+			if a.Token == token {
+				found = true
+				break
+			}
+		}
+		api.mu.Unlock()
+
+		if !found {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// failing replies with the failures set by Fail
+func (api *FakeAPI) failing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api.mu.Lock()
+		f, ok := api.failures[r.URL.Path]
+		if ok {
+			if f.count--; f.count > 0 {
+				api.failures[r.URL.Path] = f
+			} else {
+				delete(api.failures, r.URL.Path)
+			}
+		}
+		api.mu.Unlock()
+
+		if ok {
+			http.Error(w, http.StatusText(f.status), f.status)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// record stores the request and replies with an empty JSON object
+func (api *FakeAPI) record(w http.ResponseWriter, r *http.Request) {
+	api.store(r)
+	writeJSON(w, map[string]any{})
+}
+
+func (api *FakeAPI) store(r *http.Request) Request {
+	req := Request{Method: r.Method, Path: r.URL.Path, Body: make(map[string]any)}
+	_ = json.NewDecoder(r.Body).Decode(&req.Body)
+
+	api.mu.Lock()
+	api.requests = append(api.requests, req)
+	api.mu.Unlock()
+	return req
+}
+
+func (api *FakeAPI) newAgent(w http.ResponseWriter, r *http.Request) {
+	req := api.store(r)
+
+	api.mu.Lock()
+	a := &FakeAgent{
+		PK:    len(api.agents) + 1,
+		Token: fmt.Sprintf("agent-token-%d", len(api.agents)+1),
+	}
+	a.AgentID, _ = req.Body["agent_id"].(string)
+	a.NKey, _ = req.Body["nkey"].(string)
+	api.agents[a.AgentID] = a
+	api.mu.Unlock()
+
+	if api.OnNewAgent != nil {
+		if err := api.OnNewAgent(a); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, map[string]any{"pk": a.PK, "token": a.Token})
+}
+
+func (api *FakeAPI) getChecks(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	writeJSON(w, shared.AllChecks{
+		CheckInfo: shared.CheckInfo{Interval: api.interval},
+		Checks:    api.checks,
+	})
+}
+
+func (api *FakeAPI) getDueChecks(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	checks := api.checks
+	if api.due != nil {
+		checks = api.due
+	}
+	writeJSON(w, shared.AllChecks{
+		CheckInfo: shared.CheckInfo{Interval: api.interval},
+		Checks:    checks,
+	})
+}
+
+// checkResult stores a check result and replies with the check status as plain text
+func (api *FakeAPI) checkResult(w http.ResponseWriter, r *http.Request) {
+	api.store(r)
+	api.mu.Lock()
+	status := api.checkStatus
+	api.mu.Unlock()
+	_, _ = w.Write([]byte(status))
+}
+
+func (api *FakeAPI) getTask(w http.ResponseWriter, r *http.Request) {
+	// /api/v3/{task}/{agent}/taskrunner/
+	id, _ := strconv.Atoi(strings.Split(r.URL.Path, "/")[3])
+	api.mu.Lock()
+	task, ok := api.tasks[id]
+	api.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, task)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,87 @@
+package harness
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+// DNSServer answers the A queries of the names it knows over UDP, enough for the dns checks
+type DNSServer struct {
+	Addr  string
+	conn  net.PacketConn
+	hosts map[string]net.IP
+}
+
+// NewDNSServer starts a resolver answering with the given addresses, by name; it stops with the test
+func NewDNSServer(t testing.TB, hosts map[string]string) *DNSServer {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &DNSServer{Addr: conn.LocalAddr().String(), conn: conn, hosts: make(map[string]net.IP)}
+	for name, ip := range hosts {
+		s.hosts[strings.ToLower(strings.TrimSuffix(name, "."))] = net.ParseIP(ip).To4()
+	}
+	t.Cleanup(func() { conn.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *DNSServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if reply := s.answer(buf[:n]); reply != nil {
+			_, _ = s.conn.WriteTo(reply, addr)
+		}
+	}
+}
+
+// answer replies to a query with a single question, NXDOMAIN if the name is unknown
+func (s *DNSServer) answer(query []byte) []byte {
+	if len(query) < 12 || binary.BigEndian.Uint16(query[4:]) != 1 {
+		return nil
+	}
+
+	// the question: labels, then type and class
+	var labels []string
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		l := int(query[end])
+		if end+1+l > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[end+1:end+1+l]))
+		end += 1 + l
+	}
+	end += 5
+	if end > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[end-4:])
+	ip, known := s.hosts[strings.ToLower(strings.Join(labels, "."))]
+
+	reply := make([]byte, 12, end+16)
+	copy(reply, query[:2])
+	binary.BigEndian.PutUint16(reply[2:], 0x8180) // response, recursion desired and available
+	binary.BigEndian.PutUint16(reply[4:], 1)
+	reply = append(reply, query[12:end]...)
+	switch {
+	case !known:
+		reply[3] |= 3 // NXDOMAIN
+	case qtype == 1:
+		binary.BigEndian.PutUint16(reply[6:], 1)
+		reply = append(reply, 0xc0, 12) // the name of the question
+		reply = binary.BigEndian.AppendUint16(reply, 1)
+		reply = binary.BigEndian.AppendUint16(reply, 1)
+		reply = binary.BigEndian.AppendUint32(reply, 60)
+		reply = binary.BigEndian.AppendUint16(reply, 4)
+		reply = append(reply, ip...)
+	}
+	return reply
+}
@@ -0,0 +1,329 @@
+// Package harness runs agents end-to-end against an embedded NATS server and a fake RMM API
+package harness
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jetrmm/rmm-agent/agent"
+	"github.com/jetrmm/rmm-agent/shared"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/sirupsen/logrus"
+)
+
+// CheckIn is a check-in published by an agent via NATS
+type CheckIn struct {
+	AgentID     string
+	Mode        string // NATS_MODE_*
+	ContentType string
+	Data        []byte
+}
+
+// Decode decodes the check-in payload with the codec it was sent with
+func (c CheckIn) Decode(v any) error {
+	codec, err := agent.CodecFor(c.ContentType)
+	if err != nil {
+		return err
+	}
+	return codec.Decode(c.Data, v)
+}
+
+// Harness is an RMM server stand-in for end-to-end agent tests
+type Harness struct {
+	T      testing.TB
+	Dir    string
+	CA     *CA
+	NATS   *NATS
+	API    *FakeAPI
+	Conn   *nats.Conn     // Server-side NATS connection
+	Logger *logrus.Logger // Logger to pass to the agents
+
+	mu        sync.Mutex
+	checkIns  []CheckIn
+	assembler *assembler
+}
+
+// New starts the NATS server and the fake API; both are stopped when the test completes
+func New(t testing.TB) *Harness {
+	t.Helper()
+
+	h := &Harness{T: t, Dir: t.TempDir(), assembler: newAssembler()}
+
+	ca, err := newCA(h.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.CA = ca
+
+	natsTLS, err := ca.ServerTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.NATS, err = newNATS(t.TempDir(), natsTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.NATS.Shutdown)
+
+	apiTLS, err := ca.ServerTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.API = newFakeAPI()
+	h.API.OnNewAgent = func(a *FakeAgent) error {
+		if len(a.NKey) == 0 {
+			return nil
+		}
+		return h.NATS.AllowNKey(a.NKey)
+	}
+	h.API.TLS = apiTLS
+	h.API.StartTLS()
+	t.Cleanup(h.API.Close)
+
+	h.Conn, err = nats.Connect(h.NATS.ClientURL(),
+		nats.UserInfo(NATS_SERVER_USER, NATS_SERVER_PASSWORD),
+		nats.RootCAs(ca.CertFile),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Conn.Close)
+
+	// agents publish their check-ins on their own subject, with the mode as reply subject
+	_, err = h.Conn.Subscribe("*", func(msg *nats.Msg) {
+		if !strings.HasPrefix(msg.Reply, "agent-") {
+			return
+		}
+		msg, ok, err := h.assembler.add(msg)
+		if err != nil {
+			t.Errorf("check-in: %s", err)
+			return
+		} else if !ok {
+			return
+		}
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.checkIns = append(h.checkIns, CheckIn{
+			AgentID:     msg.Subject,
+			Mode:        msg.Reply,
+			ContentType: msg.Header.Get(agent.NATS_HDR_CONTENT_TYPE),
+			Data:        msg.Data,
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.Logger = logrus.New()
+	h.Logger.SetLevel(logrus.DebugLevel)
+	if !testing.Verbose() {
+		h.Logger.SetOutput(io.Discard)
+	}
+	// the agent must not exit the test binary; end the calling goroutine and fail the test instead
+	var exitCode atomic.Int32
+	h.Logger.ExitFunc = func(code int) {
+		exitCode.CompareAndSwap(0, int32(code)+1)
+		runtime.Goexit()
+	}
+	t.Cleanup(func() {
+		if code := exitCode.Load(); code != 0 {
+			t.Errorf("agent exited with code %d", code-1)
+		}
+	})
+
+	return h
+}
+
+// InstallInfo returns the installer options pointing the agent to the harness
+func (h *Harness) InstallInfo() *agent.InstallInfo {
+	return &agent.InstallInfo{
+		ServerURL:   h.API.URL,
+		NatsPort:    h.NATS.Port(),
+		ClientID:    1,
+		SiteID:      1,
+		Description: "harness",
+		Token:       h.API.InstallerToken,
+		RootCert:    h.CA.CertFile,
+		Timeout:     30,
+		Silent:      true,
+		NoService:   true,
+	}
+}
+
+// CreateCommandStream creates the JetStream stream holding the agents' durable commands
+func (h *Harness) CreateCommandStream(subjects ...string) jetstream.JetStream {
+	h.T.Helper()
+
+	js, err := jetstream.New(h.Conn)
+	if err != nil {
+		h.T.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := js.CreateStream(ctx, jetstream.StreamConfig{Name: agent.NATS_JS_STREAM, Subjects: subjects}); err != nil {
+		h.T.Fatal(err)
+	}
+	return js
+}
+
+// Request sends an RPC request to an agent and decodes the data of its response into v, if not nil
+func (h *Harness) Request(agentID string, payload shared.RpcPayload, v any) (*shared.RpcResponse, error) {
+	return h.request(agentID, payload, v, 10*time.Second)
+}
+
+// Publish sends an RPC request to an agent without waiting for a response, as for runtask
+func (h *Harness) Publish(agentID string, payload shared.RpcPayload) error {
+	msg, err := newRequestMsg(agentID, payload)
+	if err != nil {
+		return err
+	}
+	return h.Conn.PublishMsg(msg)
+}
+
+// WaitRpc waits until an agent answers RPC pings
+func (h *Harness) WaitRpc(agentID string, timeout time.Duration) {
+	h.T.Helper()
+	h.Eventually(timeout, fmt.Sprintf("RPC subscription of %s", agentID), func() bool {
+		resp, err := h.request(agentID, shared.RpcPayload{Func: agent.NATS_CMD_PING}, nil, 500*time.Millisecond)
+		return err == nil && resp.Status == shared.RPC_STATUS_OK
+	})
+}
+
+// RequestMsg sends an RPC request to an agent, with the given headers, and returns its response
+// once all of its chunks have been received. The data is decompressed; the headers are kept.
+func (h *Harness) RequestMsg(agentID string, payload shared.RpcPayload, header nats.Header, timeout time.Duration) (*nats.Msg, error) {
+	msg, err := newRequestMsg(agentID, payload)
+	if err != nil {
+		return nil, err
+	}
+	msg.Header.Set(agent.NATS_HDR_ACCEPT_CHUNKS, "1")
+	for k, v := range header {
+		msg.Header[k] = v
+	}
+
+	msg.Reply = nats.NewInbox()
+	sub, err := h.Conn.SubscribeSync(msg.Reply)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+	if err := h.Conn.PublishMsg(msg); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		chunk, err := sub.NextMsg(time.Until(deadline))
+		if err != nil {
+			return nil, err
+		}
+		reply, ok, err := h.assembler.add(chunk)
+		if err != nil || ok {
+			return reply, err
+		}
+	}
+}
+
+// WaitJob waits until a job of an agent has finished and returns its status and result
+func (h *Harness) WaitJob(agentID, jobID string, timeout time.Duration) shared.JobInfo {
+	h.T.Helper()
+	var job shared.JobInfo
+	h.Eventually(timeout, fmt.Sprintf("job %s of %s", jobID, agentID), func() bool {
+		_, err := h.Request(agentID, shared.RpcPayload{Func: agent.NATS_CMD_JOB_STATUS, Data: map[string]string{"job_id": jobID}}, &job)
+		return err == nil && job.Status != shared.JOB_STATUS_RUNNING
+	})
+	return job
+}
+
+func (h *Harness) request(agentID string, payload shared.RpcPayload, v any, timeout time.Duration) (*shared.RpcResponse, error) {
+	reply, err := h.RequestMsg(agentID, payload, nil, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &shared.RpcResponse{}
+	if err := agent.JsonCodec.Decode(reply.Data, resp); err != nil {
+		return nil, err
+	}
+	if v != nil && resp.Data != nil {
+		data, err := json.Marshal(resp.Data)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, v); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+func newRequestMsg(agentID string, payload shared.RpcPayload) (*nats.Msg, error) {
+	data, err := agent.JsonCodec.Encode(payload)
+	if err != nil {
+		return nil, err
+	}
+	msg := nats.NewMsg(agentID)
+	msg.Data = data
+	msg.Header.Set(agent.NATS_HDR_CONTENT_TYPE, agent.JsonCodec.ContentType())
+	return msg, nil
+}
+
+// CheckIns returns the check-ins received from an agent with the given mode; an empty mode matches all
+func (h *Harness) CheckIns(agentID, mode string) []CheckIn {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ret := make([]CheckIn, 0)
+	for _, c := range h.checkIns {
+		if c.AgentID == agentID && (mode == "" || c.Mode == mode) {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// WaitCheckIn waits for the first check-in of an agent with the given mode
+func (h *Harness) WaitCheckIn(agentID, mode string, timeout time.Duration) CheckIn {
+	h.T.Helper()
+	var ret CheckIn
+	h.Eventually(timeout, fmt.Sprintf("%s check-in from %s", mode, agentID), func() bool {
+		c := h.CheckIns(agentID, mode)
+		if len(c) == 0 {
+			return false
+		}
+		ret = c[0]
+		return true
+	})
+	return ret
+}
+
+// WaitRequests waits for at least n requests to the fake API and returns them
+func (h *Harness) WaitRequests(method, path string, n int, timeout time.Duration) []Request {
+	h.T.Helper()
+	var ret []Request
+	h.Eventually(timeout, fmt.Sprintf("%d %s %s request(s)", n, method, path), func() bool {
+		ret = h.API.Requests(method, path)
+		return len(ret) >= n
+	})
+	return ret
+}
+
+// Eventually polls cond until it returns true, failing the test after the timeout
+func (h *Harness) Eventually(timeout time.Duration, what string, cond func() bool) {
+	h.T.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			h.T.Fatalf("timed out after %s waiting for %s", timeout, what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,105 @@
+package harness
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nkeys"
+)
+
+// Credentials of the server-side NATS client used by the harness
+const (
+	NATS_SERVER_USER     = "rmm"
+	NATS_SERVER_PASSWORD = "rmm-harness"
+)
+
+// NATS is an embedded NATS server with JetStream, authenticating the agents with their NKeys
+type NATS struct {
+	*server.Server
+
+	mu    sync.Mutex
+	nkeys map[string]bool
+}
+
+func newNATS(dir string, tlsConfig *tls.Config) (*NATS, error) {
+	n := &NATS{nkeys: make(map[string]bool)}
+
+	// NKeys are authorized at runtime, as agents register; a config reload would
+	// move the connected clients to a new global account
+	opts := &server.Options{
+		Host:                       "127.0.0.1",
+		Port:                       server.RANDOM_PORT,
+		NoLog:                      true,
+		NoSigs:                     true,
+		TLSConfig:                  tlsConfig,
+		TLSTimeout:                 2,
+		JetStream:                  true,
+		StoreDir:                   dir,
+		AlwaysEnableNonce:          true,
+		CustomClientAuthentication: n,
+	}
+
+	s, err := server.NewServer(opts)
+	if err != nil {
+		return nil, err
+	}
+	s.Start()
+	if !s.ReadyForConnections(10 * time.Second) {
+		s.Shutdown()
+		return nil, fmt.Errorf("NATS server not ready")
+	}
+	n.Server = s
+	return n, nil
+}
+
+// Port returns the client port of the server
+func (n *NATS) Port() int {
+	return n.Addr().(*net.TCPAddr).Port
+}
+
+// AllowNKey authorizes an agent's public NKey
+func (n *NATS) AllowNKey(pub string) error {
+	if !nkeys.IsValidPublicUserKey(pub) {
+		return fmt.Errorf("invalid user NKey %q", pub)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nkeys[pub] = true
+	return nil
+}
+
+// Check implements server.Authentication, accepting the harness user and the authorized NKeys
+func (n *NATS) Check(c server.ClientAuthentication) bool {
+	opts := c.GetOpts()
+
+	if len(opts.Nkey) == 0 {
+		if opts.Username != NATS_SERVER_USER || opts.Password != NATS_SERVER_PASSWORD {
+			return false
+		}
+		c.RegisterUser(&server.User{Username: opts.Username})
+		return true
+	}
+
+	n.mu.Lock()
+	allowed := n.nkeys[opts.Nkey]
+	n.mu.Unlock()
+	if !allowed {
+		return false
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(opts.Sig)
+	if err != nil {
+		return false
+	}
+	pk, err := nkeys.FromPublicKey(opts.Nkey)
+	if err != nil || pk.Verify(c.GetNonce(), sig) != nil {
+		return false
+	}
+	c.RegisterUser(&server.User{Username: opts.Nkey})
+	return true
+}
@@ -0,0 +1,88 @@
+package harness
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/jetrmm/rmm-agent/agent"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nats-io/nats.go"
+)
+
+// assembler joins chunked messages and decodes their Content-Encoding, as the server does.
+// The headers of the assembled message are kept, so that tests can tell how it was sent.
+type assembler struct {
+	mu     sync.Mutex
+	chunks map[string][][]byte
+}
+
+func newAssembler() *assembler {
+	return &assembler{chunks: make(map[string][][]byte)}
+}
+
+// add returns the complete message once all of its chunks have been received
+func (a *assembler) add(msg *nats.Msg) (*nats.Msg, bool, error) {
+	if id := msg.Header.Get(agent.NATS_HDR_CHUNK_ID); len(id) > 0 {
+		index, err := strconv.Atoi(msg.Header.Get(agent.NATS_HDR_CHUNK_INDEX))
+		if err != nil {
+			return nil, false, err
+		}
+		count, err := strconv.Atoi(msg.Header.Get(agent.NATS_HDR_CHUNK_COUNT))
+		if err != nil || index < 0 || index >= count {
+			return nil, false, fmt.Errorf("invalid chunk %d/%d", index, count)
+		}
+
+		a.mu.Lock()
+		parts, ok := a.chunks[id]
+		if !ok {
+			parts = make([][]byte, count)
+			a.chunks[id] = parts
+		}
+		parts[index] = msg.Data
+		for _, p := range parts {
+			if p == nil {
+				a.mu.Unlock()
+				return nil, false, nil
+			}
+		}
+		delete(a.chunks, id)
+		a.mu.Unlock()
+
+		joined := *msg
+		joined.Data = bytes.Join(parts, nil)
+		msg = &joined
+	}
+
+	data, err := decompress(msg.Header.Get(agent.NATS_HDR_CONTENT_ENCODING), msg.Data)
+	if err != nil {
+		return nil, false, err
+	}
+	msg.Data = data
+	return msg, true, nil
+}
+
+func decompress(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case "":
+		return data, nil
+	case agent.ENCODING_ZSTD:
+		r, err := zstd.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case agent.ENCODING_GZIP:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+}
@@ -4,7 +4,6 @@ import (
 	"flag"
 	"fmt"
 	"github.com/jetrmm/rmm-agent/agent"
-	. "github.com/jetrmm/rmm-agent/agent/windows"
 	"github.com/kardianos/service"
 	"github.com/sirupsen/logrus"
 	"os"
@@ -58,6 +57,9 @@ func main() {
 	timeout := installSet.Duration("timeout", 1000, "Installer timeout in seconds")
 	aDesc := installSet.String("desc", hostname, "Agent's description to display on the RMM server")
 	cert := installSet.String("cert", "", "Path to the Root Certificate Authority's .pem")
+	natsPort := installSet.Int("nats-port", agent.NATS_DEFAULT_PORT, "NATS port of the RMM server")
+	noService := installSet.Bool("nosvc", false, "Do not install the agent service")
+	creds := installSet.String("creds", "", "Path to the NATS user credentials (.creds); an NKey is generated if omitted")
 
 	// Update
 	updateSet := flag.NewFlagSet("update", flag.ContinueOnError)
@@ -107,7 +109,7 @@ func main() {
 	}
 
 	// was: var a = NewAgent(log, version).(agent.IAgent)
-	var a = NewAgent(log, version, isAdmin) // .(agent.IAgent)
+	var a = newAgent(log, version, isAdmin) // .(agent.IAgent)
 	// test: var a, _ = GetAgent(log, version)
 
 	if len(os.Args) == 1 {
@@ -218,6 +220,9 @@ func main() {
 				Description: *aDesc,
 				Token:       *token,
 				RootCert:    *cert,
+				CredsFile:   *creds,
+				NatsPort:    *natsPort,
+				NoService:   *noService,
 				Timeout:     *timeout,
 				Silent:      *silent,
 			},
@@ -236,14 +241,6 @@ func main() {
 	return provider.Agent(logger, version), nil
 }*/
 
-func checkForAdmin() bool {
-	_, err := os.Open("\\\\.\\PHYSICALDRIVE0")
-	if err != nil {
-		return false
-	}
-	return true
-}
-
 func isRoot() bool {
 	currentUser, err := user.Current()
 	if err != nil {
@@ -269,7 +266,11 @@ func setupLogging(level, to *string) {
 			logFile, _ = os.OpenFile(filepath.Join("/var/log", "rmm", AGENT_LOG_FILE), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0660)
 		case "darwin":
 		case "linux":
-
+			_ = os.MkdirAll(filepath.Join("/var/log", "rmm"), 0750)
+			logFile, _ = os.OpenFile(filepath.Join("/var/log", "rmm", AGENT_LOG_FILE), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+		}
+		if logFile == nil {
+			logFile = os.Stdout
 		}
 		log.SetOutput(logFile)
 	}
@@ -280,10 +281,11 @@ func installUsage() {
 	case "windows":
 		u := `Usage: %s -m install -api <https://api.example.com> -client-id X -site-id X -auth <TOKEN>`
 		fmt.Printf(u, AGENT_FILENAME)
+	case "linux":
+		u := `Usage: %s -m install -api <https://api.example.com> -client-id X -site-id X -auth <TOKEN>`
+		fmt.Printf(u, AGENT_FILENAME)
 	case "freebsd":
 	case "darwin":
-	case "linux":
-		// todo
 	}
 }
 
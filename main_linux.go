@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os"
+
+	"github.com/jetrmm/rmm-agent/agent"
+	"github.com/jetrmm/rmm-agent/agent/linux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	AGENT_FILENAME = linux.AGENT_FILENAME
+	AGENT_FOLDER   = linux.AGENT_CONFIG_DIR
+)
+
+func newAgent(logger *logrus.Logger, version string, isAdmin bool) agent.IAgent {
+	return linux.NewAgent(logger, version, isAdmin)
+}
+
+func checkForAdmin() bool {
+	return os.Geteuid() == 0
+}
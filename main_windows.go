@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+
+	"github.com/jetrmm/rmm-agent/agent"
+	"github.com/jetrmm/rmm-agent/agent/windows"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	AGENT_FILENAME = windows.AGENT_FILENAME
+	AGENT_FOLDER   = windows.AGENT_FOLDER
+)
+
+func newAgent(logger *logrus.Logger, version string, isAdmin bool) agent.IAgent {
+	return windows.NewAgent(logger, version, isAdmin)
+}
+
+func checkForAdmin() bool {
+	_, err := os.Open("\\\\.\\PHYSICALDRIVE0")
+	if err != nil {
+		return false
+	}
+	return true
+}
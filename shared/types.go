@@ -1,15 +1,19 @@
 package shared
 
-import jetrmm "github.com/jetrmm/rmm-shared"
+import (
+	"time"
+
+	jetrmm "github.com/jetrmm/rmm-shared"
+)
 
 // from NatsMsg
 type RpcPayload struct {
-	Func    string            `json:"func"`
-	Data    map[string]string `json:"payload"`
-	Timeout int               `json:"timeout"`
-	// ScriptArgs      []string          `json:"script_args"`
-	// ProcPID         int32             `json:"procpid"`
-	// TaskPK          int               `json:"taskpk"` // was: taskpk
+	Func       string            `json:"func"`
+	Data       map[string]string `json:"payload"`
+	Timeout    int               `json:"timeout"`
+	ScriptArgs []string          `json:"script_args"`
+	ProcPID    int32             `json:"proc_pid"` // was: procpid
+	TaskId     int               `json:"task_id"`  // was: taskpk
 	// ScheduledTask   SchedTask         `json:"schedtaskpayload"`
 	// RecoveryCommand string            `json:"recoverycommand"`
 	// UpdateGUIDs     []string          `json:"guids"`           // todo: move
@@ -17,6 +21,82 @@ type RpcPayload struct {
 	// PendingActionPK int               `json:"pending_action_pk"`
 }
 
+// RPC response statuses
+const (
+	RPC_STATUS_OK    = "ok"
+	RPC_STATUS_ERROR = "error"
+)
+
+// RPC error codes
+const (
+	RPC_ERR_BUSY        = "busy"        // Already running, retry later
+	RPC_ERR_FAILED      = "failed"      // The function returned an error
+	RPC_ERR_INTERNAL    = "internal"    // The agent failed unexpectedly
+	RPC_ERR_INVALID     = "invalid"     // Malformed request
+	RPC_ERR_NOT_FOUND   = "notfound"    // Unknown job
+	RPC_ERR_UNSUPPORTED = "unsupported" // Unknown function
+)
+
+// RpcResponse is the envelope of every RPC reply
+type RpcResponse struct {
+	Status   string `json:"status"`            // RPC_STATUS_*
+	Code     string `json:"code,omitempty"`    // RPC_ERR_*, if Status is RPC_STATUS_ERROR
+	Message  string `json:"message,omitempty"` // Error message
+	Duration int64  `json:"duration_ms"`       // Time spent handling the request
+	Data     any    `json:"data"`              // Function result
+}
+
+// Job statuses
+const (
+	JOB_STATUS_RUNNING   = "running"
+	JOB_STATUS_COMPLETED = "completed"
+	JOB_STATUS_FAILED    = "failed"
+	JOB_STATUS_CANCELLED = "cancelled"
+)
+
+// Check statuses, as evaluated by the agent for checks with thresholds and the check types it evaluates itself
+const (
+	CHECK_STATUS_PASSING = "passing"
+	CHECK_STATUS_WARNING = "warning"
+	CHECK_STATUS_FAILING = "failing"
+)
+
+// JobRef is the immediate reply of long-running RPC functions
+type JobRef struct {
+	ID string `json:"job_id"`
+}
+
+// JobInfo is the state of a long-running RPC, see the jobs, jobstatus and canceljob functions
+type JobInfo struct {
+	ID       string     `json:"job_id"`
+	Func     string     `json:"func"`
+	Status   string     `json:"status"` // JOB_STATUS_*
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Pids     []int32    `json:"pids,omitempty"`   // Running processes of the job
+	Result   any        `json:"result,omitempty"` // Output of the function, once completed (jobstatus only)
+	Error    string     `json:"error,omitempty"`
+}
+
+// Script output streams
+const (
+	STREAM_STDOUT = "stdout"
+	STREAM_STDERR = "stderr"
+)
+
+// ScriptOutput is published to the "stream" subject of runscript and runscriptfull requests:
+// chunks of output while the script runs, then a final message with Done set
+type ScriptOutput struct {
+	JobID    string  `json:"job_id"`
+	Seq      int     `json:"seq"`              // Message order, from 1
+	Stream   string  `json:"stream,omitempty"` // STREAM_*
+	Data     string  `json:"data,omitempty"`
+	Done     bool    `json:"done,omitempty"`
+	Retcode  int     `json:"retcode"`                  // Final message only
+	ExecTime float64 `json:"execution_time,omitempty"` // Final message only
+	Error    string  `json:"error,omitempty"`
+}
+
 /*type ScheduledTaskMsg struct {
 	ScheduledTask SchedTask `json:"schedtaskpayload"`
 }*/
@@ -27,6 +107,30 @@ type AgentHeader struct {
 	Version string `json:"version"`
 }
 
+// AgentCapabilities tell the server what the agent build supports
+type AgentCapabilities struct {
+	Protocol    int      `json:"protocol"` // RPC protocol version
+	GoOS        string   `json:"goos"`
+	GoArch      string   `json:"goarch"`
+	Functions   []string `json:"functions"`        // Registered RPC functions
+	CheckTypes  []string `json:"check_types"`      // Supported check types
+	PkgManagers []string `json:"package_managers"` // Available package managers
+	Encodings   []string `json:"encodings"`        // Content encodings of compressed payloads, chunking is supported
+}
+
+// CheckInHello is sent via NATS when the agent service starts and periodically afterwards
+type CheckInHello struct {
+	AgentId string `json:"agent_id"`
+	Version string `json:"version"`
+	AgentCapabilities
+}
+
+// CheckInStartup is sent via the REST API when the agent service starts
+type CheckInStartup struct {
+	AgentHeader
+	AgentCapabilities
+}
+
 type RecoveryAction struct {
 	Mode     string `json:"mode"` // command, rpc
 	ShellCMD string `json:"shellcmd"`
@@ -66,6 +170,64 @@ type Check struct {
 	EventID        int            `json:"event_id"`
 	SearchLastDays int            `json:"search_last_days"`
 	Status         string         `json:"status"`
+	RunInterval    int            `json:"run_interval"` // Seconds; the agent's check interval if 0
+	// Thresholds of the diskspace (minimum % free), cpuload and memory (maximum % used) checks, of
+	// the latency of the http, tcp and dns checks and the average round trip of the ping checks (ms),
+	// and of the certexpiry checks (minimum days left); 0 if unset. The agent then reports the check status
+	// (CHECK_STATUS_*) once FailsBeforeAlert consecutive runs fail, and clears it once PassesBeforeClear
+	// consecutive runs pass.
+	WarningThreshold  float64 `json:"warning_threshold"`
+	ErrorThreshold    float64 `json:"error_threshold"`
+	FailsBeforeAlert  int     `json:"fails_b4_alert"`
+	PassesBeforeClear int     `json:"passes_b4_clear"`
+	// ping, to IP
+	PingCount            int     `json:"ping_count"`             // 4 if 0
+	PingInterval         int     `json:"ping_interval"`          // Milliseconds between echo requests, 1000 if 0
+	PingTimeout          int     `json:"ping_timeout"`           // Milliseconds to wait for each reply, 2000 if 0
+	LossWarningThreshold float64 `json:"loss_warning_threshold"` // % of packets lost; 0 if unset
+	LossErrorThreshold   float64 `json:"loss_error_threshold"`
+	// http
+	URL            string            `json:"url"`
+	Method         string            `json:"method"` // GET if empty
+	Headers        map[string]string `json:"headers"`
+	Body           string            `json:"body"`
+	ExpectedStatus []int             `json:"expected_status"` // Any 2xx if empty
+	BodyContains   string            `json:"body_contains"`
+	BodyRegex      string            `json:"body_regex"`
+	TLSInsecure    bool              `json:"tls_insecure"`    // Skip the certificate verification
+	TLSServerName  string            `json:"tls_server_name"` // Verify the certificate for this name rather than the URL's host
+	TLSCACert      string            `json:"tls_ca_cert"`     // PEM file of the CAs to trust rather than the system's
+	// tcp, dns, certexpiry
+	Host       string `json:"host"`        // Host to connect to, or name to resolve
+	Port       int    `json:"port"`        // tcp, certexpiry (443 if empty)
+	Send       string `json:"send"`        // tcp: sent once connected
+	Banner     string `json:"banner"`      // tcp: regex the data received must match
+	Resolver   string `json:"resolver"`    // dns: server address, the system's resolver if empty
+	RecordType string `json:"record_type"` // dns: A if empty
+	Expected   string `json:"expected"`    // dns: value one of the records must have
+	// certexpiry, file, logfile; certexpiry also uses the TLS options of the http checks
+	Path string `json:"path"` // certexpiry: PEM or DER certificate file, or directory of them, rather than Host; logfile: glob
+	// file: the limits are not checked if 0 or empty
+	MaxAge    int    `json:"max_age"` // Seconds since the last modification
+	MinSize   int64  `json:"min_size"`
+	MaxSize   int64  `json:"max_size"`
+	Mode      string `json:"mode"`       // Octal permissions, e.g. "0440"; not on Windows
+	Owner     string `json:"owner"`      // User name or id; not on Windows
+	Group     string `json:"group"`      // Group name or id; not on Windows
+	TrackHash bool   `json:"track_hash"` // Fail when the SHA-256 of the file changes
+	// logfile: the thresholds apply to the number of matching lines in the window, any is failing if unset
+	Include string `json:"include"` // Regex of the lines to count, all if empty
+	Exclude string `json:"exclude"` // Regex of the lines not to count
+	Window  int    `json:"window"`  // Seconds; only the lines read by the current run if 0
+	// process: the processes matching all the criteria set are counted
+	ProcessName    string  `json:"process_name"`
+	ProcessExe     string  `json:"process_exe"`     // Executable path
+	ProcessCmdline string  `json:"process_cmdline"` // Regex
+	MinCount       int     `json:"min_count"`       // 1 if both counts are 0
+	MaxCount       int     `json:"max_count"`       // Unlimited if 0
+	MaxCPUPercent  float64 `json:"max_cpu_percent"` // Per process; the limits are not enforced if 0
+	MaxRSS         uint64  `json:"max_rss"`         // Bytes
+	MaxOpenFiles   int     `json:"max_open_files"`  // Not supported on Windows
 	// Threshold        int            `json:"threshold"`
 	// PassStartPending bool           `json:"pass_if_start_pending"`
 	// PassNotExist     bool           `json:"pass_if_svc_not_exist"`